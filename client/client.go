@@ -8,6 +8,7 @@ import (
 	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
 	"net/http"
 	"net/url"
 	"os"
@@ -28,6 +29,16 @@ type FlowCollectExtension struct {
 	RemoteServer string `yaml:"remote-server"`
 	RemoteToken  string `yaml:"remote-token"`
 	DeviceID     string `yaml:"device-id"`
+	// CollectorMode 采集模式：stream（默认，订阅 Mihomo WebSocket 流）或 poll（每 10 秒轮询）
+	CollectorMode string `yaml:"collector-mode"`
+	// OutboxMaxMB 磁盘发件箱容量上限（MiB），默认 64
+	OutboxMaxMB int `yaml:"outbox-max-mb"`
+	// LatencyGroups 定期测试延迟的策略组（测试组内的全部节点），留空不测试
+	LatencyGroups []string `yaml:"latency-groups"`
+	// LatencyInterval 延迟测试间隔（秒），默认 300
+	LatencyInterval int `yaml:"latency-interval"`
+	// LatencyURL 延迟测试地址，默认 https://www.gstatic.com/generate_204
+	LatencyURL string `yaml:"latency-url"`
 }
 
 // ClashConfig 仅解析 FlowCollect 需要的字段，其余忽略
@@ -46,18 +57,28 @@ type Config struct {
 	RemoteToken   string
 	DeviceID      string
 	LocalLogFile  string
+	CollectorMode string
+	OutboxMaxMB   int
+
+	LatencyGroups   []string
+	LatencyInterval int
+	LatencyURL      string
 }
 
 // ── 全局变量 ──
 
+// clientVersion 客户端版本，发布时通过 -ldflags "-X main.clientVersion=x.y.z" 注入，
+// 连接 /ws 时以 X-Client-Version 头上报给服务端
+var clientVersion = "dev"
+
 var (
-	conf           Config
-	confLock       sync.RWMutex
-	lastStats      = make(map[string]Conn)
-	configPath     string
-	reportChan     = make(chan ReportData, 100)
-	mihomoClient   *http.Client // cached HTTP client for Mihomo API
-	mihomoAPIAddr  string       // resolved Mihomo API base URL
+	conf          Config
+	confLock      sync.RWMutex
+	lastStats     = make(map[string]Conn)
+	configPath    string
+	mihomoClient  *http.Client // cached HTTP client for Mihomo API
+	mihomoAPIAddr string       // resolved Mihomo API base URL
+	mihomoMu      sync.Mutex   // 保护 mihomoClient / mihomoAPIAddr（采集、命令、延迟测试等协程并发调用）
 )
 
 // resolveMihomoAPI 将 Clash 的 external-controller 转换为可用的 HTTP URL
@@ -80,6 +101,8 @@ func resolveMihomoAPI(controller string) string {
 // 优先尝试 HTTP 连接，失败后回退到 IPC（Windows 命名管道 / Unix Socket）。
 // 成功后缓存结果；都失败时不缓存，下次调用会重试。
 func resolveMihomoClient(httpURL string) (*http.Client, string) {
+	mihomoMu.Lock()
+	defer mihomoMu.Unlock()
 	if mihomoClient != nil {
 		return mihomoClient, mihomoAPIAddr
 	}
@@ -136,8 +159,10 @@ func loadConfig() error {
 	defer confLock.Unlock()
 
 	// 配置变更时重置缓存的 Mihomo 客户端，下次请求时重新探测
+	mihomoMu.Lock()
 	mihomoClient = nil
 	mihomoAPIAddr = ""
+	mihomoMu.Unlock()
 
 	conf = Config{
 		MihomoAPIAddr: resolveMihomoAPI(cc.ExternalController),
@@ -146,6 +171,27 @@ func loadConfig() error {
 		RemoteToken:   cc.FlowCollect.RemoteToken,
 		DeviceID:      cc.FlowCollect.DeviceID,
 		LocalLogFile:  "node_traffic_stats.json",
+		CollectorMode: strings.ToLower(cc.FlowCollect.CollectorMode),
+		OutboxMaxMB:   cc.FlowCollect.OutboxMaxMB,
+
+		LatencyGroups:   cc.FlowCollect.LatencyGroups,
+		LatencyInterval: cc.FlowCollect.LatencyInterval,
+		LatencyURL:      cc.FlowCollect.LatencyURL,
+	}
+	if conf.CollectorMode != "poll" {
+		conf.CollectorMode = "stream"
+	}
+	if conf.OutboxMaxMB <= 0 {
+		conf.OutboxMaxMB = outboxDefaultMaxMB
+	}
+	if outbox != nil {
+		outbox.SetMaxBytes(int64(conf.OutboxMaxMB) << 20)
+	}
+	if conf.LatencyInterval <= 0 {
+		conf.LatencyInterval = latencyDefaultInterval
+	}
+	if conf.LatencyURL == "" {
+		conf.LatencyURL = latencyDefaultURL
 	}
 
 	// 兜底：如果 x-flow-collect 未配置，使用默认值
@@ -243,14 +289,41 @@ func watchConfig() {
 
 // ── 业务模型 ──
 
+// ConnMetadata 对应 Mihomo /connections 中每条连接的 metadata 字段（仅取审计需要的部分）
+type ConnMetadata struct {
+	Network         string `json:"network"`
+	Type            string `json:"type"`
+	SourceIP        string `json:"sourceIP"`
+	SourcePort      string `json:"sourcePort"`
+	DestinationIP   string `json:"destinationIP"`
+	DestinationPort string `json:"destinationPort"`
+	Host            string `json:"host"`
+	SniffHost       string `json:"sniffHost"`
+	Process         string `json:"process"`
+	ProcessPath     string `json:"processPath"`
+}
+
 type Conn struct {
-	ID       string   `json:"id"`
-	Upload   int64    `json:"upload"`
-	Download int64    `json:"download"`
-	Chains   []string `json:"chains"`
+	ID          string       `json:"id"`
+	Metadata    ConnMetadata `json:"metadata"`
+	Upload      int64        `json:"upload"`
+	Download    int64        `json:"download"`
+	Start       time.Time    `json:"start"`
+	Chains      []string     `json:"chains"`
+	Rule        string       `json:"rule"`
+	RulePayload string       `json:"rulePayload"`
+}
+
+// nodeName 返回连接实际使用的出口节点（chains 的最后一项），无链路时视为 DIRECT
+func (c Conn) nodeName() string {
+	if len(c.Chains) > 0 {
+		return c.Chains[len(c.Chains)-1]
+	}
+	return "DIRECT"
 }
 
 type ReportData struct {
+	FrameHeader        // Type 固定为 "traffic"
 	Timestamp   int64  `json:"timestamp"`
 	DeviceID    string `json:"device_id"`
 	NodeName    string `json:"node_name"`
@@ -260,11 +333,57 @@ type ReportData struct {
 	ActiveConns int    `json:"active_connections"`
 }
 
+// ConnRecord 已关闭连接的审计记录（元数据 + 最终上下行 + 持续时间）
+type ConnRecord struct {
+	FrameHeader          // Type 固定为 "conn"
+	DeviceID    string   `json:"device_id"`
+	ConnID      string   `json:"conn_id"`
+	Start       int64    `json:"start"`    // Unix 毫秒
+	End         int64    `json:"end"`      // Unix 毫秒
+	Duration    int64    `json:"duration"` // 毫秒
+	Network     string   `json:"network"`
+	ConnType    string   `json:"conn_type"`
+	SourceIP    string   `json:"source_ip"`
+	SourcePort  string   `json:"source_port"`
+	DestIP      string   `json:"dest_ip"`
+	DestPort    string   `json:"dest_port"`
+	Host        string   `json:"host"`
+	Rule        string   `json:"rule"`
+	RulePayload string   `json:"rule_payload"`
+	Process     string   `json:"process"`
+	ProcessPath string   `json:"process_path"`
+	Chains      []string `json:"chains"`
+	NodeName    string   `json:"node_name"`
+	Upload      int64    `json:"upload"`
+	Download    int64    `json:"download"`
+	IsProxy     bool     `json:"is_proxy"`
+}
+
+// ReportBatch 一个上报周期内的全部数据，作为单个帧发送（type 为 "batch"）
+type ReportBatch struct {
+	FrameHeader
+	Timestamp int64        `json:"timestamp"`
+	DeviceID  string       `json:"device_id"`
+	Traffic   []ReportData `json:"traffic,omitempty"`
+	Conns     []ConnRecord `json:"conns,omitempty"`
+}
+
+// maxConnsPerBatch 单个批次最多携带的连接记录数
+const maxConnsPerBatch = 500
+
 type NodeStats struct {
 	Up   int64
 	Down int64
 }
 
+// connectionsSnapshot Mihomo /connections 的响应体（HTTP 与 WebSocket 流格式一致）。
+// UploadTotal / DownloadTotal 是核心启动以来的累计值，包含已关闭的连接
+type connectionsSnapshot struct {
+	DownloadTotal int64  `json:"downloadTotal"`
+	UploadTotal   int64  `json:"uploadTotal"`
+	Connections   []Conn `json:"connections"`
+}
+
 func main() {
 	// ── 命令行参数 ──
 	configFile := flag.String("c", "", "Clash config.yaml 路径 (必填或通过环境变量 FLOW_COLLECT_CONFIG)")
@@ -318,122 +437,202 @@ func main() {
 
 	// ── 启动监控 ──
 	confLock.RLock()
-	fmt.Printf("FlowCollect 审计客户端启动 [%s]...\n", conf.DeviceID)
+	fmt.Printf("FlowCollect 审计客户端 %s 启动 [%s]...\n", clientVersion, conf.DeviceID)
+	localLogFile := conf.LocalLogFile
+	outboxMaxBytes := int64(conf.OutboxMaxMB) << 20
 	confLock.RUnlock()
 
+	var err error
+	outbox, err = openOutbox(outboxDir(localLogFile), outboxMaxBytes)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "打开发件箱失败: %v\n", err)
+		os.Exit(1)
+	}
+
 	go websocketManager()
+	go runLatencyProbe()
 
 	fmt.Println("正在初始化连接快照 (静默模式)...")
 	fetchAndProcess(true)
 
-	ticker := time.NewTicker(10 * time.Second)
 	fmt.Println("初始化完成，开始正式监控。")
-	for range ticker.C {
-		fetchAndProcess(false)
-	}
+	runCollector()
 }
 
+// fetchAndProcess 轮询模式：拉取一次 /connections 快照，计算增量后立即上报
 func fetchAndProcess(silent bool) {
 	confLock.RLock()
 	currConf := conf
 	confLock.RUnlock()
 
-	// 获取支持 HTTP + IPC 的客户端
-	httpURL := resolveMihomoAPI(currConf.MihomoAPIAddr)
-	client, apiAddr := resolveMihomoClient(httpURL)
-
-	req, _ := http.NewRequest("GET", apiAddr+"/connections", nil)
-	req.Header.Set("Authorization", "Bearer "+currConf.MihomoSecret)
-
-	resp, err := client.Do(req)
+	snap, err := fetchConnections(currConf)
 	if err != nil {
 		if !silent {
-			fmt.Println("API 访问失败:", err)
+			fmt.Println(err)
 		}
 		return
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		if !silent {
-			fmt.Printf("API 鉴权失败! 状态码: %d\n", resp.StatusCode)
-		}
-		return
+	if !silent {
+		fmt.Printf("[%s] 活跃连接数: %d\n", time.Now().Format("15:04:05"), len(snap.Connections))
 	}
 
-	var data struct {
-		Connections []Conn `json:"connections"`
+	processSnapshot(snap, time.Now(), silent, currConf)
+	if !silent {
+		flushStats(currConf)
 	}
-	if err := json.NewDecoder(resp.Body).Decode(&data); err != nil {
-		fmt.Println("解析 JSON 失败:", err)
-		return
+}
+
+// mihomoRequest 向 Mihomo API 发送请求（HTTP / IPC 自动选择，附带 secret），非 2xx 状态码视为失败
+func mihomoRequest(currConf Config, method, path string, body io.Reader) (*http.Response, error) {
+	return mihomoRequestTimeout(currConf, method, path, body, 0)
+}
+
+// mihomoRequestTimeout 同 mihomoRequest，timeout > 0 时以它替代缓存客户端的默认超时（如延迟测试需要等 Mihomo 自己的超时先到）
+func mihomoRequestTimeout(currConf Config, method, path string, body io.Reader, timeout time.Duration) (*http.Response, error) {
+	httpURL := resolveMihomoAPI(currConf.MihomoAPIAddr)
+	client, apiAddr := resolveMihomoClient(httpURL)
+	if timeout > 0 {
+		c := *client
+		c.Timeout = timeout
+		client = &c
 	}
 
-	activeConns := len(data.Connections)
-	if !silent {
-		fmt.Printf("[%s] 活跃连接数: %d\n", time.Now().Format("15:04:05"), activeConns)
+	req, err := http.NewRequest(method, apiAddr+path, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+currConf.MihomoSecret)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
 	}
 
-	nodeStatsMap := make(map[string]*NodeStats)
-	currentIDs := make(map[string]bool)
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("API 访问失败: %w", err)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s %s 失败: HTTP %d %s", method, path, resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+	return resp, nil
+}
 
-	for _, c := range data.Connections {
-		currentIDs[c.ID] = true
-		nodeName := "DIRECT"
-		if len(c.Chains) > 0 {
-			nodeName = c.Chains[len(c.Chains)-1]
-		}
+// fetchConnections 通过 HTTP / IPC 拉取一次 Mihomo /connections 快照
+func fetchConnections(currConf Config) (connectionsSnapshot, error) {
+	// 获取支持 HTTP + IPC 的客户端
+	httpURL := resolveMihomoAPI(currConf.MihomoAPIAddr)
+	client, apiAddr := resolveMihomoClient(httpURL)
 
-		last, exists := lastStats[c.ID]
-		upDelta, downDelta := c.Upload, c.Download
-		if exists {
-			upDelta = c.Upload - last.Upload
-			downDelta = c.Download - last.Download
-		}
+	req, _ := http.NewRequest("GET", apiAddr+"/connections", nil)
+	req.Header.Set("Authorization", "Bearer "+currConf.MihomoSecret)
 
-		if _, ok := nodeStatsMap[nodeName]; !ok {
-			nodeStatsMap[nodeName] = &NodeStats{}
-		}
-		nodeStatsMap[nodeName].Up += upDelta
-		nodeStatsMap[nodeName].Down += downDelta
-		lastStats[c.ID] = c
+	var data connectionsSnapshot
+	resp, err := client.Do(req)
+	if err != nil {
+		return data, fmt.Errorf("API 访问失败: %w", err)
 	}
+	defer resp.Body.Close()
 
-	for id := range lastStats {
-		if !currentIDs[id] {
-			delete(lastStats, id)
-		}
+	if resp.StatusCode != http.StatusOK {
+		return data, fmt.Errorf("API 鉴权失败! 状态码: %d", resp.StatusCode)
 	}
 
-	if !silent {
-		for name, stats := range nodeStatsMap {
-			if stats.Up > 0 || stats.Down > 0 {
-				dispatch(name, stats.Up, stats.Down, activeConns, currConf)
-			}
-		}
+	if err := json.NewDecoder(resp.Body).Decode(&data); err != nil {
+		return data, fmt.Errorf("解析 JSON 失败: %w", err)
 	}
+	return data, nil
 }
 
-func dispatch(nodeName string, up, down int64, activeConns int, currConf Config) {
+// isProxyNode 判断节点是否走代理（DIRECT / UA3F 视为本地流量）
+func isProxyNode(nodeName string) bool {
 	lowerName := strings.ToLower(nodeName)
-	isProxy := (lowerName != "direct" && lowerName != "ua3f")
+	return lowerName != "direct" && lowerName != "ua3f"
+}
 
-	payload := ReportData{
-		Timestamp:   time.Now().Unix(),
+// newReport 构造一条节点流量增量记录
+func newReport(nodeName string, up, down int64, activeConns int, now time.Time, currConf Config) ReportData {
+	return ReportData{
+		FrameHeader: FrameHeader{Type: "traffic"},
+		Timestamp:   now.Unix(),
 		DeviceID:    currConf.DeviceID,
 		NodeName:    nodeName,
 		UpDelta:     up,
 		DownDelta:   down,
-		IsProxy:     isProxy,
+		IsProxy:     isProxyNode(nodeName),
 		ActiveConns: activeConns,
 	}
+}
+
+// newConnRecord 将已关闭连接转换为审计记录
+func newConnRecord(c Conn, closedAt time.Time, currConf Config) ConnRecord {
+	host := c.Metadata.Host
+	if host == "" {
+		host = c.Metadata.SniffHost
+	}
+	start := c.Start
+	if start.IsZero() {
+		start = closedAt
+	}
+	nodeName := c.nodeName()
+
+	return ConnRecord{
+		FrameHeader: FrameHeader{Type: "conn"},
+		DeviceID:    currConf.DeviceID,
+		ConnID:      c.ID,
+		Start:       start.UnixMilli(),
+		End:         closedAt.UnixMilli(),
+		Duration:    closedAt.Sub(start).Milliseconds(),
+		Network:     c.Metadata.Network,
+		ConnType:    c.Metadata.Type,
+		SourceIP:    c.Metadata.SourceIP,
+		SourcePort:  c.Metadata.SourcePort,
+		DestIP:      c.Metadata.DestinationIP,
+		DestPort:    c.Metadata.DestinationPort,
+		Host:        host,
+		Rule:        c.Rule,
+		RulePayload: c.RulePayload,
+		Process:     c.Metadata.Process,
+		ProcessPath: c.Metadata.ProcessPath,
+		Chains:      c.Chains,
+		NodeName:    nodeName,
+		Upload:      c.Upload,
+		Download:    c.Download,
+		IsProxy:     isProxyNode(nodeName),
+	}
+}
+
+// dispatchBatch 将一个上报周期内的节点增量与已关闭连接打包写入发件箱。
+// 连接记录过多时拆成多个批次，避免单帧过大。
+func dispatchBatch(traffic []ReportData, conns []ConnRecord, now time.Time, currConf Config) {
+	for _, r := range traffic {
+		saveLocal(r, currConf.LocalLogFile)
+	}
 
-	saveLocal(payload, currConf.LocalLogFile)
+	for first := true; first || len(conns) > 0; first = false {
+		n := len(conns)
+		if n > maxConnsPerBatch {
+			n = maxConnsPerBatch
+		}
+		batch := ReportBatch{
+			FrameHeader: FrameHeader{Type: "batch"},
+			Timestamp:   now.Unix(),
+			DeviceID:    currConf.DeviceID,
+			Conns:       conns[:n],
+		}
+		if first {
+			batch.Traffic = traffic
+		}
+		conns = conns[n:]
 
-	select {
-	case reportChan <- payload:
-	default:
-		fmt.Printf("[%s] ⚠️ 发送缓冲已满，丢弃数据 (Node: %s)\n", time.Now().Format("15:04:05"), nodeName)
+		if len(batch.Traffic) == 0 && len(batch.Conns) == 0 {
+			return
+		}
+		if err := outbox.Append(&batch); err != nil {
+			fmt.Printf("[%s] ⚠️ 写入发件箱失败，丢弃 %d 条流量 / %d 条连接记录: %v\n",
+				time.Now().Format("15:04:05"), len(batch.Traffic), len(batch.Conns), err)
+		}
 	}
 }
 
@@ -466,9 +665,6 @@ func getWSURL(serverURL string) string {
 }
 
 func websocketManager() {
-	var wsConn *websocket.Conn
-	var err error
-
 	for {
 		confLock.RLock()
 		currConf := conf
@@ -483,29 +679,206 @@ func websocketManager() {
 
 		headers := http.Header{}
 		headers.Set("Authorization", "Bearer "+currConf.RemoteToken)
+		headers.Set("X-Client-Version", clientVersion)
 		dialer := websocket.DefaultDialer
 		dialer.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
 
 		fmt.Printf("[WebSocket] 正在连接到 %s...\n", wsURL)
-		wsConn, _, err = dialer.Dial(wsURL, headers)
+		wsConn, _, err := dialer.Dial(wsURL, headers)
 		if err != nil {
 			fmt.Printf("[WebSocket] 连接失败: %v。5秒后重试...\n", err)
 			time.Sleep(5 * time.Second)
 			continue
 		}
 
-		fmt.Println("[WebSocket] ✅ 连接成功，准备发送数据。")
+		pending, _ := outbox.Stats()
+		fmt.Printf("[WebSocket] ✅ 连接成功，发件箱待发送 %d 条。\n", pending)
+
+		hello := newHello(currConf)
+		if err := wsConn.WriteJSON(hello); err != nil {
+			fmt.Printf("[WebSocket] ❌ 发送握手失败: %v。断开并重新连接...\n", err)
+			wsConn.Close()
+			continue
+		}
+		mihomoVersion := hello.MihomoVersion
+		if mihomoVersion == "" {
+			mihomoVersion = "不可达"
+		}
+		fmt.Printf("[WebSocket] 已握手 | 版本 %s | Mihomo %s | 配置 %s\n", hello.ClientVersion, mihomoVersion, hello.ConfigHash)
+
+		if err := pumpOutbox(wsConn); err != nil {
+			fmt.Printf("[WebSocket] ❌ 发送错误: %v。断开并重新连接...\n", err)
+		}
+		wsConn.Close()
+	}
+}
+
+const (
+	ackWindow  = 500              // 未确认帧的最大数量，超过后暂停发送
+	ackTimeout = 60 * time.Second // 有未确认帧且超过该时长无任何确认时，视为连接失效
+)
+
+// pumpOutbox 从已确认位置起按序发送发件箱中的帧，并每 heartbeatInterval 发送一次心跳，直到连接出错。
+// 帧只有在服务端回复 ack（入库成功）后才会从发件箱删除；重连后未确认的帧会重发。
+func pumpOutbox(wsConn *websocket.Conn) error {
+	errCh := make(chan error, 1)
+	ackCh := make(chan struct{}, 1)
+	replies := make(chan CommandResult, 4) // 命令回执，与上报帧一样由本循环写出
+	rewind := make(chan struct{}, 1)       // flush_outbox 命令：从已确认位置重发
+	done := make(chan struct{})
+	defer close(done)
+	go readServerFrames(wsConn, ackCh, errCh, func(cmd CommandFrame) {
+		go func() {
+			r := runCommand(cmd, commandEnv{rewind: rewind})
+			select {
+			case replies <- r:
+			case <-done:
+			}
+		}()
+	})
+
+	sent := outbox.Acked()
+	lastProgress := time.Now()
+	nextHeartbeat := time.Now().Add(heartbeatInterval)
+	for {
+		select {
+		case err := <-errCh:
+			return err
+		case r := <-replies:
+			if err := wsConn.WriteJSON(r); err != nil {
+				return err
+			}
+			continue
+		case f := <-latencyReports:
+			if err := wsConn.WriteJSON(f); err != nil {
+				return err
+			}
+			continue
+		case <-rewind:
+			sent = outbox.Acked()
+			lastProgress = time.Now()
+		default:
+		}
 
-		for data := range reportChan {
-			err = wsConn.WriteJSON(data)
+		if !time.Now().Before(nextHeartbeat) {
+			confLock.RLock()
+			currConf := conf
+			confLock.RUnlock()
+			if err := wsConn.WriteJSON(newHeartbeat(currConf)); err != nil {
+				return err
+			}
+			nextHeartbeat = time.Now().Add(heartbeatInterval)
+		}
+
+		acked := outbox.Acked()
+		if sent < acked {
+			sent = acked
+		}
+		inflight := sent - acked
+		if inflight == 0 {
+			lastProgress = time.Now()
+		}
+
+		var entries []outboxEntry
+		if inflight < ackWindow {
+			limit := ackWindow - int(inflight)
+			if limit > 200 {
+				limit = 200
+			}
+			var err error
+			entries, err = outbox.Read(sent, limit)
 			if err != nil {
-				fmt.Printf("[WebSocket] ❌ 发送错误: %v。断开并重新连接...\n", err)
-				wsConn.Close()
-				break
-			} else {
-				fmt.Printf("[已上报 WS] %s | 节点: %-15s ↑%-10s ↓%-10s\n",
-					time.Now().Format("15:04:05"), data.NodeName, formatBytes(data.UpDelta), formatBytes(data.DownDelta))
+				return fmt.Errorf("读取发件箱失败: %w", err)
+			}
+		}
+
+		if len(entries) > 0 {
+			for _, e := range entries {
+				if err := wsConn.WriteMessage(websocket.TextMessage, e.Data); err != nil {
+					return err
+				}
+				sent = e.Seq
+			}
+			fmt.Printf("[已上报 WS] %s | seq %d-%d (%d 条)\n",
+				time.Now().Format("15:04:05"), entries[0].Seq, sent, len(entries))
+			continue
+		}
+
+		if inflight > 0 && time.Since(lastProgress) > ackTimeout {
+			return fmt.Errorf("等待服务端确认超时 (%d 条未确认)", inflight)
+		}
+
+		select {
+		case <-outbox.Notify():
+		case <-ackCh:
+			lastProgress = time.Now()
+		case err := <-errCh:
+			return err
+		case r := <-replies:
+			if err := wsConn.WriteJSON(r); err != nil {
+				return err
+			}
+		case f := <-latencyReports:
+			if err := wsConn.WriteJSON(f); err != nil {
+				return err
+			}
+		case <-rewind:
+			sent = outbox.Acked()
+			lastProgress = time.Now()
+		case <-time.After(time.Until(nextHeartbeat)):
+			// 空闲时也按时发送心跳，服务端据此区分空闲设备与失效连接
+		}
+	}
+}
+
+// ServerAck 服务端回复的确认帧：Ranges 中的每个 [from, to] 区间均已入库
+type ServerAck struct {
+	Type   string      `json:"type"`
+	Stream string      `json:"stream"`
+	Ranges [][2]uint64 `json:"ranges"`
+}
+
+// readServerFrames 读取服务端下发的帧（ack 与远程命令），连接出错时写入 errCh 并退出
+func readServerFrames(wsConn *websocket.Conn, ackCh chan<- struct{}, errCh chan<- error, onCommand func(CommandFrame)) {
+	for {
+		_, msg, err := wsConn.ReadMessage()
+		if err != nil {
+			errCh <- err
+			return
+		}
+
+		var head FrameHeader
+		if err := json.Unmarshal(msg, &head); err != nil {
+			fmt.Printf("[WebSocket] 无法解析服务端消息: %v\n", err)
+			continue
+		}
+
+		switch head.Type {
+		case "ack":
+			var ack ServerAck
+			if err := json.Unmarshal(msg, &ack); err != nil {
+				fmt.Printf("[WebSocket] ack 格式错误: %v\n", err)
+				continue
+			}
+			if ack.Stream != outbox.Stream() {
+				continue
+			}
+			for _, r := range ack.Ranges {
+				outbox.AckRange(r[0], r[1])
+			}
+			select {
+			case ackCh <- struct{}{}:
+			default:
+			}
+		case "command":
+			var cmd CommandFrame
+			if err := json.Unmarshal(msg, &cmd); err != nil || cmd.ID == "" {
+				fmt.Printf("[WebSocket] command 格式错误: %v\n", err)
+				continue
 			}
+			onCommand(cmd)
+		default:
+			fmt.Printf("[WebSocket] 未知的服务端消息类型: %s\n", head.Type)
 		}
 	}
 }
@@ -0,0 +1,290 @@
+//go:build client
+// +build client
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// ── 采集器：轮询 / 流式两种模式共用同一套快照处理逻辑 ──
+
+const (
+	reportInterval      = 10 * time.Second // 节点增量的上报周期
+	streamInterval      = 1000             // 流式模式下 Mihomo 推送快照的间隔（毫秒）
+	streamRetryInterval = time.Minute      // 流式连接失败后，回退轮询多久再重试
+	streamReadTimeout   = 15 * time.Second // 流式模式下超过该时长没有任何数据（快照或 pong）即视为连接已挂起
+	streamPingInterval  = 5 * time.Second  // 流式模式下向 Mihomo 发送 ping 的间隔
+
+	// unattributedNode 无法归到具体连接的流量（两次快照之间开始又结束的短连接）记在该名下
+	unattributedNode = "UNATTRIBUTED"
+)
+
+var (
+	pendingStats = make(map[string]*NodeStats) // 自上次上报以来累积的节点增量
+	pendingConns []ConnRecord                  // 自上次上报以来关闭的连接
+	lastActive   int                           // 最近一次快照中的活跃连接数
+	lastTotals   *NodeStats                    // 上一份快照的累计上下行，nil 表示尚无基线
+	lastDeltas   = make(map[string]NodeStats)  // 每条连接最近一次快照间隔内的增量，用于分摊残差
+)
+
+// runCollector 根据配置的采集模式持续采集，流式失败时自动回退到轮询
+func runCollector() {
+	for {
+		confLock.RLock()
+		mode := conf.CollectorMode
+		confLock.RUnlock()
+
+		if mode == "stream" {
+			err := streamConnections()
+			fmt.Printf("[Collector] 流式采集中断: %v，回退到轮询模式 %s\n", err, streamRetryInterval)
+			pollFor(streamRetryInterval)
+			continue
+		}
+
+		pollFor(streamRetryInterval)
+	}
+}
+
+// pollFor 以轮询模式运行指定时长
+func pollFor(d time.Duration) {
+	ticker := time.NewTicker(reportInterval)
+	defer ticker.Stop()
+	deadline := time.Now().Add(d)
+	for range ticker.C {
+		fetchAndProcess(false)
+		if time.Now().After(deadline) {
+			return
+		}
+	}
+}
+
+// dialMihomoStream 连接 Mihomo 的 WebSocket 流端点（目前只用于 /connections）。
+// 与 resolveMihomoClient 探测结果保持一致：HTTP 可用时走 TCP，否则复用 IPC 的拨号器。
+func dialMihomoStream(path string, currConf Config) (*websocket.Conn, error) {
+	httpURL := resolveMihomoAPI(currConf.MihomoAPIAddr)
+	client, apiAddr := resolveMihomoClient(httpURL)
+
+	wsURL := strings.Replace(apiAddr, "http", "ws", 1) + path
+	dialer := websocket.Dialer{HandshakeTimeout: 5 * time.Second}
+	if t, ok := client.Transport.(*http.Transport); ok && t.DialContext != nil {
+		// IPC：命名管道 / Unix Socket 忽略地址参数，直接连到本地管道
+		dialer.NetDialContext = t.DialContext
+	}
+
+	headers := http.Header{}
+	headers.Set("Authorization", "Bearer "+currConf.MihomoSecret)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, _, err := dialer.DialContext(ctx, wsURL, headers)
+	return conn, err
+}
+
+// streamConnections 订阅 Mihomo /connections 的 WebSocket 流，逐帧处理快照，
+// 每 reportInterval 汇总上报一次节点增量。仅在流中断时返回。
+// 不另外订阅 /traffic：对账用的累计上下行取自同一帧的 uploadTotal / downloadTotal，与逐连接计数同一时刻采样
+
+func streamConnections() error {
+	confLock.RLock()
+	currConf := conf
+	confLock.RUnlock()
+
+	conn, err := dialMihomoStream(fmt.Sprintf("/connections?interval=%d", streamInterval), currConf)
+	if err != nil {
+		return fmt.Errorf("连接 /connections 流失败: %w", err)
+	}
+	defer conn.Close()
+	fmt.Println("[Collector] ✅ 已订阅 Mihomo /connections 流")
+
+	// 读超时 + ping 保活：Mihomo 挂起时 ReadJSON 会超时返回，而不是永远阻塞
+	extendDeadline := func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(streamReadTimeout))
+	}
+	conn.SetPongHandler(extendDeadline)
+
+	snapshots := make(chan connectionsSnapshot)
+	errCh := make(chan error, 1)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			var snap connectionsSnapshot
+			extendDeadline("")
+			if err := conn.ReadJSON(&snap); err != nil {
+				errCh <- err
+				return
+			}
+			select {
+			case snapshots <- snap:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	ticker := time.NewTicker(reportInterval)
+	defer ticker.Stop()
+	ping := time.NewTicker(streamPingInterval)
+	defer ping.Stop()
+
+	for {
+		select {
+		case snap := <-snapshots:
+			confLock.RLock()
+			currConf = conf
+			confLock.RUnlock()
+			processSnapshot(snap, time.Now(), false, currConf)
+
+		case <-ticker.C:
+			confLock.RLock()
+			currConf = conf
+			confLock.RUnlock()
+			fmt.Printf("[%s] 活跃连接数: %d\n", time.Now().Format("15:04:05"), lastActive)
+			flushStats(currConf)
+
+		case <-ping.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(5*time.Second)); err != nil {
+				flushStats(currConf)
+				return fmt.Errorf("发送 ping 失败: %w", err)
+			}
+
+		case err := <-errCh:
+			// 中断前把已累积的增量先上报，避免丢失
+			flushStats(currConf)
+			return err
+		}
+	}
+}
+
+// processSnapshot 对比上一份快照，把每条连接的增量累加到 pendingStats，
+// 并为已消失的连接生成关闭记录。逐连接增量漏掉的部分（快照间隙内的短连接、
+// 已关闭连接在最后一次快照之后的流量）按快照累计值对账补回，见 attributeResidual。
+// silent 为 true 时只建立基线、不产生任何上报。
+func processSnapshot(snap connectionsSnapshot, at time.Time, silent bool, currConf Config) {
+	lastActive = len(snap.Connections)
+	currentIDs := make(map[string]bool, len(snap.Connections))
+	var seen NodeStats
+
+	for _, c := range snap.Connections {
+		currentIDs[c.ID] = true
+
+		last, exists := lastStats[c.ID]
+		upDelta, downDelta := c.Upload, c.Download
+		if exists {
+			upDelta = c.Upload - last.Upload
+			downDelta = c.Download - last.Download
+		}
+		lastStats[c.ID] = c
+		lastDeltas[c.ID] = NodeStats{Up: upDelta, Down: downDelta}
+		seen.Up += upDelta
+		seen.Down += downDelta
+
+		if silent {
+			continue
+		}
+		addPending(c.nodeName(), upDelta, downDelta)
+	}
+
+	// 上一轮存在、本轮消失的连接即视为已关闭
+	var closed []Conn
+	for id, last := range lastStats {
+		if !currentIDs[id] {
+			closed = append(closed, last)
+			delete(lastStats, id)
+		}
+	}
+	sort.Slice(closed, func(i, j int) bool { return closed[i].ID < closed[j].ID }) // 分摊结果与 map 遍历顺序无关
+
+	residual := reconcileTotals(snap, seen)
+	if !silent {
+		attributeResidual(residual, closed)
+		for _, c := range closed {
+			pendingConns = append(pendingConns, newConnRecord(c, at, currConf))
+		}
+	}
+	for _, c := range closed {
+		delete(lastDeltas, c.ID)
+	}
+}
+
+// addPending 把增量累加到节点的待上报统计
+func addPending(nodeName string, up, down int64) {
+	if _, ok := pendingStats[nodeName]; !ok {
+		pendingStats[nodeName] = &NodeStats{}
+	}
+	pendingStats[nodeName].Up += up
+	pendingStats[nodeName].Down += down
+}
+
+// reconcileTotals 用快照的累计值减去逐连接增量之和，得到本轮未被任何连接计入的流量。
+// 首个快照或累计值回退（Mihomo 重启）时只重建基线，返回零
+func reconcileTotals(snap connectionsSnapshot, seen NodeStats) NodeStats {
+	prev := lastTotals
+	lastTotals = &NodeStats{Up: snap.UploadTotal, Down: snap.DownloadTotal}
+	if prev == nil || snap.UploadTotal < prev.Up || snap.DownloadTotal < prev.Down {
+		return NodeStats{}
+	}
+	return NodeStats{
+		Up:   max(snap.UploadTotal-prev.Up-seen.Up, 0),
+		Down: max(snap.DownloadTotal-prev.Down-seen.Down, 0),
+	}
+}
+
+// attributeResidual 把残差计入节点：有连接在本轮关闭时，按它们最近一次的增量比例分摊，
+// 并补进其关闭记录（closed 原地修改）；没有连接关闭时，残差来自间隙内的短连接，记在 unattributedNode 名下
+func attributeResidual(residual NodeStats, closed []Conn) {
+	if residual.Up == 0 && residual.Down == 0 {
+		return
+	}
+	if len(closed) == 0 {
+		addPending(unattributedNode, residual.Up, residual.Down)
+		return
+	}
+
+	// 权重 +1：最近一次没有流量的连接也能分到一份，避免总权重为零
+	weights := make([]int64, len(closed))
+	var total int64
+	for i, c := range closed {
+		d := lastDeltas[c.ID]
+		weights[i] = d.Up + d.Down + 1
+		total += weights[i]
+	}
+
+	remain := residual
+	for i := range closed {
+		ratio := float64(weights[i]) / float64(total) // 用浮点避免大流量时整数乘法溢出
+		share := NodeStats{Up: int64(float64(residual.Up) * ratio), Down: int64(float64(residual.Down) * ratio)}
+		if i == len(closed)-1 {
+			share = remain // 舍入误差归最后一条，保证总量不变
+		}
+		remain.Up -= share.Up
+		remain.Down -= share.Down
+
+		closed[i].Upload += share.Up
+		closed[i].Download += share.Down
+		addPending(closed[i].nodeName(), share.Up, share.Down)
+	}
+}
+
+// flushStats 将累积的节点增量与关闭连接打包成一个批次上报并清空
+func flushStats(currConf Config) {
+	now := time.Now()
+	var traffic []ReportData
+	for name, stats := range pendingStats {
+		if stats.Up > 0 || stats.Down > 0 {
+			traffic = append(traffic, newReport(name, stats.Up, stats.Down, lastActive, now, currConf))
+		}
+	}
+
+	dispatchBatch(traffic, pendingConns, now, currConf)
+	pendingStats = make(map[string]*NodeStats)
+	pendingConns = nil
+}
@@ -0,0 +1,110 @@
+//go:build client
+// +build client
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// resetCollector 清空采集器的全部状态
+func resetCollector() {
+	lastStats = make(map[string]Conn)
+	lastDeltas = make(map[string]NodeStats)
+	lastTotals = nil
+	pendingStats = make(map[string]*NodeStats)
+	pendingConns = nil
+}
+
+func conn(id, node string, up, down int64) Conn {
+	return Conn{ID: id, Chains: []string{node}, Upload: up, Download: down}
+}
+
+func TestProcessSnapshotReconcile(t *testing.T) {
+	type want struct {
+		stats map[string]NodeStats
+		conns map[string]NodeStats // 关闭记录的最终上下行
+	}
+	tests := []struct {
+		name  string
+		snaps []connectionsSnapshot // 第一份只建立基线
+		want  want
+	}{
+		{
+			name: "已关闭连接最后一次快照之后的流量补进其记录",
+			snaps: []connectionsSnapshot{
+				{UploadTotal: 100, DownloadTotal: 1000, Connections: []Conn{conn("a", "HK", 100, 1000)}},
+				{UploadTotal: 150, DownloadTotal: 1500},
+			},
+			want: want{
+				stats: map[string]NodeStats{"HK": {Up: 50, Down: 500}},
+				conns: map[string]NodeStats{"a": {Up: 150, Down: 1500}},
+			},
+		},
+		{
+			name: "间隙内的短连接记在未归属名下",
+			snaps: []connectionsSnapshot{
+				{UploadTotal: 10, DownloadTotal: 10, Connections: []Conn{conn("a", "HK", 10, 10)}},
+				{UploadTotal: 40, DownloadTotal: 90, Connections: []Conn{conn("a", "HK", 20, 30)}},
+			},
+			want: want{
+				stats: map[string]NodeStats{"HK": {Up: 10, Down: 20}, unattributedNode: {Up: 20, Down: 60}},
+				conns: map[string]NodeStats{},
+			},
+		},
+		{
+			name: "多条连接关闭时按最近增量分摊且总量守恒",
+			snaps: []connectionsSnapshot{
+				{UploadTotal: 0, DownloadTotal: 0},
+				{UploadTotal: 400, DownloadTotal: 0, Connections: []Conn{conn("a", "HK", 299, 0), conn("b", "JP", 99, 0)}},
+				{UploadTotal: 801, DownloadTotal: 0},
+			},
+			want: want{
+				stats: map[string]NodeStats{"HK": {Up: 299 + 300}, "JP": {Up: 99 + 101}, unattributedNode: {Up: 2}},
+				conns: map[string]NodeStats{"a": {Up: 599}, "b": {Up: 200}},
+			},
+		},
+		{
+			name: "累计值回退（核心重启）时不产生残差",
+			snaps: []connectionsSnapshot{
+				{UploadTotal: 5000, DownloadTotal: 5000, Connections: []Conn{conn("a", "HK", 10, 10)}},
+				{UploadTotal: 30, DownloadTotal: 30, Connections: []Conn{conn("b", "HK", 20, 20)}},
+			},
+			want: want{
+				stats: map[string]NodeStats{"HK": {Up: 20, Down: 20}},
+				conns: map[string]NodeStats{"a": {Up: 10, Down: 10}},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetCollector()
+			now := time.Now()
+			for i, snap := range tt.snaps {
+				processSnapshot(snap, now, i == 0, Config{})
+			}
+
+			if len(pendingStats) != len(tt.want.stats) {
+				t.Errorf("节点数 = %d, 期望 %d: %v", len(pendingStats), len(tt.want.stats), pendingStats)
+			}
+			for node, w := range tt.want.stats {
+				got := pendingStats[node]
+				if got == nil || *got != w {
+					t.Errorf("节点 %s = %v, 期望 %v", node, got, w)
+				}
+			}
+
+			if len(pendingConns) != len(tt.want.conns) {
+				t.Fatalf("关闭记录数 = %d, 期望 %d", len(pendingConns), len(tt.want.conns))
+			}
+			for _, r := range pendingConns {
+				w := tt.want.conns[r.ConnID]
+				if r.Upload != w.Up || r.Download != w.Down {
+					t.Errorf("连接 %s = %d/%d, 期望 %d/%d", r.ConnID, r.Upload, r.Download, w.Up, w.Down)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,283 @@
+//go:build client
+// +build client
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ── 远程命令：服务端经 /ws 下发 command 帧，客户端执行后回复 command_result ──
+//
+// 命令在独立的 goroutine 中执行，回执与上报帧一样由 pumpOutbox 写出；连接断开时未发出的回执直接丢弃，
+// 服务端会将该命令记为失败。
+
+// CommandFrame 服务端下发的命令
+type CommandFrame struct {
+	Type   string          `json:"type"` // 固定为 "command"
+	ID     string          `json:"id"`
+	Action string          `json:"action"`
+	Args   json.RawMessage `json:"args"`
+}
+
+// CommandResult 命令回执
+type CommandResult struct {
+	Type   string `json:"type"` // 固定为 "command_result"
+	ID     string `json:"id"`
+	OK     bool   `json:"ok"`
+	Result any    `json:"result,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// commandEnv 命令执行时需要与发送循环交互的部分
+type commandEnv struct {
+	rewind chan<- struct{} // 通知 pumpOutbox 从已确认位置重发
+}
+
+var processStart = time.Now()
+
+func runCommand(cmd CommandFrame, env commandEnv) CommandResult {
+	fmt.Printf("[Command] 收到命令 %s #%s\n", cmd.Action, cmd.ID)
+	result, err := execCommand(cmd, env)
+	if err != nil {
+		fmt.Printf("[Command] %s #%s 失败: %v\n", cmd.Action, cmd.ID, err)
+		return CommandResult{Type: "command_result", ID: cmd.ID, Error: err.Error()}
+	}
+	fmt.Printf("[Command] %s #%s 已完成\n", cmd.Action, cmd.ID)
+	return CommandResult{Type: "command_result", ID: cmd.ID, OK: true, Result: result}
+}
+
+func execCommand(cmd CommandFrame, env commandEnv) (any, error) {
+	confLock.RLock()
+	currConf := conf
+	confLock.RUnlock()
+
+	switch cmd.Action {
+	case "reload_config":
+		if err := loadConfig(); err != nil {
+			return nil, err
+		}
+		return map[string]any{"config_hash": configHash()}, nil
+
+	case "refresh_subscription":
+		var args struct {
+			Path string `json:"path"`
+		}
+		decodeArgs(cmd.Args, &args)
+		return refreshSubscription(currConf, args.Path)
+
+	case "select_proxy":
+		var args struct {
+			Group string `json:"group"`
+			Name  string `json:"name"`
+		}
+		decodeArgs(cmd.Args, &args)
+		if args.Group == "" || args.Name == "" {
+			return nil, errors.New("缺少参数 group 或 name")
+		}
+		return selectProxy(currConf, args.Group, args.Name)
+
+	case "list_proxies":
+		groups, err := listProxyGroups(currConf)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]any{"groups": groups}, nil
+
+	case "flush_outbox":
+		var args struct {
+			Discard bool `json:"discard"`
+		}
+		decodeArgs(cmd.Args, &args)
+		pending, dropped := outbox.Stats()
+		result := map[string]any{"pending_before": pending, "dropped_before": dropped}
+		if args.Discard {
+			result["discarded"] = outbox.Discard()
+		} else {
+			select {
+			case env.rewind <- struct{}{}:
+			default:
+			}
+		}
+		pending, dropped = outbox.Stats()
+		result["pending"], result["dropped"] = pending, dropped
+		return result, nil
+
+	case "diagnostics":
+		return diagnostics(currConf), nil
+	}
+	return nil, fmt.Errorf("不支持的命令: %s", cmd.Action)
+}
+
+// decodeArgs 解析命令参数，缺省或格式错误时保留零值
+func decodeArgs(raw json.RawMessage, v any) {
+	if len(raw) > 0 {
+		json.Unmarshal(raw, v)
+	}
+}
+
+// ProxyGroup Mihomo 策略组（/proxies 中带有 all 字段的条目）
+type ProxyGroup struct {
+	Name string   `json:"name"`
+	Type string   `json:"type"`
+	Now  string   `json:"now"`
+	All  []string `json:"all"`
+}
+
+// fetchProxies 读取 Mihomo /proxies，返回全部节点与策略组（节点的 All 为空）
+func fetchProxies(currConf Config) (map[string]ProxyGroup, error) {
+	resp, err := mihomoRequest(currConf, "GET", "/proxies", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var data struct {
+		Proxies map[string]ProxyGroup `json:"proxies"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&data); err != nil {
+		return nil, fmt.Errorf("解析 /proxies 失败: %w", err)
+	}
+	return data.Proxies, nil
+}
+
+// listProxyGroups 返回全部策略组（GLOBAL 排在最后）
+func listProxyGroups(currConf Config) ([]ProxyGroup, error) {
+	proxies, err := fetchProxies(currConf)
+	if err != nil {
+		return nil, err
+	}
+	groups := make([]ProxyGroup, 0, len(proxies))
+	for name, p := range proxies {
+		if p.All == nil {
+			continue // 单个节点
+		}
+		p.Name = name
+		groups = append(groups, p)
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		if (groups[i].Name == "GLOBAL") != (groups[j].Name == "GLOBAL") {
+			return groups[j].Name == "GLOBAL"
+		}
+		return groups[i].Name < groups[j].Name
+	})
+	return groups, nil
+}
+
+// selectProxy 切换策略组选中的节点，返回切换后的策略组
+func selectProxy(currConf Config, group, name string) (any, error) {
+	body, _ := json.Marshal(map[string]string{"name": name})
+	path := "/proxies/" + url.PathEscape(group)
+	resp, err := mihomoRequest(currConf, "PUT", path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+
+	resp, err = mihomoRequest(currConf, "GET", path, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var g ProxyGroup
+	if err := json.NewDecoder(resp.Body).Decode(&g); err != nil {
+		return nil, fmt.Errorf("解析策略组失败: %w", err)
+	}
+	g.Name = group
+	return map[string]any{"groups": []ProxyGroup{g}}, nil
+}
+
+// refreshSubscription 让 Mihomo 重新加载配置文件，并更新所有 HTTP 类型的代理集合。
+// path 只能是本客户端读取的配置文件（-c 指定），不允许让 Mihomo 加载服务端指定的任意文件
+func refreshSubscription(currConf Config, path string) (any, error) {
+	own, err := filepath.Abs(configPath)
+	if err != nil {
+		return nil, fmt.Errorf("无法确定配置文件路径: %w", err)
+	}
+	if path != "" {
+		abs, err := filepath.Abs(path)
+		if err != nil || abs != own {
+			return nil, fmt.Errorf("只能重新加载本客户端的配置文件 %s", own)
+		}
+	}
+	path = own
+	body, _ := json.Marshal(map[string]string{"path": path})
+	resp, err := mihomoRequest(currConf, "PUT", "/configs?force=true", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+
+	updated, failed := []string{}, []string{}
+	resp, err = mihomoRequest(currConf, "GET", "/providers/proxies", nil)
+	if err != nil {
+		return map[string]any{"path": path, "providers_error": err.Error()}, nil
+	}
+	var providers struct {
+		Providers map[string]struct {
+			VehicleType string `json:"vehicleType"`
+		} `json:"providers"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&providers)
+	resp.Body.Close()
+	if err != nil {
+		return map[string]any{"path": path, "providers_error": err.Error()}, nil
+	}
+	for name, p := range providers.Providers {
+		if !strings.EqualFold(p.VehicleType, "HTTP") {
+			continue
+		}
+		r, err := mihomoRequest(currConf, "PUT", "/providers/proxies/"+url.PathEscape(name), nil)
+		if err != nil {
+			failed = append(failed, name)
+			continue
+		}
+		r.Body.Close()
+		updated = append(updated, name)
+	}
+	return map[string]any{"path": path, "updated": updated, "failed": failed}, nil
+}
+
+// diagnostics 汇总客户端运行状态，便于远程排查
+func diagnostics(currConf Config) map[string]any {
+	mihomoVersion, mihomoErr := fetchMihomoVersion(currConf)
+	pending, dropped := outbox.Stats()
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	d := map[string]any{
+		"client_version": clientVersion,
+		"os":             runtime.GOOS,
+		"arch":           runtime.GOARCH,
+		"go_version":     runtime.Version(),
+		"uptime":         int64(time.Since(processStart).Seconds()),
+		"device_id":      currConf.DeviceID,
+		"collector_mode": currConf.CollectorMode,
+		"config_path":    configPath,
+		"config_hash":    configHash(),
+		"mihomo_api":     currConf.MihomoAPIAddr,
+		"mihomo_version": mihomoVersion,
+		"mihomo_ok":      mihomoErr == nil,
+		"outbox": map[string]any{
+			"stream":  outbox.Stream(),
+			"acked":   outbox.Acked(),
+			"pending": pending,
+			"dropped": dropped,
+		},
+		"goroutines": runtime.NumGoroutine(),
+		"heap_bytes": mem.HeapAlloc,
+	}
+	if mihomoErr != nil {
+		d["mihomo_error"] = mihomoErr.Error()
+	}
+	return d
+}
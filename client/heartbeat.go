@@ -0,0 +1,97 @@
+//go:build client
+// +build client
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"runtime"
+	"time"
+)
+
+// ── 握手与心跳：连接 /ws 后先发送 hello，之后每 heartbeatInterval 发送一次本地健康状态 ──
+//
+// 两者都不经过发件箱、不分配序号，服务端也不回复 ack；连接断开时直接丢弃，重连后重新握手。
+
+const heartbeatInterval = 30 * time.Second
+
+// HelloFrame 连接建立后发送的握手帧
+type HelloFrame struct {
+	Type              string   `json:"type"` // 固定为 "hello"
+	DeviceID          string   `json:"device_id"`
+	ClientVersion     string   `json:"client_version"`
+	OS                string   `json:"os"`
+	Arch              string   `json:"arch"`
+	MihomoVersion     string   `json:"mihomo_version"`     // Mihomo /version，不可达时为空
+	ConfigHash        string   `json:"config_hash"`        // config.yaml 内容的 SHA-256 前 16 位
+	HeartbeatInterval int      `json:"heartbeat_interval"` // 心跳间隔（秒），服务端据此判断连接失效
+	Capabilities      []string `json:"capabilities"`       // 支持的可选功能，"commands" 表示接受远程命令
+}
+
+// HeartbeatFrame 定期发送的本地健康状态
+type HeartbeatFrame struct {
+	Type            string `json:"type"` // 固定为 "heartbeat"
+	DeviceID        string `json:"device_id"`
+	Timestamp       int64  `json:"timestamp"`
+	MihomoReachable bool   `json:"mihomo_reachable"`
+	QueueDepth      uint64 `json:"queue_depth"` // 发件箱中未确认的帧数
+	Dropped         uint64 `json:"dropped"`     // 发件箱超出容量后累计丢弃的帧数
+}
+
+// fetchMihomoVersion 读取 Mihomo /version，同时用作可达性探测
+func fetchMihomoVersion(currConf Config) (string, error) {
+	resp, err := mihomoRequest(currConf, "GET", "/version", nil)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var v struct {
+		Version string `json:"version"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&v); err != nil {
+		return "", err
+	}
+	return v.Version, nil
+}
+
+// configHash 返回当前配置文件内容的摘要，便于在服务端核对设备是否使用了最新的订阅
+func configHash() string {
+	data, err := os.ReadFile(configPath)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])[:16]
+}
+
+func newHello(currConf Config) HelloFrame {
+	mihomoVersion, _ := fetchMihomoVersion(currConf)
+	return HelloFrame{
+		Type:              "hello",
+		DeviceID:          currConf.DeviceID,
+		ClientVersion:     clientVersion,
+		OS:                runtime.GOOS,
+		Arch:              runtime.GOARCH,
+		MihomoVersion:     mihomoVersion,
+		ConfigHash:        configHash(),
+		HeartbeatInterval: int(heartbeatInterval / time.Second),
+		Capabilities:      []string{"commands"},
+	}
+}
+
+func newHeartbeat(currConf Config) HeartbeatFrame {
+	_, err := fetchMihomoVersion(currConf)
+	pending, dropped := outbox.Stats()
+	return HeartbeatFrame{
+		Type:            "heartbeat",
+		DeviceID:        currConf.DeviceID,
+		Timestamp:       time.Now().Unix(),
+		MihomoReachable: err == nil,
+		QueueDepth:      pending,
+		Dropped:         dropped,
+	}
+}
@@ -0,0 +1,137 @@
+//go:build client
+// +build client
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// ── 延迟测试：每 latency-interval 秒测试一次 latency-groups 中全部节点的延迟，经 /ws 上报 ──
+//
+// 与心跳一样不经过发件箱；未连接时最多保留最近几轮结果，重连后补发，更早的直接丢弃。
+
+const (
+	latencyDefaultInterval = 300 // 秒
+	latencyDefaultURL      = "https://www.gstatic.com/generate_204"
+	latencyTimeout         = 5000            // 单个节点的测试超时（毫秒），由 Mihomo 执行
+	latencyRequestSlack    = 2 * time.Second // 请求 Mihomo 的超时比 latencyTimeout 多留的余量，保证 Mihomo 先返回结果
+	latencyConcurrency     = 8
+)
+
+// LatencyFrame 一轮延迟测试的结果
+type LatencyFrame struct {
+	Type      string          `json:"type"` // 固定为 "latency"
+	DeviceID  string          `json:"device_id"`
+	Timestamp int64           `json:"timestamp"`
+	Results   []LatencyResult `json:"results"`
+}
+
+// LatencyResult 单个节点的延迟（毫秒），0 表示超时或失败
+type LatencyResult struct {
+	Node  string `json:"node"`
+	Delay int    `json:"delay"`
+}
+
+// latencyReports 待发送的测试结果，由 pumpOutbox 写出
+var latencyReports = make(chan LatencyFrame, 4)
+
+// builtinProxies Mihomo 内置的出站，不参与测试
+var builtinProxies = map[string]bool{"Direct": true, "Reject": true, "RejectDrop": true, "Pass": true, "Compatible": true}
+
+func runLatencyProbe() {
+	for {
+		confLock.RLock()
+		currConf := conf
+		confLock.RUnlock()
+
+		if len(currConf.LatencyGroups) > 0 {
+			frame, err := probeLatency(currConf)
+			if err != nil {
+				fmt.Printf("[Latency] 延迟测试失败: %v\n", err)
+			} else if len(frame.Results) > 0 {
+				queueLatency(frame)
+			}
+		}
+		time.Sleep(time.Duration(currConf.LatencyInterval) * time.Second)
+	}
+}
+
+// queueLatency 放入待发送队列，队列已满时丢弃最早的一轮
+func queueLatency(frame LatencyFrame) {
+	for {
+		select {
+		case latencyReports <- frame:
+			return
+		default:
+		}
+		select {
+		case <-latencyReports:
+		default:
+		}
+	}
+}
+
+// probeLatency 测试配置的策略组中的全部节点（嵌套的策略组与内置出站跳过，同一节点只测一次）
+func probeLatency(currConf Config) (LatencyFrame, error) {
+	frame := LatencyFrame{Type: "latency", DeviceID: currConf.DeviceID, Timestamp: time.Now().Unix()}
+	proxies, err := fetchProxies(currConf)
+	if err != nil {
+		return frame, err
+	}
+
+	seen := make(map[string]bool)
+	var nodes []string
+	for _, group := range currConf.LatencyGroups {
+		g, ok := proxies[group]
+		if !ok || g.All == nil {
+			fmt.Printf("[Latency] 策略组不存在: %s\n", group)
+			continue
+		}
+		for _, name := range g.All {
+			p := proxies[name]
+			if seen[name] || p.All != nil || builtinProxies[p.Type] {
+				continue
+			}
+			seen[name] = true
+			nodes = append(nodes, name)
+		}
+	}
+
+	frame.Results = make([]LatencyResult, len(nodes))
+	sem := make(chan struct{}, latencyConcurrency)
+	var wg sync.WaitGroup
+	for i, name := range nodes {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, name string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			frame.Results[i] = LatencyResult{Node: name, Delay: testDelay(currConf, name)}
+		}(i, name)
+	}
+	wg.Wait()
+	return frame, nil
+}
+
+// testDelay 调用 Mihomo /proxies/{name}/delay，失败时返回 0
+func testDelay(currConf Config, name string) int {
+	path := fmt.Sprintf("/proxies/%s/delay?timeout=%d&url=%s", url.PathEscape(name), latencyTimeout, url.QueryEscape(currConf.LatencyURL))
+	resp, err := mihomoRequestTimeout(currConf, "GET", path, nil, latencyTimeout*time.Millisecond+latencyRequestSlack)
+	if err != nil {
+		return 0
+	}
+	defer resp.Body.Close()
+
+	var v struct {
+		Delay int `json:"delay"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&v); err != nil {
+		return 0
+	}
+	return v.Delay
+}
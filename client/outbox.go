@@ -0,0 +1,413 @@
+//go:build client
+// +build client
+
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ── 发件箱：磁盘持久化的上报队列 ──
+//
+// 上报帧按序号追加到 <dir>/<首条序号>.seg 分段文件（每行一个 JSON 帧），
+// state.json 记录流 ID 与已确认的最大序号。断网期间数据持续落盘，
+// 重连后从已确认位置按序重放；总大小超过上限时丢弃最旧的分段。
+
+const (
+	outboxSegmentBytes = 1 << 20 // 单个分段文件上限 1 MiB
+	outboxDefaultMaxMB = 64      // 发件箱默认总容量上限（MiB）
+)
+
+// FrameHeader 所有上报帧共有的头部字段，Stream/Seq 由发件箱在入队时分配
+type FrameHeader struct {
+	Type   string `json:"type"`
+	Stream string `json:"stream,omitempty"`
+	Seq    uint64 `json:"seq,omitempty"`
+}
+
+func (h *FrameHeader) header() *FrameHeader { return h }
+
+// framer 可写入发件箱的上报帧
+type framer interface {
+	header() *FrameHeader
+}
+
+type outboxSegment struct {
+	path     string
+	firstSeq uint64
+	lastSeq  uint64
+	size     int64
+}
+
+type outboxState struct {
+	Stream string `json:"stream"` // 序号空间标识，发件箱重建时更换，服务端按 (设备, 流) 去重
+	Acked  uint64 `json:"acked"`  // 已确认送达的最大序号
+}
+
+type outboxEntry struct {
+	Seq  uint64
+	Data []byte
+}
+
+type Outbox struct {
+	mu       sync.Mutex
+	dir      string
+	maxBytes int64
+	state    outboxState
+	nextSeq  uint64 // 最近一次分配的序号
+	segments []*outboxSegment
+	notify   chan struct{}
+	dropped  uint64          // 因超出容量被丢弃的帧数
+	ackedSet map[uint64]bool // 已确认但尚未与 state.Acked 连续的序号
+}
+
+var outbox *Outbox
+
+// openOutbox 打开（或创建）发件箱目录，并从分段文件重建索引
+func openOutbox(dir string, maxBytes int64) (*Outbox, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("创建发件箱目录失败: %w", err)
+	}
+
+	o := &Outbox{
+		dir:      dir,
+		maxBytes: maxBytes,
+		notify:   make(chan struct{}, 1),
+		ackedSet: make(map[uint64]bool),
+	}
+
+	if data, err := os.ReadFile(o.statePath()); err == nil {
+		if err := json.Unmarshal(data, &o.state); err != nil {
+			fmt.Printf("[Outbox] state.json 损坏，重建: %v\n", err)
+			o.state = outboxState{}
+		}
+	}
+	if o.state.Stream == "" {
+		o.state = outboxState{Stream: newStreamID()}
+	}
+	o.nextSeq = o.state.Acked
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.seg"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+	for _, path := range files {
+		seg, err := scanSegment(path)
+		if err != nil || seg.lastSeq == 0 {
+			os.Remove(path)
+			continue
+		}
+		o.segments = append(o.segments, seg)
+		if seg.lastSeq > o.nextSeq {
+			o.nextSeq = seg.lastSeq
+		}
+	}
+
+	o.compact()
+	if err := o.saveState(); err != nil {
+		return nil, err
+	}
+
+	fmt.Printf("[Outbox] 已打开 %s | 流: %s | 待发送: %d 条\n", dir, o.state.Stream, o.nextSeq-o.state.Acked)
+	return o, nil
+}
+
+// scanSegment 读取分段文件，得到首尾序号与大小
+func scanSegment(path string) (*outboxSegment, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	seg := &outboxSegment{path: path}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), outboxSegmentBytes)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		seg.size += int64(len(line)) + 1
+		seq := frameSeq(line)
+		if seq == 0 {
+			continue
+		}
+		if seg.firstSeq == 0 {
+			seg.firstSeq = seq
+		}
+		seg.lastSeq = seq
+	}
+	return seg, scanner.Err()
+}
+
+// frameSeq 从一行 JSON 帧中取出序号，无法解析时返回 0
+func frameSeq(line []byte) uint64 {
+	var h FrameHeader
+	if err := json.Unmarshal(line, &h); err != nil {
+		return 0
+	}
+	return h.Seq
+}
+
+func newStreamID() string {
+	b := make([]byte, 6)
+	if _, err := rand.Read(b); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 36)
+	}
+	return strconv.FormatInt(time.Now().Unix(), 36) + "-" + hex.EncodeToString(b)
+}
+
+func (o *Outbox) statePath() string {
+	return filepath.Join(o.dir, "state.json")
+}
+
+// saveState 原子写入 state.json（先写临时文件再重命名）
+func (o *Outbox) saveState() error {
+	data, _ := json.Marshal(o.state)
+	tmp := o.statePath() + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, o.statePath())
+}
+
+// Append 为帧分配序号并追加到当前分段
+func (o *Outbox) Append(f framer) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	seq := o.nextSeq + 1
+	h := f.header()
+	h.Stream = o.state.Stream
+	h.Seq = seq
+
+	data, err := json.Marshal(f)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	var seg *outboxSegment
+	if n := len(o.segments); n > 0 && o.segments[n-1].size+int64(len(data)) <= outboxSegmentBytes {
+		seg = o.segments[n-1]
+	} else {
+		seg = &outboxSegment{path: filepath.Join(o.dir, fmt.Sprintf("%020d.seg", seq)), firstSeq: seq}
+		o.segments = append(o.segments, seg)
+	}
+
+	file, err := os.OpenFile(seg.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(data)
+	file.Close()
+	if err != nil {
+		return err
+	}
+
+	seg.lastSeq = seq
+	seg.size += int64(len(data))
+	o.nextSeq = seq
+	o.enforceCap()
+
+	select {
+	case o.notify <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// enforceCap 总大小超过上限时丢弃最旧的分段（当前写入的分段保留）
+func (o *Outbox) enforceCap() {
+	if o.maxBytes <= 0 {
+		return
+	}
+	var total int64
+	for _, seg := range o.segments {
+		total += seg.size
+	}
+
+	changed := false
+	for total > o.maxBytes && len(o.segments) > 1 {
+		seg := o.segments[0]
+		if seg.lastSeq > o.state.Acked {
+			from := seg.firstSeq
+			if o.state.Acked >= from {
+				from = o.state.Acked + 1
+			}
+			lost := seg.lastSeq - from + 1
+			o.dropped += lost
+			o.state.Acked = seg.lastSeq
+			fmt.Printf("[Outbox] ⚠️ 发件箱超出 %s 上限，丢弃最旧的 %d 条 (seq %d-%d)\n",
+				formatBytes(o.maxBytes), lost, from, seg.lastSeq)
+			changed = true
+		}
+		os.Remove(seg.path)
+		total -= seg.size
+		o.segments = o.segments[1:]
+	}
+	if changed {
+		o.saveState()
+	}
+}
+
+// Read 返回序号大于 after 的最多 limit 条帧
+func (o *Outbox) Read(after uint64, limit int) ([]outboxEntry, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	var entries []outboxEntry
+	for _, seg := range o.segments {
+		if seg.lastSeq <= after {
+			continue
+		}
+		f, err := os.Open(seg.path)
+		if err != nil {
+			return entries, err
+		}
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(make([]byte, 64*1024), outboxSegmentBytes)
+		for scanner.Scan() {
+			line := scanner.Bytes()
+			seq := frameSeq(line)
+			if seq <= after {
+				continue
+			}
+			entries = append(entries, outboxEntry{Seq: seq, Data: append([]byte(nil), line...)})
+			if len(entries) >= limit {
+				break
+			}
+		}
+		f.Close()
+		if len(entries) >= limit {
+			break
+		}
+	}
+	return entries, nil
+}
+
+// AckRange 标记服务端已确认入库的序号区间 [from, to]。
+// 只有与已确认位置连续的部分才会推进 state.Acked 并删除对应分段，
+// 中间有空洞时先记录在 ackedSet 中，等空洞被补上后再一并推进。
+func (o *Outbox) AckRange(from, to uint64) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if to > o.nextSeq {
+		to = o.nextSeq
+	}
+	if from == 0 || to < from || to <= o.state.Acked {
+		return
+	}
+
+	before := o.state.Acked
+	if from <= o.state.Acked+1 {
+		o.state.Acked = to
+	} else {
+		for seq := from; seq <= to; seq++ {
+			o.ackedSet[seq] = true
+		}
+	}
+	for o.ackedSet[o.state.Acked+1] {
+		o.state.Acked++
+	}
+	for seq := range o.ackedSet {
+		if seq <= o.state.Acked {
+			delete(o.ackedSet, seq)
+		}
+	}
+
+	if o.state.Acked == before {
+		return
+	}
+	o.compact()
+	if err := o.saveState(); err != nil {
+		fmt.Printf("[Outbox] 保存状态失败: %v\n", err)
+	}
+}
+
+// Discard 丢弃全部未确认的帧（视同已确认并计入丢弃数），返回丢弃的条数
+func (o *Outbox) Discard() uint64 {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	var n uint64
+	for seq := o.state.Acked + 1; seq <= o.nextSeq; seq++ {
+		if !o.ackedSet[seq] {
+			n++
+		}
+	}
+	if o.nextSeq <= o.state.Acked {
+		return 0
+	}
+	o.state.Acked = o.nextSeq
+	o.ackedSet = make(map[uint64]bool)
+	o.dropped += n
+	o.compact()
+	if err := o.saveState(); err != nil {
+		fmt.Printf("[Outbox] 保存状态失败: %v\n", err)
+	}
+	return n
+}
+
+// compact 删除所有帧都已确认的分段
+func (o *Outbox) compact() {
+	kept := o.segments[:0]
+	for _, seg := range o.segments {
+		if seg.lastSeq <= o.state.Acked {
+			os.Remove(seg.path)
+			continue
+		}
+		kept = append(kept, seg)
+	}
+	o.segments = kept
+}
+
+// Acked 返回已确认的最大序号
+func (o *Outbox) Acked() uint64 {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.state.Acked
+}
+
+// Stream 返回当前序号空间的流 ID
+func (o *Outbox) Stream() string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.state.Stream
+}
+
+// Notify 有新帧入队时收到信号
+func (o *Outbox) Notify() <-chan struct{} {
+	return o.notify
+}
+
+// Stats 返回待发送条数与累计丢弃条数
+func (o *Outbox) Stats() (pending, dropped uint64) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.nextSeq - o.state.Acked, o.dropped
+}
+
+// SetMaxBytes 更新容量上限（配置热重载时调用）
+func (o *Outbox) SetMaxBytes(maxBytes int64) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.maxBytes = maxBytes
+	o.enforceCap()
+}
+
+// outboxDir 发件箱目录：与 LocalLogFile 位于同一目录
+func outboxDir(localLogFile string) string {
+	return filepath.Join(filepath.Dir(localLogFile), strings.TrimSuffix(filepath.Base(localLogFile), filepath.Ext(localLogFile))+"_outbox")
+}
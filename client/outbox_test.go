@@ -0,0 +1,187 @@
+//go:build client
+// +build client
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// newTestOutbox 在临时目录中打开发件箱并写入 n 个帧（序号 1..n）
+func newTestOutbox(t *testing.T, maxBytes int64, n int, payload string) *Outbox {
+	t.Helper()
+	o, err := openOutbox(t.TempDir(), maxBytes)
+	if err != nil {
+		t.Fatalf("openOutbox: %v", err)
+	}
+	appendFrames(t, o, n, payload)
+	return o
+}
+
+func appendFrames(t *testing.T, o *Outbox, n int, payload string) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		if err := o.Append(&ReportBatch{FrameHeader: FrameHeader{Type: "batch"}, DeviceID: payload}); err != nil {
+			t.Fatalf("Append: %v", err)
+		}
+	}
+}
+
+func readSeqs(t *testing.T, o *Outbox, after uint64) []uint64 {
+	t.Helper()
+	entries, err := o.Read(after, 1000)
+	if err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	seqs := make([]uint64, len(entries))
+	for i, e := range entries {
+		seqs[i] = e.Seq
+	}
+	return seqs
+}
+
+func TestOutboxAckRange(t *testing.T) {
+	tests := []struct {
+		name      string
+		acks      [][2]uint64
+		wantAcked uint64
+		wantHoles int // ackedSet 中尚未连续的序号数
+	}{
+		{"顺序确认", [][2]uint64{{1, 3}, {4, 6}}, 6, 0},
+		{"乱序确认先记录空洞", [][2]uint64{{4, 6}}, 0, 3},
+		{"空洞补上后一并推进", [][2]uint64{{4, 6}, {8, 8}, {1, 3}}, 6, 1},
+		{"全部补齐", [][2]uint64{{9, 10}, {4, 6}, {1, 3}, {7, 8}}, 10, 0},
+		{"与已确认位置重叠", [][2]uint64{{1, 5}, {3, 7}}, 7, 0},
+		{"重复确认", [][2]uint64{{1, 4}, {1, 4}, {2, 3}}, 4, 0},
+		{"超出已分配序号截断", [][2]uint64{{1, 99}}, 10, 0},
+		{"无效区间忽略", [][2]uint64{{0, 3}, {5, 4}}, 0, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o := newTestOutbox(t, 0, 10, "dev")
+			for _, a := range tt.acks {
+				o.AckRange(a[0], a[1])
+			}
+			if got := o.Acked(); got != tt.wantAcked {
+				t.Errorf("Acked = %d, 期望 %d", got, tt.wantAcked)
+			}
+			if got := len(o.ackedSet); got != tt.wantHoles {
+				t.Errorf("ackedSet = %d 条, 期望 %d", got, tt.wantHoles)
+			}
+			if pending, _ := o.Stats(); pending != 10-tt.wantAcked {
+				t.Errorf("pending = %d, 期望 %d", pending, 10-tt.wantAcked)
+			}
+			// 已确认的帧不再返回
+			if seqs := readSeqs(t, o, o.Acked()); len(seqs) != int(10-tt.wantAcked) {
+				t.Errorf("Read 返回 %v", seqs)
+			}
+		})
+	}
+}
+
+func TestOutboxEnforceCap(t *testing.T) {
+	// 每帧约 400 KiB，单个 1 MiB 分段可容纳 2 帧
+	payload := strings.Repeat("x", 400<<10)
+
+	tests := []struct {
+		name        string
+		maxBytes    int64
+		frames      int
+		ackBefore   uint64 // 先确认 1..ackBefore（0 表示不确认），确认时其所在分段仍有未确认的帧
+		wantFirst   uint64 // 保留的第一个序号
+		wantDropped uint64
+	}{
+		{"未超出上限不丢弃", 8 << 20, 8, 0, 1, 0},
+		{"丢弃最旧的分段", 2 << 20, 8, 0, 5, 4},
+		{"只保留当前分段", 1, 8, 0, 7, 6},
+		{"已确认的帧不计入丢弃", 2 << 20, 8, 3, 5, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o := newTestOutbox(t, tt.maxBytes, 0, "")
+			appended := 0
+			if tt.ackBefore > 0 {
+				appended = int(tt.ackBefore) + 1
+				appendFrames(t, o, appended, payload)
+				o.AckRange(1, tt.ackBefore)
+			}
+			appendFrames(t, o, tt.frames-appended, payload)
+
+			seqs := readSeqs(t, o, o.Acked())
+			if len(seqs) == 0 || seqs[0] != tt.wantFirst || seqs[len(seqs)-1] != uint64(tt.frames) {
+				t.Errorf("保留的序号 = %v, 期望 %d..%d", seqs, tt.wantFirst, tt.frames)
+			}
+			if _, dropped := o.Stats(); dropped != tt.wantDropped {
+				t.Errorf("dropped = %d, 期望 %d", dropped, tt.wantDropped)
+			}
+			if got := o.Acked(); got != tt.wantFirst-1 {
+				t.Errorf("Acked = %d, 期望 %d", got, tt.wantFirst-1)
+			}
+			files, _ := filepath.Glob(filepath.Join(o.dir, "*.seg"))
+			if len(files) != len(o.segments) {
+				t.Errorf("磁盘上有 %d 个分段，索引中有 %d 个", len(files), len(o.segments))
+			}
+		})
+	}
+}
+
+func TestOutboxReload(t *testing.T) {
+	tests := []struct {
+		name       string
+		acks       [][2]uint64
+		corrupt    bool // 重新打开前破坏 state.json
+		wantAcked  uint64
+		wantSeqs   []uint64
+		sameStream bool
+	}{
+		{"恢复已确认位置与未发送的帧", [][2]uint64{{1, 2}}, false, 2, []uint64{3, 4, 5}, true},
+		{"乱序确认的空洞不持久化，重启后重发", [][2]uint64{{1, 1}, {4, 5}}, false, 1, []uint64{2, 3, 4, 5}, true},
+		{"全部确认后分段被清理", [][2]uint64{{1, 5}}, false, 5, nil, true},
+		{"state.json 损坏时更换流并保留分段", nil, true, 0, []uint64{1, 2, 3, 4, 5}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o := newTestOutbox(t, 0, 5, "dev")
+			for _, a := range tt.acks {
+				o.AckRange(a[0], a[1])
+			}
+			if tt.corrupt {
+				if err := os.WriteFile(o.statePath(), []byte("{"), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			r, err := openOutbox(o.dir, 0)
+			if err != nil {
+				t.Fatalf("重新打开: %v", err)
+			}
+			if got := r.Acked(); got != tt.wantAcked {
+				t.Errorf("Acked = %d, 期望 %d", got, tt.wantAcked)
+			}
+			if (r.Stream() == o.Stream()) != tt.sameStream {
+				t.Errorf("流 ID %s -> %s, 期望保持不变: %v", o.Stream(), r.Stream(), tt.sameStream)
+			}
+			seqs := readSeqs(t, r, r.Acked())
+			if len(seqs) != len(tt.wantSeqs) {
+				t.Fatalf("待发送 = %v, 期望 %v", seqs, tt.wantSeqs)
+			}
+			for i := range seqs {
+				if seqs[i] != tt.wantSeqs[i] {
+					t.Fatalf("待发送 = %v, 期望 %v", seqs, tt.wantSeqs)
+				}
+			}
+
+			// 新帧接在重建出的最大序号之后
+			appendFrames(t, r, 1, "dev")
+			if seqs := readSeqs(t, r, 5); len(seqs) != 1 || seqs[0] != 6 {
+				t.Errorf("新帧序号 = %v, 期望 [6]", seqs)
+			}
+		})
+	}
+}
@@ -0,0 +1,262 @@
+// 登录防爆破与鉴权审计：按来源 IP 统计失败次数并指数退避锁定，鉴权事件持久化
+
+package main
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	authFreeFailures = 5                // 锁定前允许的连续失败次数
+	authBaseLockout  = time.Minute      // 首次锁定时长，之后每次失败翻倍
+	authMaxLockout   = time.Hour        // 锁定时长上限
+	authFailureReset = 24 * time.Hour   // 距上次失败超过该时长后清零计数
+	authEventsMax    = 1000             // /api/auth-events 单次最多返回条数
+	authGuardSweep   = 10 * time.Minute // 清理内存中过期计数的周期
+	authAuditRepeat  = 10 * time.Minute // 同一来源重复的锁定 / 失效凭据事件的审计间隔
+)
+
+type ipFailures struct {
+	count       int
+	lastFailure time.Time
+	lockedUntil time.Time
+}
+
+// authFailures 按来源 IP 记录鉴权失败。ClientIP 已按 TrustedPlatform 取 CF-Connecting-IP，
+// 经 Cloudflare 隧道访问时锁定的是真实客户端而不是边缘节点。
+var (
+	authFailures   = make(map[string]*ipFailures)
+	authAudited    = make(map[string]time.Time) // 重复事件（IP|原因|主体）最近一次写入审计的时间
+	authFailuresMu sync.Mutex
+)
+
+// authLockedFor 返回该 IP 剩余的锁定时长，未锁定时为 0
+func authLockedFor(ip string) time.Duration {
+	authFailuresMu.Lock()
+	defer authFailuresMu.Unlock()
+
+	f, ok := authFailures[ip]
+	if !ok {
+		return 0
+	}
+	if d := time.Until(f.lockedUntil); d > 0 {
+		return d
+	}
+	return 0
+}
+
+// recordAuthFailure 计一次失败，超过免费次数后按 1m、2m、4m … 锁定，最长 1 小时
+func recordAuthFailure(ip string) time.Duration {
+	authFailuresMu.Lock()
+	defer authFailuresMu.Unlock()
+
+	now := time.Now()
+	f, ok := authFailures[ip]
+	if !ok || now.Sub(f.lastFailure) > authFailureReset {
+		f = &ipFailures{}
+		authFailures[ip] = f
+	}
+	f.count++
+	f.lastFailure = now
+
+	if f.count < authFreeFailures {
+		return 0
+	}
+	lockout := authMaxLockout
+	if shift := f.count - authFreeFailures; shift < 10 {
+		lockout = min(authBaseLockout<<shift, authMaxLockout)
+	}
+	f.lockedUntil = now.Add(lockout)
+	return lockout
+}
+
+// recordAuthSuccess 鉴权成功后清零该 IP 的失败计数
+func recordAuthSuccess(ip string) {
+	authFailuresMu.Lock()
+	delete(authFailures, ip)
+	authFailuresMu.Unlock()
+}
+
+// sweepAuthFailures 定期清理已过期的失败计数，避免内存增长
+func sweepAuthFailures() {
+	for range time.Tick(authGuardSweep) {
+		authFailuresMu.Lock()
+		for ip, f := range authFailures {
+			if time.Since(f.lastFailure) > authFailureReset && time.Now().After(f.lockedUntil) {
+				delete(authFailures, ip)
+			}
+		}
+		for key, at := range authAudited {
+			if time.Since(at) > authAuditRepeat {
+				delete(authAudited, key)
+			}
+		}
+		authFailuresMu.Unlock()
+	}
+}
+
+// auditRepeated 重复出现的事件（锁定期内的请求、失效凭据的重试）在 authAuditRepeat 内只写一次审计，
+// 返回本次是否应写入。被锁定的客户端或吊销后仍在重连的设备每隔几秒就会来一次
+func auditRepeated(ip, reason, subject string) bool {
+	key := ip + "|" + reason + "|" + subject
+	now := time.Now()
+
+	authFailuresMu.Lock()
+	defer authFailuresMu.Unlock()
+	if at, ok := authAudited[key]; ok && now.Sub(at) < authAuditRepeat {
+		return false
+	}
+	authAudited[key] = now
+	return true
+}
+
+// staleTokenReason 判断 Token 是否为曾经有效的凭据：签名正确但已过期或已登出的会话 Token、已吊销的设备 Token。
+// 这类失败来自没关的仪表盘标签页或被吊销后仍在重连的设备，不是猜测凭据，不计入失败次数。其他情况返回空
+func staleTokenReason(token string) string {
+	switch {
+	case strings.HasPrefix(token, sessionTokenPrefix):
+		if _, _, ok := decodeSessionToken(token); ok {
+			return "expired_session"
+		}
+	case strings.HasPrefix(token, deviceTokenPrefix):
+		if revoked, err := store.DeviceTokenRevoked(hashToken(token)); err == nil && revoked {
+			return "revoked_token"
+		}
+	}
+	return ""
+}
+
+// redactToken 脱敏后的 Token，仅用于日志与审计：设备 Token 保留签发时记录的前缀，其余只保留类型
+func redactToken(token string) string {
+	switch {
+	case token == "":
+		return "(empty)"
+	case strings.HasPrefix(token, deviceTokenPrefix) && len(token) > len(deviceTokenPrefix)+6:
+		return token[:len(deviceTokenPrefix)+6] + "…"
+	case strings.HasPrefix(token, sessionTokenPrefix):
+		return sessionTokenPrefix + "…"
+	}
+	return "***(" + strconv.Itoa(len(token)) + " chars)"
+}
+
+// rejectIfLocked 来源 IP 处于锁定期时返回 429 并记录审计事件（同一 IP 与主体每 authAuditRepeat 一条）
+func rejectIfLocked(c *gin.Context, kind, subject string) bool {
+	d := authLockedFor(c.ClientIP())
+	if d <= 0 {
+		return false
+	}
+	if auditRepeated(c.ClientIP(), "locked", subject) {
+		recordAuthEvent(c, kind, subject, false, "locked")
+	}
+	c.Header("Retry-After", strconv.Itoa(int(d.Seconds())+1))
+	c.JSON(http.StatusTooManyRequests, gin.H{"error": "尝试次数过多，请稍后再试", "retry_after": int(d.Seconds()) + 1})
+	return true
+}
+
+// authFailed 记录一次失败（计数 + 审计 + 日志）
+func authFailed(c *gin.Context, kind, subject, reason string) {
+	ip := c.ClientIP()
+	if lockout := recordAuthFailure(ip); lockout > 0 {
+		log.Printf("[Auth] ⚠️ %s 鉴权失败次数过多，锁定 %s", ip, lockout)
+	}
+	recordAuthEvent(c, kind, subject, false, reason)
+}
+
+// authSucceeded 记录一次成功（清零计数 + 审计）
+func authSucceeded(c *gin.Context, kind, subject string) {
+	recordAuthSuccess(c.ClientIP())
+	recordAuthEvent(c, kind, subject, true, "")
+}
+
+// recordAuthEvent 写入鉴权审计表。subject 为用户名或脱敏后的 Token，绝不写入明文凭据
+func recordAuthEvent(c *gin.Context, kind, subject string, success bool, reason string) {
+	event := AuthEvent{
+		Time:      time.Now(),
+		ClientIP:  c.ClientIP(),
+		Kind:      kind,
+		Subject:   subject,
+		Success:   success,
+		Reason:    reason,
+		Path:      c.Request.URL.Path,
+		UserAgent: c.Request.UserAgent(),
+	}
+	if err := store.CreateAuthEvent(&event); err != nil {
+		log.Printf("[Auth] 写入鉴权审计失败: %v", err)
+	}
+}
+
+// authenticateGuarded 带锁定检查的 Token 鉴权，所有 Token 入口（Bearer 头与 ?token=）共用：
+// 失败计入来源 IP 的失败次数并写审计，成功清零计数。成功事件只在 audit 为 true 时写入审计表，
+// 按请求调用的高频路径（/api/*、/report、Mihomo 定时拉取的 /templates/*）不记录成功，避免刷满审计表。
+// 未携带 Token 不计为失败（仪表盘未登录时的请求）；过期的会话与已吊销的设备 Token 也不计入，
+// 只按 authAuditRepeat 间隔审计，锁定只针对密码登录与无法识别的 Token。失败时已写出 401/429 响应
+func authenticateGuarded(c *gin.Context, kind, token string, audit bool) (*Principal, bool) {
+	subject := redactToken(token)
+	if rejectIfLocked(c, kind, subject) {
+		return nil, false
+	}
+
+	p, ok := authenticateToken(token)
+	if !ok {
+		if reason := staleTokenReason(token); reason != "" {
+			if auditRepeated(c.ClientIP(), reason, subject) {
+				log.Printf("[Auth] 凭据已失效: %s %s (%s=%s, %s)", c.ClientIP(), c.Request.URL.Path, kind, subject, reason)
+				recordAuthEvent(c, kind, subject, false, reason)
+			}
+		} else if token != "" {
+			log.Printf("[Auth] Token 鉴权失败: %s %s (%s=%s)", c.ClientIP(), c.Request.URL.Path, kind, subject)
+			authFailed(c, kind, subject, "invalid_token")
+		}
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized: invalid or missing token"})
+		return nil, false
+	}
+	recordAuthSuccess(c.ClientIP())
+	if audit {
+		recordAuthEvent(c, kind, p.String(), true, "")
+	}
+	return p, true
+}
+
+// authenticateQueryToken ?token= 查询参数鉴权（/sub、/templates/*、/ws/live），并检查权限。
+// 失败时已写出 401/403/429 响应
+func authenticateQueryToken(c *gin.Context, perm string, audit bool) (*Principal, bool) {
+	p, ok := authenticateGuarded(c, "token", c.Query("token"), audit)
+	if !ok {
+		return nil, false
+	}
+	if !authorize(c, p, perm) {
+		return nil, false
+	}
+	return p, true
+}
+
+// handleGetAuthEvents GET /api/auth-events — 最近的鉴权事件（?limit=&ip=&success=true|false）
+func handleGetAuthEvents(c *gin.Context) {
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "100"))
+	if limit <= 0 {
+		limit = 100
+	}
+	if limit > authEventsMax {
+		limit = authEventsMax
+	}
+
+	q := AuthEventQuery{ClientIP: c.Query("ip"), Limit: limit}
+	if success := c.Query("success"); success != "" {
+		ok := success == "true" || success == "1"
+		q.Success = &ok
+	}
+
+	events, err := store.ListAuthEvents(q)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"events": events})
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStaleTokenReason(t *testing.T) {
+	// 使用固定密钥，避免在数据目录下生成 session.key
+	sessionKeyOnce.Do(func() { sessionKey = []byte(strings.Repeat("k", 32)) })
+
+	expired := newSessionToken("s1", time.Now().Add(-time.Hour))
+	valid := newSessionToken("s2", time.Now().Add(time.Hour))
+	tests := []struct {
+		name  string
+		token string
+		want  string
+	}{
+		{"空", "", ""},
+		{"过期的会话 Token", expired, "expired_session"},
+		{"未过期但已登出的会话 Token", valid, "expired_session"},
+		{"签名被篡改的会话 Token 计为失败", expired[:len(expired)-2] + "xx", ""},
+		{"伪造的会话 Token 计为失败", sessionTokenPrefix + "abc.def", ""},
+		{"无法识别的 Token 计为失败", "guess", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := staleTokenReason(tt.token); got != tt.want {
+				t.Errorf("staleTokenReason(%s) = %q, 期望 %q", redactToken(tt.token), got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAuditRepeated(t *testing.T) {
+	if !auditRepeated("192.0.2.1", "locked", "admin") {
+		t.Fatal("首次事件应写入审计")
+	}
+	if auditRepeated("192.0.2.1", "locked", "admin") {
+		t.Error("间隔内的重复事件不应写入审计")
+	}
+	if !auditRepeated("192.0.2.1", "locked", "root") || !auditRepeated("192.0.2.2", "locked", "admin") {
+		t.Error("主体或来源不同的事件应分别审计")
+	}
+
+	authFailuresMu.Lock()
+	authAudited["192.0.2.1|locked|admin"] = time.Now().Add(-authAuditRepeat)
+	authFailuresMu.Unlock()
+	if !auditRepeated("192.0.2.1", "locked", "admin") {
+		t.Error("超过间隔后应再次写入审计")
+	}
+}
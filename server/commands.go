@@ -0,0 +1,350 @@
+// 远程命令：经设备的 /ws 连接下发命令（重载配置、刷新订阅、查看 / 切换节点、处理发件箱、诊断），等待客户端回执
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	commandDefaultTimeout = 30 * time.Second
+	commandMaxTimeout     = 2 * time.Minute
+	commandCapability     = "commands" // 客户端在 hello 的 capabilities 中声明支持远程命令
+)
+
+// 命令状态
+const (
+	CommandSent    = "sent"
+	CommandOK      = "ok"
+	CommandFailed  = "failed"
+	CommandTimeout = "timeout"
+)
+
+var (
+	errDeviceOffline       = errors.New("设备不在线")
+	errCommandsUnsupported = errors.New("该设备的客户端版本不支持远程命令")
+	errCommandTimeout      = errors.New("等待设备回执超时")
+	errCommandConnLost     = errors.New("命令回执前设备连接已断开")
+)
+
+// commandActions 支持的命令及其参数校验（nil 表示无参数）
+var commandActions = map[string]func(args json.RawMessage) error{
+	"reload_config":        nil, // 客户端重新读取 config.yaml
+	"refresh_subscription": nil, // Mihomo PUT /configs 重新加载配置文件（args.path 只能是客户端自身的配置文件）
+	"list_proxies":         nil, // Mihomo GET /proxies，返回策略组及当前选中节点
+	"select_proxy":         validateSelectProxy,
+	"flush_outbox":         nil, // 从已确认位置立即重发；args.discard 为 true 时丢弃全部未确认帧
+	"diagnostics":          nil, // 返回客户端运行状态
+}
+
+func validateSelectProxy(args json.RawMessage) error {
+	var a struct {
+		Group string `json:"group"`
+		Name  string `json:"name"`
+	}
+	if err := json.Unmarshal(args, &a); err != nil || a.Group == "" || a.Name == "" {
+		return errors.New("select_proxy 需要参数 group 与 name")
+	}
+	return nil
+}
+
+// wsCommand 下发给客户端的命令帧
+type wsCommand struct {
+	Type   string          `json:"type"` // 固定为 "command"
+	ID     string          `json:"id"`
+	Action string          `json:"action"`
+	Args   json.RawMessage `json:"args,omitempty"`
+}
+
+// wsCommandResult 客户端回复的命令回执（type 为 "command_result"）
+type wsCommandResult struct {
+	ID     string          `json:"id"`
+	OK     bool            `json:"ok"`
+	Result json.RawMessage `json:"result"`
+	Error  string          `json:"error"`
+}
+
+// pendingCommand 等待回执的命令
+type pendingCommand struct {
+	deviceID string
+	result   chan wsCommandResult
+}
+
+var (
+	pendingCommands   = make(map[string]*pendingCommand)
+	pendingCommandsMu sync.Mutex
+)
+
+func newCommandID() (string, error) {
+	b := make([]byte, 12)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// commandTarget 返回设备最近建立的、支持远程命令的连接
+func commandTarget(deviceID string) (*wsSession, error) {
+	wsSessionsMu.Lock()
+	defer wsSessionsMu.Unlock()
+
+	var target *wsSession
+	found := false
+	for s := range wsSessions {
+		if s.deviceID != deviceID {
+			continue
+		}
+		found = true
+		if s.commands && (target == nil || s.startedAt.After(target.startedAt)) {
+			target = s
+		}
+	}
+	switch {
+	case target != nil:
+		return target, nil
+	case found:
+		return nil, errCommandsUnsupported
+	}
+	return nil, errDeviceOffline
+}
+
+// runDeviceCommand 记录并下发命令，等待回执或超时，返回最终的命令记录。
+// 设备不在线、不支持命令时不写库；超时与断线会写入命令记录后一并返回错误
+func runDeviceCommand(deviceID, action string, args json.RawMessage, issuedBy string, timeout time.Duration) (*DeviceCommand, error) {
+	session, err := commandTarget(deviceID)
+	if err != nil {
+		return nil, err
+	}
+	id, err := newCommandID()
+	if err != nil {
+		return nil, err
+	}
+
+	cmd := &DeviceCommand{
+		ID:        id,
+		DeviceID:  deviceID,
+		Action:    action,
+		Args:      string(args),
+		IssuedBy:  issuedBy,
+		Status:    CommandSent,
+		CreatedAt: time.Now(),
+	}
+	if err := store.CreateDeviceCommand(cmd); err != nil {
+		return nil, err
+	}
+
+	pending := &pendingCommand{deviceID: deviceID, result: make(chan wsCommandResult, 1)}
+	pendingCommandsMu.Lock()
+	pendingCommands[id] = pending
+	pendingCommandsMu.Unlock()
+	defer func() {
+		pendingCommandsMu.Lock()
+		delete(pendingCommands, id)
+		pendingCommandsMu.Unlock()
+	}()
+
+	log.Printf("[Command] %s → 设备 %s: %s #%s", issuedBy, deviceID, action, id)
+	var waitErr error
+	if !session.send(wsCommand{Type: "command", ID: id, Action: action, Args: args}) {
+		waitErr = errCommandConnLost
+	} else {
+		select {
+		case r := <-pending.result:
+			// 回执已由 handleCommandResult 落库，这里只回填返回值
+			now := time.Now()
+			cmd.Status, cmd.Result, cmd.Error, cmd.FinishedAt = resultStatus(r), string(r.Result), r.Error, &now
+			return cmd, nil
+		case <-time.After(timeout):
+			waitErr = errCommandTimeout
+		case <-session.closed:
+			waitErr = errCommandConnLost
+		}
+	}
+
+	status := CommandFailed
+	if waitErr == errCommandTimeout {
+		status = CommandTimeout
+	}
+	now := time.Now()
+	if err := store.ExpireDeviceCommand(id, status, waitErr.Error(), now); err != nil {
+		log.Printf("[Command] 更新命令 #%s 状态失败: %v", id, err)
+	}
+	cmd.Status, cmd.Error, cmd.FinishedAt = status, waitErr.Error(), &now
+	log.Printf("[Command] 设备 %s: %s #%s %v", deviceID, action, id, waitErr)
+	return cmd, waitErr
+}
+
+func resultStatus(r wsCommandResult) string {
+	if r.OK {
+		return CommandOK
+	}
+	return CommandFailed
+}
+
+// handleCommandResult 处理客户端回执：只接受命令目标设备的回执，超时后到达的回执也会落库
+func (s *wsSession) handleCommandResult(msg []byte) {
+	var r wsCommandResult
+	if err := json.Unmarshal(msg, &r); err != nil || r.ID == "" {
+		log.Printf("[WS] command_result 格式错误: %v", err)
+		return
+	}
+	if s.deviceID == "" {
+		return
+	}
+
+	status := resultStatus(r)
+	if err := store.CompleteDeviceCommand(r.ID, s.deviceID, status, string(r.Result), r.Error, time.Now()); err != nil {
+		log.Printf("[Command] 保存命令 #%s 的回执失败: %v", r.ID, err)
+	}
+	if r.OK {
+		log.Printf("[Command] 设备 %s 已执行 #%s", s.deviceID, r.ID)
+	} else {
+		log.Printf("[Command] 设备 %s 执行 #%s 失败: %s", s.deviceID, r.ID, r.Error)
+	}
+
+	pendingCommandsMu.Lock()
+	pending := pendingCommands[r.ID]
+	pendingCommandsMu.Unlock()
+	if pending != nil && pending.deviceID == s.deviceID {
+		select {
+		case pending.result <- r:
+		default:
+		}
+	}
+}
+
+// commandErrorStatus 将命令错误映射为 HTTP 状态码
+func commandErrorStatus(err error) int {
+	switch err {
+	case errDeviceOffline, errCommandsUnsupported:
+		return http.StatusConflict
+	case errCommandTimeout:
+		return http.StatusGatewayTimeout
+	case errCommandConnLost:
+		return http.StatusBadGateway
+	}
+	return http.StatusInternalServerError
+}
+
+// commandJSON 命令记录的展示字段，args / result 以 JSON 原样嵌入
+func commandJSON(cmd *DeviceCommand) gin.H {
+	return gin.H{
+		"id":          cmd.ID,
+		"device_id":   cmd.DeviceID,
+		"action":      cmd.Action,
+		"args":        rawJSON(cmd.Args),
+		"issued_by":   cmd.IssuedBy,
+		"status":      cmd.Status,
+		"result":      rawJSON(cmd.Result),
+		"error":       cmd.Error,
+		"created_at":  cmd.CreatedAt,
+		"finished_at": cmd.FinishedAt,
+	}
+}
+
+func rawJSON(s string) json.RawMessage {
+	if s == "" || !json.Valid([]byte(s)) {
+		return nil
+	}
+	return json.RawMessage(s)
+}
+
+// commandTimeout 解析请求中的超时（秒），缺省 30 秒，最长 2 分钟
+func commandTimeout(seconds int) time.Duration {
+	timeout := time.Duration(seconds) * time.Second
+	if timeout <= 0 {
+		timeout = commandDefaultTimeout
+	}
+	if timeout > commandMaxTimeout {
+		timeout = commandMaxTimeout
+	}
+	return timeout
+}
+
+// handleSendCommand POST /api/devices/:id/commands — 向在线设备下发命令并等待回执。
+// 请求体：{"action": "...", "args": {...}, "timeout": 秒}
+func handleSendCommand(c *gin.Context) {
+	var req struct {
+		Action  string          `json:"action"`
+		Args    json.RawMessage `json:"args"`
+		Timeout int             `json:"timeout"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "请求格式错误"})
+		return
+	}
+	validate, ok := commandActions[req.Action]
+	if !ok {
+		actions := make([]string, 0, len(commandActions))
+		for a := range commandActions {
+			actions = append(actions, a)
+		}
+		c.JSON(http.StatusBadRequest, gin.H{"error": "未知命令: " + req.Action, "actions": actions})
+		return
+	}
+	if validate != nil {
+		if err := validate(req.Args); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	principal := c.MustGet(principalKey).(*Principal)
+	cmd, err := runDeviceCommand(c.Param("id"), req.Action, req.Args, principal.String(), commandTimeout(req.Timeout))
+	if err != nil {
+		resp := gin.H{"error": err.Error()}
+		if cmd != nil {
+			resp["command"] = commandJSON(cmd)
+		}
+		c.JSON(commandErrorStatus(err), resp)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"command": commandJSON(cmd)})
+}
+
+// handleListCommands GET /api/devices/:id/commands — 设备最近的命令及回执（?limit=，默认 50，最大 500）
+func handleListCommands(c *gin.Context) {
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "50"))
+	if err != nil || limit <= 0 {
+		limit = 50
+	}
+	if limit > 500 {
+		limit = 500
+	}
+
+	cmds, err := store.ListDeviceCommands(c.Param("id"), limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	list := make([]gin.H, 0, len(cmds))
+	for i := range cmds {
+		list = append(list, commandJSON(&cmds[i]))
+	}
+	c.JSON(http.StatusOK, gin.H{"commands": list})
+}
+
+// handleGetCommand GET /api/commands/:id — 查询单条命令（超时后到达的回执也会体现在这里）
+func handleGetCommand(c *gin.Context) {
+	cmd, err := store.GetDeviceCommand(strings.TrimSpace(c.Param("id")))
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "command not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"command": commandJSON(cmd)})
+}
@@ -11,6 +11,7 @@ import (
 	"strings"
 	"sync"
 	"time"
+	_ "time/tzdata" // 精简镜像中可能没有系统时区数据库
 
 	"github.com/fsnotify/fsnotify"
 )
@@ -20,6 +21,8 @@ type ServerConfig struct {
 	ListenPort        string
 	ServerToken       string
 	DBPath            string
+	DSN               string // PostgreSQL 连接串，非空时使用 PostgreSQL 而不是 SQLite
+	TimescaleDB       bool   // PostgreSQL 上把 traffic_records 转为 TimescaleDB 超表
 	SMTPHost          string
 	SMTPPort          string
 	EmailUser         string
@@ -29,16 +32,38 @@ type ServerConfig struct {
 	MainSubFile       string            // 主订阅文件路径（相对于 templates/ 目录）
 	ReadMainSubConfig bool              // 是否从主订阅文件读取端口和 Token 配置
 	HealthCheckURL    string            // 健康检查 URL（留空则禁用）
+	PublicURL         string            // 客户端访问本服务的外部地址，/sub 注入 x-flow-collect.remote-server 时使用，留空取请求地址
 	SubUrlsUpdateTime int               // SubUrls 更新间隔（秒），默认 604800（7 天）
 	RuleSetUpdateTime int               // RuleSet 更新间隔（秒），默认 604800（7 天）
+	SessionTTL        int               // 仪表盘登录会话有效期（秒），默认 43200（12 小时）
+	Timezone          string            // 报表时区（IANA 名称），日 / 周 / 月边界均按此计算，留空使用系统时区
+
+	RawRetentionDays    int // 原始流量 / 连接记录保留天数，默认 30
+	HourlyRetentionDays int // 小时汇总保留天数，默认 400，0 表示永久
+	DailyRetentionDays  int // 日汇总保留天数，默认 0（永久）
+
+	OfflineAlertMinutes int // 设备离线超过该分钟数时发送告警，默认 30，0 表示不告警
 }
 
 var (
-	conf     ServerConfig
-	confLock sync.RWMutex
-	iniPath  = "./configs/ServerSetting.ini"
+	conf      ServerConfig
+	confLock  sync.RWMutex
+	iniPath   = "./configs/ServerSetting.ini"
+	reportLoc = time.Local // 由 Timezone 解析而来，受 confLock 保护
 )
 
+// reportLocation 返回报表时区
+func reportLocation() *time.Location {
+	confLock.RLock()
+	defer confLock.RUnlock()
+	return reportLoc
+}
+
+// reportDayStart 返回 t 在报表时区中所在日的零点
+func reportDayStart(t time.Time) time.Time {
+	return bucketStart(t, "day", reportLocation())
+}
+
 // parseINIValue 去除值两端的引号（单引号或双引号）
 func parseINIValue(v string) string {
 	v = strings.TrimSpace(v)
@@ -61,7 +86,7 @@ func loadConfig() error {
 	subUrlsMap := make(map[string]string)
 
 	// 默认值
-	conf = ServerConfig{
+	cfg := ServerConfig{
 		ListenPort:        ":8686",
 		ServerToken:       "YourSecretToken",
 		DBPath:            "./data/traffic.db",
@@ -73,6 +98,13 @@ func loadConfig() error {
 		HealthCheckURL:    "",
 		SubUrlsUpdateTime: 604800,
 		RuleSetUpdateTime: 604800,
+		SessionTTL:        43200,
+
+		RawRetentionDays:    30,
+		HourlyRetentionDays: 400,
+		DailyRetentionDays:  0,
+
+		OfflineAlertMinutes: 30,
 	}
 
 	var currentSection string
@@ -129,38 +161,66 @@ func loadConfig() error {
 			case "server":
 				switch lowerKey {
 				case "listenport":
-					conf.ListenPort = val
+					cfg.ListenPort = val
 				case "servertoken":
-					conf.ServerToken = val
+					cfg.ServerToken = val
 				case "dbpath":
-					conf.DBPath = val
+					cfg.DBPath = val
+				case "dsn":
+					cfg.DSN = val
+				case "timescaledb":
+					cfg.TimescaleDB = val == "true" || val == "1" || val == "yes"
 				case "mainsubfile":
-					conf.MainSubFile = val
+					cfg.MainSubFile = val
 				case "readmainsubconfig":
-					conf.ReadMainSubConfig = val == "true" || val == "1" || val == "yes"
+					cfg.ReadMainSubConfig = val == "true" || val == "1" || val == "yes"
 				case "healthcheckurl":
-					conf.HealthCheckURL = val
+					cfg.HealthCheckURL = val
+				case "public_url":
+					cfg.PublicURL = strings.TrimRight(val, "/")
 				case "suburls_update_time":
 					if v, err := strconv.Atoi(val); err == nil && v > 0 {
-						conf.SubUrlsUpdateTime = v
+						cfg.SubUrlsUpdateTime = v
 					}
 				case "ruleset_update_time":
 					if v, err := strconv.Atoi(val); err == nil && v > 0 {
-						conf.RuleSetUpdateTime = v
+						cfg.RuleSetUpdateTime = v
+					}
+				case "timezone":
+					cfg.Timezone = val
+				case "session_ttl":
+					if v, err := strconv.Atoi(val); err == nil && v > 0 {
+						cfg.SessionTTL = v
+					}
+				case "offline_alert_minutes":
+					if v, err := strconv.Atoi(val); err == nil && v >= 0 {
+						cfg.OfflineAlertMinutes = v
+					}
+				case "raw_retention_days":
+					if v, err := strconv.Atoi(val); err == nil && v > 0 {
+						cfg.RawRetentionDays = v
+					}
+				case "hourly_retention_days":
+					if v, err := strconv.Atoi(val); err == nil && v >= 0 {
+						cfg.HourlyRetentionDays = v
+					}
+				case "daily_retention_days":
+					if v, err := strconv.Atoi(val); err == nil && v >= 0 {
+						cfg.DailyRetentionDays = v
 					}
 				}
 			case "smtp":
 				switch lowerKey {
 				case "smtphost":
-					conf.SMTPHost = val
+					cfg.SMTPHost = val
 				case "smtpport":
-					conf.SMTPPort = val
+					cfg.SMTPPort = val
 				case "emailuser":
-					conf.EmailUser = val
+					cfg.EmailUser = val
 				case "emailpass":
-					conf.EmailPass = val
+					cfg.EmailPass = val
 				case "emailto":
-					conf.EmailTo = val
+					cfg.EmailTo = val
 				}
 			}
 		}
@@ -170,6 +230,31 @@ func loadConfig() error {
 		return err
 	}
 
+	loc := time.Local
+	if cfg.Timezone != "" {
+		if l, err := time.LoadLocation(cfg.Timezone); err != nil {
+			log.Printf("⚠️ 无效的 Timezone %q，使用系统时区: %v", cfg.Timezone, err)
+		} else {
+			loc = l
+		}
+	}
+
+	// 汇总层的保留期不能短于更细的一层，否则分层读取时会出现空洞
+	if cfg.HourlyRetentionDays > 0 && cfg.HourlyRetentionDays < cfg.RawRetentionDays {
+		log.Printf("⚠️ hourly_retention_days (%d) 小于 raw_retention_days (%d)，已调整为后者", cfg.HourlyRetentionDays, cfg.RawRetentionDays)
+		cfg.HourlyRetentionDays = cfg.RawRetentionDays
+	}
+	if cfg.DailyRetentionDays > 0 && (cfg.HourlyRetentionDays == 0 || cfg.DailyRetentionDays < cfg.HourlyRetentionDays) {
+		log.Printf("⚠️ daily_retention_days (%d) 短于小时汇总保留期，已改为永久保留", cfg.DailyRetentionDays)
+		cfg.DailyRetentionDays = 0
+	}
+
+	// 解析完成后一次性替换，读取方（reportLocation 等）持 confLock 读锁，不会看到半写的配置
+	confLock.Lock()
+	conf = cfg
+	reportLoc = loc
+	confLock.Unlock()
+
 	log.Printf("[%s] 服务端配置已更新，加载了 %d 个订阅链接", time.Now().Format("15:04:05"), len(subUrlsMap))
 	return nil
 }
@@ -1,17 +1,12 @@
-// 数据库模型定义与初始化
+// 数据库模型定义与初始化（存储后端见 storage.go，表结构由 migrations/ 下的迁移文件定义，修改模型时需同步新增迁移）
 
 package main
 
 import (
 	"log"
 	"time"
-
-	"github.com/glebarez/sqlite"
-	"gorm.io/gorm"
 )
 
-var db *gorm.DB
-
 type TrafficRecord struct {
 	ID          uint      `gorm:"primaryKey"`
 	Timestamp   time.Time `gorm:"index"`
@@ -23,6 +18,149 @@ type TrafficRecord struct {
 	ActiveConns int
 }
 
+// ConnectionRecord 客户端上报的已关闭连接审计记录
+type ConnectionRecord struct {
+	ID          uint   `gorm:"primaryKey"`
+	DeviceID    string `gorm:"index"`
+	ConnID      string
+	StartTime   time.Time `gorm:"index"`
+	EndTime     time.Time
+	Duration    int64 // 毫秒
+	Network     string
+	ConnType    string
+	SourceIP    string
+	SourcePort  string
+	DestIP      string
+	DestPort    string
+	Host        string `gorm:"index"`
+	Rule        string
+	RulePayload string
+	Process     string
+	ProcessPath string
+	Chains      string // 以 " > " 连接的代理链
+	NodeName    string
+	Upload      int64
+	Download    int64
+	IsProxy     bool
+}
+
+// ReportCursor 记录每个设备上报流已入库的最大序号，客户端重放发件箱时据此去重
+type ReportCursor struct {
+	DeviceID  string `gorm:"primaryKey"`
+	Stream    string `gorm:"primaryKey"`
+	LastSeq   uint64
+	UpdatedAt time.Time
+}
+
+// Device 设备登记表。握手信息、最近活跃时间与心跳状态随上报连接更新
+type Device struct {
+	ID         string `gorm:"primaryKey"` // 即上报数据中的 device_id
+	Note       string
+	CreatedAt  time.Time
+	LastSeenAt *time.Time
+	LastIP     string
+	Profile    string // 订阅默认使用的 Profile（templates/profiles/<Profile>.yaml），空表示默认
+	DeviceHello
+	DeviceHeartbeat
+}
+
+// DeviceHello 客户端连接 /ws 后在 hello 帧中报告的环境信息（旧版客户端只有握手头中的版本号）
+type DeviceHello struct {
+	ClientVersion string
+	OS            string
+	Arch          string
+	MihomoVersion string
+	ConfigHash    string // config.yaml 内容摘要
+}
+
+// DeviceHeartbeat 客户端心跳中报告的本地健康状态
+type DeviceHeartbeat struct {
+	HeartbeatAt     *time.Time
+	MihomoReachable bool
+	QueueDepth      int64 // 发件箱中未确认的帧数
+	Dropped         int64 // 发件箱累计丢弃的帧数
+}
+
+// DeviceSession 设备的一次上报连接（/ws 会话）。EndedAt 为空表示仍在线
+type DeviceSession struct {
+	ID         uint   `gorm:"primaryKey"`
+	DeviceID   string `gorm:"index"`
+	TokenID    uint   // 使用 ServerToken 连接时为 0
+	RemoteIP   string
+	StartedAt  time.Time `gorm:"index"`
+	EndedAt    *time.Time
+	LastSeenAt time.Time
+	DeviceHello
+}
+
+// DeviceCommand 经 /ws 下发给设备的远程命令。Status：sent（已下发）/ ok / failed / timeout
+type DeviceCommand struct {
+	ID         string `gorm:"primaryKey"`
+	DeviceID   string `gorm:"index"`
+	Action     string
+	Args       string // JSON
+	IssuedBy   string // 发起人（Principal 描述）
+	Status     string
+	Result     string // 客户端回执中的 JSON 结果
+	Error      string
+	CreatedAt  time.Time `gorm:"index"`
+	FinishedAt *time.Time
+}
+
+// NodeLatency 设备对节点的一次延迟测试（Mihomo /proxies/{name}/delay）
+type NodeLatency struct {
+	ID        uint      `gorm:"primaryKey"`
+	Timestamp time.Time `gorm:"index"`
+	DeviceID  string
+	NodeName  string
+	Delay     int // 毫秒，0 表示超时或失败
+}
+
+// DeviceToken 设备凭据。仅保存 SHA-256 摘要，明文只在签发时返回一次
+type DeviceToken struct {
+	ID         uint   `gorm:"primaryKey"`
+	DeviceID   string `gorm:"index"`
+	Label      string
+	Prefix     string // 明文的前几位，便于在列表中辨认
+	TokenHash  string `gorm:"uniqueIndex" json:"-"`
+	CreatedAt  time.Time
+	LastUsedAt *time.Time
+	RevokedAt  *time.Time
+}
+
+// User 仪表盘登录用户，密码以 bcrypt 摘要保存
+type User struct {
+	ID           uint   `gorm:"primaryKey"`
+	Username     string `gorm:"uniqueIndex"`
+	PasswordHash string `json:"-"`
+	Role         string
+	CreatedAt    time.Time
+	LastLoginAt  *time.Time
+}
+
+// UserSession 登录会话。会话 Token 中携带会话 ID，登出时写入 RevokedAt 使其立即失效
+type UserSession struct {
+	ID        string `gorm:"primaryKey"`
+	UserID    uint   `gorm:"index"`
+	ClientIP  string
+	CreatedAt time.Time
+	ExpiresAt time.Time `gorm:"index"`
+	RevokedAt *time.Time
+}
+
+// AuthEvent 鉴权审计事件（登录、?token= 鉴权、登出），Subject 为用户名或脱敏后的 Token
+type AuthEvent struct {
+	ID        uint      `gorm:"primaryKey"`
+	Time      time.Time `gorm:"index"`
+	ClientIP  string    `gorm:"index"`
+	Kind      string    // login / token / logout
+	Subject   string
+	Success   bool
+	Reason    string // bad_credentials / invalid_token / locked
+	Path      string
+	UserAgent string
+}
+
 type SubSnapshot struct {
 	ID     uint      `gorm:"primaryKey"`
 	Date   time.Time `gorm:"index"`
@@ -32,27 +170,26 @@ type SubSnapshot struct {
 	Expire int64
 }
 
-func initDB() {
-	var err error
-
-	// 高并发读写优化：启用 WAL 模式 (Write-Ahead Logging) 并设置 busy_timeout
-	dsn := conf.DBPath + "?_pragma=journal_mode(WAL)&_pragma=busy_timeout(5000)&_pragma=synchronous(NORMAL)"
+// openStore 按配置打开存储后端（SQLite 或 PostgreSQL），不执行迁移
+func openStore() *gormStore {
+	dialect, dsn := storeDSN()
+	confLock.RLock()
+	timescaleDB := conf.TimescaleDB
+	confLock.RUnlock()
 
-	db, err = gorm.Open(sqlite.Open(dsn), &gorm.Config{})
+	s, err := openGormStore(dialect, dsn, timescaleDB)
 	if err != nil {
 		log.Fatal("数据库连接失败:", err)
 	}
+	return s
+}
 
-	// 获取底层的 sql.DB 进行连接池配置
-	sqlDB, err := db.DB()
-	if err == nil {
-		// 设置最大打开的连接数，推荐 SQLite WAL 模式下可以适当增大，但不宜过多避免锁竞争
-		sqlDB.SetMaxOpenConns(1) // SQLite 最安全的并发写入配置是强串行写入（1）+ WAL 并发读
-		// 但由于 WAL 模式支持多读一写，Go 内置的 sql 包也能很好的处理 sqlite 的并发，我们可以稍微增大或者直接不设限制使用默认
-		// 结合 CGO / Pure Go SQLite 的差异，glebarez/sqlite (pure go) 在设为 1 时写入最稳
-		// 结合业务，这里写入是高频小包，建议设置为 1 强制串行写入，避免 "database is locked"
-		sqlDB.SetMaxOpenConns(1)
+// initDB 打开存储后端并执行待应用的迁移
+func initDB() {
+	s := openStore()
+	if err := s.Migrate(); err != nil {
+		log.Fatal("数据库迁移失败:", err)
 	}
-
-	db.AutoMigrate(&TrafficRecord{}, &SubSnapshot{})
+	store = s
+	log.Printf("[Store] 存储后端: %s", s.Dialect())
 }
@@ -0,0 +1,215 @@
+// 设备凭据：签发 / 列出 / 吊销每台设备独立的 Token，并据此识别上报方身份
+
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// deviceTokenPrefix 设备 Token 的固定前缀，用于与 ServerToken 等其他凭据区分
+const deviceTokenPrefix = "fcd_"
+
+// Principal 已认证的调用方
+type Principal struct {
+	Kind     string // "master"（ServerToken）、"device"（设备 Token）或 "user"（登录会话）
+	DeviceID string // Kind 为 device 时绑定的设备 ID
+	TokenID  uint   // Kind 为 device 时对应的 DeviceToken.ID
+
+	UserID    uint // Kind 为 user 时的登录用户
+	Username  string
+	Role      string
+	SessionID string
+}
+
+// principalKey gin.Context 中保存 *Principal 的键
+const principalKey = "principal"
+
+// bearerToken 从 Authorization 头中取出 Bearer Token
+func bearerToken(c *gin.Context) string {
+	return strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// newDeviceToken 生成一个随机的设备 Token 明文
+func newDeviceToken() (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return deviceTokenPrefix + hex.EncodeToString(b), nil
+}
+
+// authenticateToken 识别 Token 对应的调用方：ServerToken 视为 master，
+// 会话 Token 交给 authenticateSession，其余按设备 Token 查库（已吊销的不通过）。
+// 只负责认证，能访问哪些路由由 rbac.go 中的权限决定。
+func authenticateToken(token string) (*Principal, bool) {
+	if token == "" {
+		return nil, false
+	}
+	if strings.HasPrefix(token, sessionTokenPrefix) {
+		return authenticateSession(token)
+	}
+
+	confLock.RLock()
+	master := conf.ServerToken
+	confLock.RUnlock()
+	if master != "" && subtle.ConstantTimeCompare([]byte(token), []byte(master)) == 1 {
+		return &Principal{Kind: "master"}, true
+	}
+
+	if !strings.HasPrefix(token, deviceTokenPrefix) {
+		return nil, false
+	}
+	dt, err := store.FindDeviceToken(hashToken(token))
+	if err != nil {
+		return nil, false
+	}
+
+	// 最近使用时间按分钟粒度更新，避免每次上报都写库
+	now := time.Now()
+	if dt.LastUsedAt == nil || now.Sub(*dt.LastUsedAt) > time.Minute {
+		store.TouchDeviceToken(dt.ID, now)
+	}
+	return &Principal{Kind: "device", DeviceID: dt.DeviceID, TokenID: dt.ID}, true
+}
+
+// legacyDevices 已允许以 ServerToken 上报的设备，同时保证每台设备只提示一次弃用警告
+var legacyDevices sync.Map
+
+// knownDevice 判断设备是否已登记：devices 表中存在，或已有流量记录（设备表出现之前接入的旧设备）
+func knownDevice(deviceID string) (bool, error) {
+	_, err := store.GetDevice(deviceID)
+	if err == nil {
+		return true, nil
+	}
+	if !errors.Is(err, ErrNotFound) {
+		return false, err
+	}
+	ids, err := store.DeviceIDs()
+	if err != nil {
+		return false, err
+	}
+	return slices.Contains(ids, deviceID), nil
+}
+
+// checkLegacyReport ServerToken 上报（/ws、/report）已弃用：帧内的 device_id 无法验证，
+// 因此只允许已登记的设备继续使用，新设备必须先签发设备 Token。其他身份直接放行
+func checkLegacyReport(p *Principal, deviceID string) error {
+	if p == nil || p.Kind != "master" {
+		return nil
+	}
+	if deviceID == "" {
+		return errors.New("使用 ServerToken 上报时必须携带 device_id")
+	}
+	if _, ok := legacyDevices.Load(deviceID); ok {
+		return nil
+	}
+	known, err := knownDevice(deviceID)
+	if err != nil {
+		return fmt.Errorf("查询设备 %s 失败: %w", deviceID, err)
+	}
+	if !known {
+		return fmt.Errorf("未登记的设备 %s：ServerToken 上报已弃用，新设备请使用设备 Token（POST /api/tokens 签发）", deviceID)
+	}
+	if _, loaded := legacyDevices.LoadOrStore(deviceID, true); !loaded {
+		log.Printf("[Auth] ⚠️ 设备 %s 仍在使用 ServerToken 上报，该方式已弃用，请为其签发设备 Token", deviceID)
+	}
+	return nil
+}
+
+// issueDeviceToken 为设备签发新 Token（设备不存在时自动登记），返回明文与记录
+func issueDeviceToken(deviceID, label string) (string, *DeviceToken, error) {
+	token, err := newDeviceToken()
+	if err != nil {
+		return "", nil, err
+	}
+	dt := &DeviceToken{
+		DeviceID:  deviceID,
+		Label:     label,
+		Prefix:    token[:len(deviceTokenPrefix)+6],
+		TokenHash: hashToken(token),
+	}
+	if err := store.CreateDeviceToken(dt); err != nil {
+		return "", nil, err
+	}
+	return token, dt, nil
+}
+
+// handleIssueToken POST /api/tokens — 为设备签发 Token，明文仅在响应中出现一次
+func handleIssueToken(c *gin.Context) {
+	var req struct {
+		DeviceID string `json:"device_id"`
+		Label    string `json:"label"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil || strings.TrimSpace(req.DeviceID) == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "device_id 不能为空"})
+		return
+	}
+
+	token, dt, err := issueDeviceToken(strings.TrimSpace(req.DeviceID), req.Label)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	log.Printf("[Device] 已为设备 %s 签发 Token #%d (%s)", dt.DeviceID, dt.ID, dt.Prefix)
+	c.JSON(http.StatusOK, gin.H{"token": token, "record": dt})
+}
+
+// handleListTokens GET /api/tokens — 列出设备 Token（可用 ?device= 过滤）
+func handleListTokens(c *gin.Context) {
+	tokens, err := store.ListDeviceTokens(c.Query("device"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"tokens": tokens})
+}
+
+// handleRevokeToken DELETE /api/tokens/:id — 吊销 Token，并断开使用该 Token 的在线连接
+func handleRevokeToken(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+		return
+	}
+
+	dt, err := store.GetDeviceToken(uint(id))
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "token not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if dt.RevokedAt == nil {
+		now := time.Now()
+		if err := store.RevokeDeviceToken(dt.ID, now); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		dt.RevokedAt = &now
+	}
+
+	closed := closeSessionsByToken(dt.ID)
+	log.Printf("[Device] 已吊销设备 %s 的 Token #%d，断开 %d 个在线连接", dt.DeviceID, dt.ID, closed)
+	c.JSON(http.StatusOK, gin.H{"record": dt, "closed_sessions": closed})
+}
@@ -3,7 +3,9 @@
 package main
 
 import (
+	"log"
 	"net/http"
+	"strconv"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -11,15 +13,6 @@ import (
 
 // 提取的上报处理逻辑
 func handleReport(c *gin.Context) {
-	confLock.RLock()
-	token := conf.ServerToken
-	confLock.RUnlock()
-
-	if c.GetHeader("Authorization") != "Bearer "+token {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
-		return
-	}
-
 	var data struct {
 		Timestamp   int64  `json:"timestamp"`
 		DeviceID    string `json:"device_id"`
@@ -35,7 +28,7 @@ func handleReport(c *gin.Context) {
 		return
 	}
 
-	db.Create(&TrafficRecord{
+	record := TrafficRecord{
 		Timestamp:   time.Unix(data.Timestamp, 0),
 		DeviceID:    data.DeviceID,
 		NodeName:    data.NodeName,
@@ -43,7 +36,18 @@ func handleReport(c *gin.Context) {
 		DownDelta:   data.DownDelta,
 		IsProxy:     data.IsProxy,
 		ActiveConns: data.ActiveConns,
-	})
+	}
+	job := &ingestJob{deviceID: data.DeviceID, traffic: []TrafficRecord{record}}
+	principal := c.MustGet(principalKey).(*Principal)
+	job.bindDevice(principal)
+	if err := checkLegacyReport(principal, job.deviceID); err != nil {
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		return
+	}
+	if _, err := ingestSync(job); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
 	c.Status(http.StatusOK)
 }
 
@@ -59,43 +63,51 @@ func handleAuth(c *gin.Context) {
 		return
 	}
 
-	confLock.RLock()
-	validUser := conf.EmailUser
-	validPass := conf.ServerToken
-	confLock.RUnlock()
+	if rejectIfLocked(c, "login", loginReq.Username) {
+		return
+	}
 
-	if validUser != "" && loginReq.Username == validUser && loginReq.Password == validPass {
-		c.JSON(http.StatusOK, gin.H{"token": validPass})
+	user, ok := checkPassword(loginReq.Username, loginReq.Password)
+	if !ok {
+		log.Printf("[Auth] 登录失败: %s (用户: %s)", c.ClientIP(), loginReq.Username)
+		authFailed(c, "login", loginReq.Username, "bad_credentials")
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "用户名或密码错误"})
 		return
 	}
+	authSucceeded(c, "login", user.Username)
 
-	c.JSON(http.StatusUnauthorized, gin.H{"error": "用户名或密码错误，请检查 ServerSetting.ini"})
+	token, expiresAt, err := createSession(user, c.ClientIP())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	log.Printf("[Auth] 用户 %s 登录成功: %s", user.Username, c.ClientIP())
+	c.JSON(http.StatusOK, gin.H{
+		"token":      token,
+		"expires_at": expiresAt.Unix(),
+		"username":   user.Username,
+		"role":       user.Role,
+	})
 }
 
 // Vue3 后端接口逻辑
 func handleGetStats(c *gin.Context) {
-	today := time.Now().Truncate(24 * time.Hour)
+	// 今日零点按报表时区计算
+	dayStart := reportDayStart(time.Now())
 
 	// 1. 统计今日各节点流量排行
-	type NodeResult struct {
-		NodeName string `json:"node_name"`
-		Total    int64  `json:"total"`
-		IsProxy  bool   `json:"is_proxy"`
+	nodeStats, err := store.NodeTotals(dayStart)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
 	}
-	var nodeStats []NodeResult
-	db.Model(&TrafficRecord{}).Select("node_name, SUM(up_delta + down_delta) as total, is_proxy").Where("timestamp >= ?", today).Group("node_name").Order("total DESC").Scan(&nodeStats)
 
 	// 2. 统计今日代理 vs 本地总量
-	var summary struct {
-		ProxyUp   int64 `json:"proxy_up"`
-		ProxyDown int64 `json:"proxy_down"`
-		LocalUp   int64 `json:"local_up"`
-		LocalDown int64 `json:"local_down"`
+	summary, err := store.Summary(dayStart)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
 	}
-	db.Model(&TrafficRecord{}).Where("timestamp >= ? AND is_proxy = ?", today, true).Select("COALESCE(SUM(up_delta), 0)").Scan(&summary.ProxyUp)
-	db.Model(&TrafficRecord{}).Where("timestamp >= ? AND is_proxy = ?", today, true).Select("COALESCE(SUM(down_delta), 0)").Scan(&summary.ProxyDown)
-	db.Model(&TrafficRecord{}).Where("timestamp >= ? AND is_proxy = ?", today, false).Select("COALESCE(SUM(up_delta), 0)").Scan(&summary.LocalUp)
-	db.Model(&TrafficRecord{}).Where("timestamp >= ? AND is_proxy = ?", today, false).Select("COALESCE(SUM(down_delta), 0)").Scan(&summary.LocalDown)
 
 	// 3. 获取最新的订阅快照
 	var subStats []SubSnapshot
@@ -104,50 +116,30 @@ func handleGetStats(c *gin.Context) {
 	confLock.RUnlock()
 
 	for _, url := range subUrls {
-		var snap SubSnapshot
-		if err := db.Where("sub_url = ?", url).Order("date desc, id desc").First(&snap).Error; err == nil {
-			subStats = append(subStats, snap)
+		if snap, err := store.LatestSubSnapshot(url, time.Time{}); err == nil {
+			subStats = append(subStats, *snap)
 		}
 	}
 
 	// 4. 统计设备信息 (新增，模仿 fake_api.go)
 	var deviceStats []gin.H
-	var deviceIDs []string
-	db.Model(&TrafficRecord{}).Distinct("device_id").Pluck("device_id", &deviceIDs)
-
-	// a. 预查询，避免N+1
-	type DeviceTraffic struct {
-		DeviceID string
-		Up       int64
-		Down     int64
-	}
-	var todayTraffics, totalTraffics []DeviceTraffic
-	db.Model(&TrafficRecord{}).Select("device_id, SUM(up_delta) as up, SUM(down_delta) as down").Where("timestamp >= ?", today).Group("device_id").Scan(&todayTraffics)
-	db.Model(&TrafficRecord{}).Select("device_id, SUM(up_delta) as up, SUM(down_delta) as down").Group("device_id").Scan(&totalTraffics)
-
-	type DeviceNodeUsage struct {
-		DeviceID, NodeName string
-		Up, Down           int64
-	}
-	var nodeUsages []DeviceNodeUsage
-	db.Model(&TrafficRecord{}).Select("device_id, node_name, SUM(up_delta) as up, SUM(down_delta) as down").Where("timestamp >= ?", today).Group("device_id, node_name").Scan(&nodeUsages)
-
-	type DeviceFirstSeen struct {
-		DeviceID  string
-		FirstSeen time.Time
+	deviceIDs, err := store.DeviceIDs()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
 	}
-	var firstSeens []DeviceFirstSeen
-	db.Model(&TrafficRecord{}).Select("device_id, MIN(timestamp) as first_seen").Group("device_id").Scan(&firstSeens)
 
-	// 查询每个设备今日最新一条记录的活跃连接数
-	activeConnsMap := make(map[string]int)
-	for _, devID := range deviceIDs {
-		var latest TrafficRecord
-		if err := db.Where("device_id = ? AND timestamp >= ?", devID, today).
-			Order("timestamp DESC, id DESC").First(&latest).Error; err == nil {
-			activeConnsMap[devID] = latest.ActiveConns
-		}
-	}
+	// a. 预查询，避免N+1
+	todayTraffics, _ := store.DeviceTrafficSince(dayStart)
+	// 累计流量读日汇总表：原始记录只保留 raw_retention_days 天
+	totalTraffics, _ := store.DeviceTrafficTotals()
+	nodeUsages, _ := store.DeviceNodeUsage(dayStart)
+	// 今日各设备到各节点的延迟
+	latencyStats, _ := store.LatencyStats(dayStart)
+	// 在线时长取本次上线以来的时间，离线设备为 0
+	online := presenceSnapshot()
+	// 每个设备今日最新一条记录的活跃连接数
+	activeConnsMap, _ := store.LatestActiveConns(deviceIDs, dayStart)
 
 	// b. 数据整理到Map
 	todayTrafficMap := make(map[string]DeviceTraffic)
@@ -162,9 +154,9 @@ func handleGetStats(c *gin.Context) {
 	for _, u := range nodeUsages {
 		nodeUsageMap[u.DeviceID] = append(nodeUsageMap[u.DeviceID], u)
 	}
-	firstSeenMap := make(map[string]time.Time)
-	for _, s := range firstSeens {
-		firstSeenMap[s.DeviceID] = s.FirstSeen
+	latencyMap := make(map[string][]LatencyStat)
+	for _, l := range latencyStats {
+		latencyMap[l.DeviceID] = append(latencyMap[l.DeviceID], l)
 	}
 
 	// c. 组装最终数据
@@ -172,22 +164,39 @@ func handleGetStats(c *gin.Context) {
 		devToday := todayTrafficMap[devID]
 		devTotal := totalTrafficMap[devID]
 		devNodes := nodeUsageMap[devID]
+		devLatency := latencyMap[devID]
+		nodeLatency := make(map[string]int64, len(devLatency))
+		for _, l := range devLatency {
+			nodeLatency[l.NodeName] = l.Avg
+		}
 		var devNodeDetails []gin.H
 		for _, nu := range devNodes {
-			devNodeDetails = append(devNodeDetails, gin.H{"name": nu.NodeName, "up_value": nu.Up, "down_value": nu.Down, "formatted_value": formatNetworkBytes(float64(nu.Up + nu.Down))})
+			detail := gin.H{"name": nu.NodeName, "up_value": nu.Up, "down_value": nu.Down, "formatted_value": formatNetworkBytes(float64(nu.Up + nu.Down))}
+			if avg, ok := nodeLatency[nu.NodeName]; ok {
+				detail["latency"] = avg
+			}
+			devNodeDetails = append(devNodeDetails, detail)
+		}
+
+		var uptime int64
+		var health gin.H
+		p, isOnline := online[devID]
+		if isOnline {
+			uptime = int64(time.Since(p.Since).Seconds())
+			health = healthJSON(p.Hello, p.Heartbeat)
 		}
 
 		deviceStats = append(deviceStats, gin.H{
-			"device_name": devID, "uptime": int64(time.Since(firstSeenMap[devID]).Seconds()),
+			"device_name": devID, "uptime": uptime, "online": isOnline,
 			"current_up": devToday.Up, "current_down": devToday.Down, "formatted_current_up": formatNetworkBytes(float64(devToday.Up)), "formatted_current_down": formatNetworkBytes(float64(devToday.Down)),
 			"total_up": devTotal.Up, "total_down": devTotal.Down, "formatted_total_up": formatNetworkBytes(float64(devTotal.Up)), "formatted_total_down": formatNetworkBytes(float64(devTotal.Down)),
 			"active_connections": activeConnsMap[devID], "closed_connections": 0, "total_connections": activeConnsMap[devID],
-			"node_usage": devNodeDetails,
+			"node_usage": devNodeDetails, "health": health, "latency": devLatency,
 		})
 	}
 
 	c.JSON(http.StatusOK, gin.H{
-		"date":         today.Format("2006-01-02"),
+		"date":         dayStart.Format("2006-01-02"),
 		"summary":      summary,
 		"node_stats":   nodeStats,
 		"sub_stats":    subStats,
@@ -195,9 +204,21 @@ func handleGetStats(c *gin.Context) {
 	})
 }
 
-// handleGetDevices 返回数据库中所有已知的设备 ID 列表
-func handleGetDevices(c *gin.Context) {
-	var deviceIDs []string
-	db.Model(&TrafficRecord{}).Distinct("device_id").Where("device_id != ?", "").Pluck("device_id", &deviceIDs)
-	c.JSON(http.StatusOK, gin.H{"devices": deviceIDs})
+// handleGetConnections 返回已关闭连接的审计记录（按结束时间倒序）
+// 支持查询参数：device（设备 ID）、host（域名模糊匹配）、limit（默认 100，最大 1000）
+func handleGetConnections(c *gin.Context) {
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "100"))
+	if err != nil || limit <= 0 {
+		limit = 100
+	}
+	if limit > 1000 {
+		limit = 1000
+	}
+
+	records, err := store.Connections(ConnQuery{Device: c.Query("device"), Host: c.Query("host"), Limit: limit})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"connections": records})
 }
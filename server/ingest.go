@@ -0,0 +1,178 @@
+// 上报数据写入管线：合并来自所有连接的上报帧，批量写入同一个事务
+
+package main
+
+import (
+	"errors"
+	"log"
+	"time"
+)
+
+const (
+	ingestMaxDelay = 50 * time.Millisecond // 第一帧到达后最多等待多久以合并后续帧
+	ingestMaxRows  = 2000                  // 单个事务最多写入的行数
+	ingestQueueLen = 1024
+)
+
+// ingestJob 一个待入库的上报帧（单条流量、单条连接记录或一个批次）
+type ingestJob struct {
+	deviceID string
+	head     wsFrameHeader
+	traffic  []TrafficRecord
+	conns    []ConnectionRecord
+	// failed 由同一连接的所有 job 共享：前序帧写入失败后，后续帧一律拒绝，
+	// 保证游标不会越过失败的序号（客户端重连后会从失败处重放）
+	failed *bool
+	// done 在事务结束后被调用；dup 表示该帧此前已入库
+	done func(dup bool, err error)
+}
+
+func (j *ingestJob) rows() int {
+	return len(j.traffic) + len(j.conns)
+}
+
+// bindDevice 使用设备 Token 认证时，以 Token 绑定的设备 ID 覆盖帧内自报的 device_id
+func (j *ingestJob) bindDevice(p *Principal) {
+	if p == nil || p.Kind != "device" {
+		return
+	}
+	if j.deviceID != p.DeviceID {
+		log.Printf("[Ingest] 设备 ID 不匹配: 帧内为 %q，Token 绑定 %q，以 Token 为准", j.deviceID, p.DeviceID)
+		j.deviceID = p.DeviceID
+	}
+	for i := range j.traffic {
+		j.traffic[i].DeviceID = p.DeviceID
+	}
+	for i := range j.conns {
+		j.conns[i].DeviceID = p.DeviceID
+	}
+}
+
+var ingestQueue = make(chan *ingestJob, ingestQueueLen)
+
+// startIngestPipeline 启动写入管线（initDB 之后调用）
+func startIngestPipeline() {
+	go ingestLoop()
+}
+
+// submitIngest 将上报帧放入写入管线，结果通过 job.done 异步返回。
+// 同一连接的帧按提交顺序入库。
+func submitIngest(job *ingestJob) {
+	ingestQueue <- job
+}
+
+// ingestSync 同步写入，供 HTTP /report 等无需流水线的场景使用
+func ingestSync(job *ingestJob) (dup bool, err error) {
+	ch := make(chan struct{})
+	job.done = func(d bool, e error) {
+		dup, err = d, e
+		close(ch)
+	}
+	submitIngest(job)
+	<-ch
+	return dup, err
+}
+
+func ingestLoop() {
+	for job := range ingestQueue {
+		jobs := []*ingestJob{job}
+		rows := job.rows()
+
+		timer := time.NewTimer(ingestMaxDelay)
+	collect:
+		for rows < ingestMaxRows {
+			select {
+			case next := <-ingestQueue:
+				jobs = append(jobs, next)
+				rows += next.rows()
+			case <-timer.C:
+				break collect
+			}
+		}
+		timer.Stop()
+
+		commitJobs(jobs)
+	}
+}
+
+// commitJobs 将一组帧写入同一个事务；失败时逐帧重试，把错误限定在出错的帧上
+func commitJobs(jobs []*ingestJob) {
+	var pending []*ingestJob
+	for _, job := range jobs {
+		if job.failed != nil && *job.failed {
+			job.done(false, errIngestAborted)
+			continue
+		}
+		pending = append(pending, job)
+	}
+	if len(pending) == 0 {
+		return
+	}
+
+	start := time.Now()
+	dups, err := writeJobs(pending)
+	if err == nil {
+		var traffic []TrafficRecord
+		var conns, dupCount int
+		for i, job := range pending {
+			if dups[i] {
+				dupCount++
+			} else {
+				traffic = append(traffic, job.traffic...)
+				conns += len(job.conns)
+			}
+			job.done(dups[i], nil)
+		}
+		log.Printf("[Ingest] 已入库 %d 帧 | 流量 %d 条 | 连接 %d 条 | 重复 %d 帧 | 耗时 %s",
+			len(pending), len(traffic), conns, dupCount, time.Since(start).Round(time.Millisecond))
+		hub.publishTraffic(traffic)
+		return
+	}
+
+	if len(pending) == 1 {
+		pending[0].fail(err)
+		return
+	}
+
+	log.Printf("[Ingest] 批量写入失败，逐帧重试: %v", err)
+	for _, job := range pending {
+		if job.failed != nil && *job.failed {
+			job.done(false, errIngestAborted)
+			continue
+		}
+		dups, err := writeJobs([]*ingestJob{job})
+		if err != nil {
+			job.fail(err)
+			continue
+		}
+		job.done(dups[0], nil)
+		if !dups[0] {
+			hub.publishTraffic(job.traffic)
+		}
+	}
+}
+
+func (j *ingestJob) fail(err error) {
+	if j.failed != nil {
+		*j.failed = true
+	}
+	j.done(false, err)
+}
+
+// writeJobs 交给存储层在一个事务内完成去重判断、批量插入与游标推进
+func writeJobs(jobs []*ingestJob) ([]bool, error) {
+	batches := make([]ReportBatch, len(jobs))
+	for i, job := range jobs {
+		batches[i] = ReportBatch{
+			DeviceID: job.deviceID,
+			Stream:   job.head.Stream,
+			Seq:      job.head.Seq,
+			Traffic:  job.traffic,
+			Conns:    job.conns,
+		}
+	}
+	return store.WriteReports(batches)
+}
+
+// errIngestAborted 同一连接的前序帧写入失败，本帧被拒绝等待重放
+var errIngestAborted = errors.New("前序帧写入失败，等待客户端重放")
@@ -0,0 +1,125 @@
+// 节点延迟：接收客户端经 /ws 上报的延迟测试结果，按设备 × 节点保存，供 /api/stats 与 /api/timeseries?metric=latency 查询
+
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"sort"
+	"time"
+)
+
+const latencyMaxSamples = 500 // 单帧最多接受的测试结果数
+
+// wsLatencyFrame 客户端一轮延迟测试的结果（type 为 "latency"），不经发件箱、无需确认
+type wsLatencyFrame struct {
+	DeviceID  string `json:"device_id"`
+	Timestamp int64  `json:"timestamp"`
+	Results   []struct {
+		Node  string `json:"node"`
+		Delay int    `json:"delay"` // 毫秒，0 表示超时或失败
+	} `json:"results"`
+}
+
+// handleLatency 保存一轮延迟测试结果，时间以客户端测试时间为准（缺省或偏差过大时取服务端时间）
+func (s *wsSession) handleLatency(msg []byte) {
+	var f wsLatencyFrame
+	if err := json.Unmarshal(msg, &f); err != nil {
+		log.Printf("[WS] latency 格式错误: %v", err)
+		return
+	}
+	s.bindDeviceID(f.DeviceID)
+	if s.deviceID == "" || len(f.Results) == 0 {
+		return
+	}
+	if len(f.Results) > latencyMaxSamples {
+		f.Results = f.Results[:latencyMaxSamples]
+	}
+
+	now := time.Now()
+	at := time.Unix(f.Timestamp, 0)
+	if f.Timestamp <= 0 || at.After(now.Add(time.Minute)) || at.Before(now.Add(-24*time.Hour)) {
+		at = now
+	}
+	samples := make([]NodeLatency, 0, len(f.Results))
+	failed := 0
+	for _, r := range f.Results {
+		if r.Node == "" {
+			continue
+		}
+		if r.Delay < 0 {
+			r.Delay = 0
+		}
+		if r.Delay == 0 {
+			failed++
+		}
+		samples = append(samples, NodeLatency{Timestamp: at, DeviceID: s.deviceID, NodeName: r.Node, Delay: r.Delay})
+	}
+	if err := store.SaveNodeLatency(samples); err != nil {
+		log.Printf("[Latency] 保存设备 %s 的延迟测试失败: %v", s.deviceID, err)
+		return
+	}
+	if failed > 0 && failed == len(samples) {
+		log.Printf("[Latency] ⚠️ 设备 %s 测试的 %d 个节点全部超时或失败", s.deviceID, failed)
+	}
+}
+
+// latencySeries 一个分组的延迟序列，与响应中的 buckets 一一对应；桶内没有成功的测试时 avg/min/max 为 null
+type latencySeries struct {
+	Key      string   `json:"key"`
+	Avg      []*int64 `json:"avg"`
+	Min      []*int64 `json:"min"`
+	Max      []*int64 `json:"max"`
+	Samples  []int64  `json:"samples"`
+	Failures []int64  `json:"failures"`
+
+	sum, ok []int64
+}
+
+// foldLatency 把细粒度槽折叠到桶并计算平均值，分组按键名排序
+func foldLatency(rows []latencyRow, starts []time.Time) []*latencySeries {
+	seriesMap := make(map[string]*latencySeries)
+	for _, r := range rows {
+		idx := searchBucket(starts, time.Unix(r.Slot, 0))
+		if idx < 0 {
+			continue
+		}
+		s, ok := seriesMap[r.GroupKey]
+		if !ok {
+			n := len(starts)
+			s = &latencySeries{
+				Key: r.GroupKey, Avg: make([]*int64, n), Min: make([]*int64, n), Max: make([]*int64, n),
+				Samples: make([]int64, n), Failures: make([]int64, n), sum: make([]int64, n), ok: make([]int64, n),
+			}
+			seriesMap[r.GroupKey] = s
+		}
+		s.sum[idx] += r.DelaySum
+		s.ok[idx] += r.OK
+		s.Samples[idx] += r.OK + r.Failures
+		s.Failures[idx] += r.Failures
+		if r.OK == 0 {
+			continue
+		}
+		if s.Min[idx] == nil || r.Min < *s.Min[idx] {
+			v := r.Min
+			s.Min[idx] = &v
+		}
+		if s.Max[idx] == nil || r.Max > *s.Max[idx] {
+			v := r.Max
+			s.Max[idx] = &v
+		}
+	}
+
+	series := make([]*latencySeries, 0, len(seriesMap))
+	for _, s := range seriesMap {
+		for i := range s.sum {
+			if s.ok[i] > 0 {
+				avg := s.sum[i] / s.ok[i]
+				s.Avg[i] = &avg
+			}
+		}
+		series = append(series, s)
+	}
+	sort.Slice(series, func(i, j int) bool { return series[i].Key < series[j].Key })
+	return series
+}
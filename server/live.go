@@ -0,0 +1,224 @@
+// 仪表盘实时推送：/ws/live 订阅端点，广播入库的流量记录、每秒吞吐量与设备上下线事件
+
+package main
+
+import (
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	liveSendBuffer   = 256              // 单个订阅者的待发送消息数上限，超出视为慢消费者并断开
+	livePingInterval = 30 * time.Second // 心跳间隔，防止反代因空闲断开
+	liveWriteTimeout = 10 * time.Second
+)
+
+// liveRate 一秒内某设备或节点的吞吐量（字节）
+type liveRate struct {
+	Key  string `json:"key"`
+	Up   int64  `json:"up"`
+	Down int64  `json:"down"`
+}
+
+// 推送消息。Type 取值：
+//   - "hello"：连接建立后的首条消息，携带当前在线设备
+//   - "traffic"：一次入库事务中新写入的流量记录
+//   - "throughput"：上一秒按设备、按节点汇总的吞吐量
+//   - "device"：设备上线 / 下线
+type liveMessage struct {
+	Type     string          `json:"type"`
+	Time     int64           `json:"time"`
+	Online   []string        `json:"online,omitempty"`
+	Records  []TrafficRecord `json:"records,omitempty"`
+	Devices  []liveRate      `json:"devices,omitempty"`
+	Nodes    []liveRate      `json:"nodes,omitempty"`
+	DeviceID string          `json:"device_id,omitempty"`
+	Event    string          `json:"event,omitempty"` // online / offline
+}
+
+type liveSubscriber struct {
+	conn      *websocket.Conn
+	principal *Principal
+	send      chan liveMessage
+}
+
+// liveHub 订阅者集合与当前秒的吞吐量累加器
+type liveHub struct {
+	mu          sync.Mutex
+	subscribers map[*liveSubscriber]struct{}
+	devices     map[string]*liveRate
+	nodes       map[string]*liveRate
+}
+
+var hub = &liveHub{
+	subscribers: make(map[*liveSubscriber]struct{}),
+	devices:     make(map[string]*liveRate),
+	nodes:       make(map[string]*liveRate),
+}
+
+func (h *liveHub) subscribe(s *liveSubscriber) {
+	h.mu.Lock()
+	h.subscribers[s] = struct{}{}
+	h.mu.Unlock()
+}
+
+func (h *liveHub) unsubscribe(s *liveSubscriber) {
+	h.mu.Lock()
+	if _, ok := h.subscribers[s]; ok {
+		delete(h.subscribers, s)
+		close(s.send)
+	}
+	h.mu.Unlock()
+}
+
+// broadcastLocked 向所有订阅者投递消息（调用方持有 h.mu）。
+// 不阻塞写入管线：订阅者缓冲区已满时断开该订阅者，前端重连后重新开始接收
+func (h *liveHub) broadcastLocked(msg liveMessage) {
+	for s := range h.subscribers {
+		select {
+		case s.send <- msg:
+		default:
+			log.Printf("[Live] 订阅者 %s 消费过慢，已断开", s.principal)
+			delete(h.subscribers, s)
+			close(s.send)
+		}
+	}
+}
+
+// publishTraffic 广播新入库的流量记录并计入当前秒的吞吐量（由写入管线在事务提交后调用）
+func (h *liveHub) publishTraffic(records []TrafficRecord) {
+	if len(records) == 0 {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.subscribers) == 0 {
+		return
+	}
+
+	for _, r := range records {
+		addRate(h.devices, r.DeviceID, r)
+		addRate(h.nodes, r.NodeName, r)
+	}
+	h.broadcastLocked(liveMessage{Type: "traffic", Time: time.Now().Unix(), Records: records})
+}
+
+func addRate(m map[string]*liveRate, key string, r TrafficRecord) {
+	rate, ok := m[key]
+	if !ok {
+		rate = &liveRate{Key: key}
+		m[key] = rate
+	}
+	rate.Up += r.UpDelta
+	rate.Down += r.DownDelta
+}
+
+// publishDeviceEvent 广播设备上线 / 下线
+func (h *liveHub) publishDeviceEvent(deviceID, event string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.broadcastLocked(liveMessage{Type: "device", Time: time.Now().Unix(), DeviceID: deviceID, Event: event})
+}
+
+// runThroughput 每秒推送一次上一秒的吞吐量，无订阅者时不推送
+func (h *liveHub) runThroughput() {
+	for now := range time.Tick(time.Second) {
+		h.mu.Lock()
+		if len(h.subscribers) > 0 {
+			h.broadcastLocked(liveMessage{
+				Type:    "throughput",
+				Time:    now.Unix(),
+				Devices: sortedRates(h.devices),
+				Nodes:   sortedRates(h.nodes),
+			})
+		}
+		h.devices = make(map[string]*liveRate)
+		h.nodes = make(map[string]*liveRate)
+		h.mu.Unlock()
+	}
+}
+
+func sortedRates(m map[string]*liveRate) []liveRate {
+	rates := make([]liveRate, 0, len(m))
+	for _, r := range m {
+		rates = append(rates, *r)
+	}
+	sort.Slice(rates, func(i, j int) bool { return rates[i].Up+rates[i].Down > rates[j].Up+rates[j].Down })
+	return rates
+}
+
+func (s *liveSubscriber) writeLoop() {
+	ticker := time.NewTicker(livePingInterval)
+	defer ticker.Stop()
+	defer s.conn.Close()
+
+	for {
+		select {
+		case msg, ok := <-s.send:
+			if !ok {
+				s.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseTryAgainLater, "slow consumer"), time.Now().Add(time.Second))
+				return
+			}
+			s.conn.SetWriteDeadline(time.Now().Add(liveWriteTimeout))
+			if err := s.conn.WriteJSON(msg); err != nil {
+				return
+			}
+		case <-ticker.C:
+			if err := s.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(liveWriteTimeout)); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// handleLiveWS GET /ws/live — 仪表盘订阅实时数据。
+// 浏览器无法为 WebSocket 设置请求头，除 Authorization 外也接受 ?token=（登录会话 Token）
+func handleLiveWS(c *gin.Context) {
+	var principal *Principal
+	if token := bearerToken(c); token != "" {
+		p, ok := authenticateGuarded(c, "bearer", token, true)
+		if !ok {
+			return
+		}
+		if !authorize(c, p, PermStatsRead) {
+			return
+		}
+		principal = p
+	} else {
+		p, ok := authenticateQueryToken(c, PermStatsRead, true)
+		if !ok {
+			return
+		}
+		principal = p
+	}
+
+	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		log.Printf("[Live] 升级失败: %v", err)
+		return
+	}
+
+	sub := &liveSubscriber{conn: conn, principal: principal, send: make(chan liveMessage, liveSendBuffer)}
+	sub.send <- liveMessage{Type: "hello", Time: time.Now().Unix(), Online: onlineDevices()}
+	hub.subscribe(sub)
+	log.Printf("[Live] 订阅者已连接: %s (%s)", c.ClientIP(), principal)
+
+	go sub.writeLoop()
+	defer func() {
+		hub.unsubscribe(sub)
+		log.Printf("[Live] 订阅者断开: %s", c.ClientIP())
+	}()
+
+	// 仪表盘不发送业务消息，读循环只用于处理控制帧与感知断开
+	conn.SetReadLimit(4096)
+	for {
+		if _, _, err := conn.ReadMessage(); err != nil {
+			return
+		}
+	}
+}
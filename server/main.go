@@ -1,6 +1,7 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"io"
 	"log"
@@ -16,9 +17,34 @@ import (
 const serverVersion = "v1.2.0"
 
 func main() {
+	migrateDryRun := flag.Bool("migrate-dry-run", false, "列出待执行的数据库迁移后退出，不修改数据库")
+	createAdminUser := flag.String("create-admin", "", "创建（或重置）管理员账号后退出，密码取自 FLOWCOLLECT_ADMIN_PASSWORD 或标准输入")
+	flag.Parse()
+
 	// 0. 确保运行时目录存在
 	ensureDirs()
 
+	if *migrateDryRun {
+		if err := loadConfig(); err != nil {
+			log.Fatalf("❌ 加载配置文件失败: %v", err)
+		}
+		if err := printPendingMigrations(openStore()); err != nil {
+			log.Fatalf("❌ 读取迁移状态失败: %v", err)
+		}
+		return
+	}
+
+	if *createAdminUser != "" {
+		if err := loadConfig(); err != nil {
+			log.Fatalf("❌ 加载配置文件失败: %v", err)
+		}
+		initDB()
+		if err := createAdmin(*createAdminUser); err != nil {
+			log.Fatalf("❌ 创建管理员失败: %v", err)
+		}
+		return
+	}
+
 	// 1. 初始化日志 (同时输出到控制台和文件)
 	setupLogging()
 
@@ -91,15 +117,28 @@ func main() {
 
 	// 3. 初始化数据库
 	initDB()
+	backfillRollups()
+	closeStaleDeviceSessions()
+	startIngestPipeline()
+	go sweepAuthFailures()
+	go hub.runThroughput()
+	go watchOfflineDevices()
+
+	if userCount, err := store.CountUsers(); err == nil && userCount == 0 {
+		log.Println("⚠️ 尚未创建任何仪表盘账号，请运行 ./server -create-admin <用户名> 创建管理员")
+	}
 
 	// 4. 启动定时任务
-	c := cron.New()
+	// 定时任务按报表时区调度（23:55 日报即报表时区的 23:55）
+	c := cron.New(cron.WithLocation(reportLocation()))
 	_, _ = c.AddFunc("55 23 * * *", func() {
 		processDailyReport()
 	})
-	// 添加定时清理过期数据的任务（例如每天凌晨 3:00 清理 30 天前的数据）
+	// 每天凌晨 3:00 按分层保留期清理过期数据
 	_, _ = c.AddFunc("0 3 * * *", func() {
-		cleanupOldData(30)
+		cleanupOldData()
+		cleanupRollups()
+		cleanupSessions()
 	})
 	// 健康检查（每 5 分钟检查一次，仅在配置了 HealthCheckURL 时生效）
 	_, err := c.AddFunc("*/5 * * * *", func() {
@@ -187,15 +226,45 @@ func main() {
 	{
 		api.POST("/auth", handleAuth)
 
-		// 增加 Token 鉴权中间件保护查询接口
+		// 增加 Token 鉴权中间件保护查询接口，各路由按角色权限放行
 		protected := api.Group("")
 		protected.Use(TokenAuthMiddleware())
 		{
-			protected.GET("/stats", handleGetStats)
-			protected.GET("/devices", handleGetDevices)
-			protected.GET("/fake/stats", handleFakeGetStats)
-			// 触发节点更新的接口，为了安全起见必须鉴权
-			protected.POST("/trigger-update", HandleTriggerUpdate)
+			protected.POST("/logout", handleLogout)
+			protected.GET("/me", handleMe)
+
+			// viewer 及以上
+			protected.GET("/stats", RequirePermission(PermStatsRead), handleGetStats)
+			protected.GET("/devices", RequirePermission(PermStatsRead), handleGetDevices)
+			protected.GET("/devices/:id/sessions", RequirePermission(PermStatsRead), handleGetDeviceSessions)
+			protected.GET("/connections", RequirePermission(PermStatsRead), handleGetConnections)
+			protected.GET("/timeseries", RequirePermission(PermStatsRead), handleGetTimeseries)
+			protected.GET("/profiles", RequirePermission(PermStatsRead), handleListProfiles)
+			protected.GET("/fake/stats", RequirePermission(PermStatsRead), handleFakeGetStats)
+
+			// operator 及以上：触发节点更新、远程命令
+			protected.POST("/trigger-update", RequirePermission(PermUpdateTrigger), HandleTriggerUpdate)
+			protected.POST("/devices/:id/commands", RequirePermission(PermDeviceCommand), handleSendCommand)
+			protected.GET("/devices/:id/commands", RequirePermission(PermDeviceCommand), handleListCommands)
+			protected.GET("/commands/:id", RequirePermission(PermDeviceCommand), handleGetCommand)
+			// 读取策略组同样经远程命令下发到设备（写命令记录），因此与切换节点一样需要 device:command
+			protected.GET("/devices/:id/proxies", RequirePermission(PermDeviceCommand), handleListProxies)
+			protected.PUT("/devices/:id/proxies/*group", RequirePermission(PermDeviceCommand), handleSelectProxy)
+
+			// admin：设备 Token 与订阅 Profile 管理
+			protected.POST("/tokens", RequirePermission(PermTokensManage), handleIssueToken)
+			protected.GET("/tokens", RequirePermission(PermTokensManage), handleListTokens)
+			protected.DELETE("/tokens/:id", RequirePermission(PermTokensManage), handleRevokeToken)
+			protected.PUT("/devices/:id/profile", RequirePermission(PermTokensManage), handleSetDeviceProfile)
+
+			// admin：仪表盘账号管理
+			protected.GET("/users", RequirePermission(PermUsersManage), handleListUsers)
+			protected.POST("/users", RequirePermission(PermUsersManage), handleCreateUser)
+			protected.PUT("/users/:id", RequirePermission(PermUsersManage), handleUpdateUser)
+			protected.DELETE("/users/:id", RequirePermission(PermUsersManage), handleDeleteUser)
+
+			// admin：鉴权审计
+			protected.GET("/auth-events", RequirePermission(PermAuditRead), handleGetAuthEvents)
 		}
 	}
 
@@ -205,11 +274,12 @@ func main() {
 	// 模板文件原始分发（自带 token 鉴权，供 proxy-providers / rule-providers 拉取）
 	r.GET("/templates/*filepath", handleTemplateFile)
 
-	// 流量上报接口增加 Token 鉴权中间件
-	r.POST("/report", TokenAuthMiddleware(), handleReport)
+	// 流量上报接口：需要 report:write 权限（设备 Token 或 ServerToken）
+	r.POST("/report", TokenAuthMiddleware(), RequirePermission(PermReportWrite), handleReport)
 
-	// WebSocket 实时上报端点（自带鉴权）
+	// WebSocket 实时上报端点（自带鉴权，设备 Token 或 ServerToken）
 	r.GET("/ws", handleWS)
+	r.GET("/ws/live", handleLiveWS)
 
 	confLock.RLock()
 	port := conf.ListenPort
@@ -240,31 +310,58 @@ func setupLogging() {
 	log.Println("✅ 日志系统初始化完成")
 }
 
-// TokenAuthMiddleware 验证 Authorization Header
+// TokenAuthMiddleware 验证 Authorization Header（会话 Token、设备 Token 或 ServerToken，失败计入防爆破计数），
+// 并把调用方保存到上下文中；具体权限由路由上的 RequirePermission 检查
 func TokenAuthMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		confLock.RLock()
-		expectedToken := conf.ServerToken
-		confLock.RUnlock()
-
-		authHeader := c.GetHeader("Authorization")
-		if authHeader == "" || authHeader != "Bearer "+expectedToken {
-			c.JSON(401, gin.H{"error": "Unauthorized"})
+		p, ok := authenticateGuarded(c, "bearer", bearerToken(c), false)
+		if !ok {
 			c.Abort()
 			return
 		}
+		c.Set(principalKey, p)
 		c.Next()
 	}
 }
 
-// cleanupOldData 清理指定天数之前的数据
-func cleanupOldData(days int) {
-	threshold := time.Now().AddDate(0, 0, -days)
-	result := db.Where("timestamp < ?", threshold).Delete(&TrafficRecord{})
-	if result.Error != nil {
-		log.Printf("清理过期数据失败: %v", result.Error)
+// cleanupOldData 清理超出原始保留期（raw_retention_days）的原始记录，汇总表不受影响。
+// 清理边界对齐到报表时区的零点，保证保留的每一天都是完整的
+func cleanupOldData() {
+	days, _, _ := retentionDays()
+	threshold := reportDayStart(time.Now().AddDate(0, 0, -days))
+	traffic, conns, err := store.PurgeRaw(threshold)
+	if err != nil {
+		log.Printf("清理过期数据失败: %v", err)
+	} else {
+		log.Printf("已清理 %d 天前的数据，共删除 %d 条流量记录、%d 条连接记录", days, traffic, conns)
+	}
+
+	n, err := store.PurgeAuthEvents(threshold)
+	if err != nil {
+		log.Printf("清理过期鉴权审计失败: %v", err)
+	} else {
+		log.Printf("已清理 %d 天前的鉴权审计，共删除 %d 条记录", days, n)
+	}
+
+	n, err = store.PurgeDeviceSessions(threshold)
+	if err != nil {
+		log.Printf("清理过期设备会话失败: %v", err)
+	} else {
+		log.Printf("已清理 %d 天前的设备会话，共删除 %d 条记录", days, n)
+	}
+
+	n, err = store.PurgeDeviceCommands(threshold)
+	if err != nil {
+		log.Printf("清理过期远程命令失败: %v", err)
+	} else {
+		log.Printf("已清理 %d 天前的远程命令，共删除 %d 条记录", days, n)
+	}
+
+	n, err = store.PurgeNodeLatency(threshold)
+	if err != nil {
+		log.Printf("清理过期节点延迟失败: %v", err)
 	} else {
-		log.Printf("已清理 %d 天前的数据，共删除 %d 条记录", days, result.RowsAffected)
+		log.Printf("已清理 %d 天前的节点延迟，共删除 %d 条记录", days, n)
 	}
 }
 
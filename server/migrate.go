@@ -0,0 +1,175 @@
+// 版本化数据库迁移：migrations/<方言>/NNNN_name.sql 编译进二进制，启动时按版本号顺序执行未应用的迁移
+
+package main
+
+import (
+	"embed"
+	"fmt"
+	"io/fs"
+	"log"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+//go:embed migrations
+var migrationsFS embed.FS
+
+// Migration 一个迁移文件
+type Migration struct {
+	Version int
+	Name    string
+	SQL     string
+}
+
+// SchemaVersion 已应用的迁移记录
+type SchemaVersion struct {
+	Version   int `gorm:"primaryKey;autoIncrement:false"`
+	Name      string
+	AppliedAt time.Time
+}
+
+func (SchemaVersion) TableName() string { return "schema_version" }
+
+// loadMigrations 读取指定方言的全部迁移，按版本号升序。文件名格式为 0001_描述.sql
+func loadMigrations(dialect string) ([]Migration, error) {
+	dir := path.Join("migrations", dialect)
+	entries, err := fs.ReadDir(migrationsFS, dir)
+	if err != nil {
+		return nil, fmt.Errorf("没有 %s 的迁移文件: %w", dialect, err)
+	}
+
+	var migrations []Migration
+	seen := make(map[int]string)
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), ".sql") {
+			continue
+		}
+		name := strings.TrimSuffix(e.Name(), ".sql")
+		prefix, _, _ := strings.Cut(name, "_")
+		version, err := strconv.Atoi(prefix)
+		if err != nil || version <= 0 {
+			return nil, fmt.Errorf("迁移文件名无效（应为 0001_name.sql）: %s", e.Name())
+		}
+		if other, ok := seen[version]; ok {
+			return nil, fmt.Errorf("迁移版本 %d 重复: %s / %s", version, other, e.Name())
+		}
+		seen[version] = e.Name()
+
+		data, err := migrationsFS.ReadFile(path.Join(dir, e.Name()))
+		if err != nil {
+			return nil, err
+		}
+		migrations = append(migrations, Migration{Version: version, Name: name, SQL: string(data)})
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	return migrations, nil
+}
+
+// splitStatements 按行尾分号拆分 SQL 语句，跳过 -- 注释行
+func splitStatements(sql string) []string {
+	var stmts []string
+	var cur strings.Builder
+	for _, line := range strings.Split(sql, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "--") {
+			continue
+		}
+		cur.WriteString(line)
+		cur.WriteString("\n")
+		if strings.HasSuffix(trimmed, ";") {
+			stmts = append(stmts, strings.TrimSpace(cur.String()))
+			cur.Reset()
+		}
+	}
+	if rest := strings.TrimSpace(cur.String()); rest != "" {
+		stmts = append(stmts, rest)
+	}
+	return stmts
+}
+
+// appliedVersions 返回已应用的迁移版本（schema_version 表不存在时为空）
+func appliedVersions(db *gorm.DB) (map[int]bool, error) {
+	applied := make(map[int]bool)
+	if !db.Migrator().HasTable(&SchemaVersion{}) {
+		return applied, nil
+	}
+	var rows []SchemaVersion
+	if err := db.Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	for _, r := range rows {
+		applied[r.Version] = true
+	}
+	return applied, nil
+}
+
+func (s *gormStore) PendingMigrations() ([]Migration, error) {
+	all, err := loadMigrations(s.dialect)
+	if err != nil {
+		return nil, err
+	}
+	applied, err := appliedVersions(s.db)
+	if err != nil {
+		return nil, err
+	}
+	var pending []Migration
+	for _, m := range all {
+		if !applied[m.Version] {
+			pending = append(pending, m)
+		}
+	}
+	return pending, nil
+}
+
+// runMigrations 依次执行未应用的迁移，每个迁移连同版本记录在同一事务中提交
+func (s *gormStore) runMigrations() error {
+	if err := s.db.AutoMigrate(&SchemaVersion{}); err != nil {
+		return fmt.Errorf("创建 schema_version 失败: %w", err)
+	}
+	pending, err := s.PendingMigrations()
+	if err != nil {
+		return err
+	}
+
+	for _, m := range pending {
+		start := time.Now()
+		err := s.db.Transaction(func(tx *gorm.DB) error {
+			for _, stmt := range splitStatements(m.SQL) {
+				if err := tx.Exec(stmt).Error; err != nil {
+					return fmt.Errorf("%w\n%s", err, stmt)
+				}
+			}
+			return tx.Create(&SchemaVersion{Version: m.Version, Name: m.Name, AppliedAt: time.Now()}).Error
+		})
+		if err != nil {
+			return fmt.Errorf("迁移 %s 失败: %w", m.Name, err)
+		}
+		log.Printf("[Migrate] 已应用 %s（%s）", m.Name, time.Since(start).Round(time.Millisecond))
+	}
+	return nil
+}
+
+// printPendingMigrations -migrate-dry-run：只列出待执行的迁移及其语句，不修改数据库
+func printPendingMigrations(s *gormStore) error {
+	pending, err := s.PendingMigrations()
+	if err != nil {
+		return err
+	}
+	if len(pending) == 0 {
+		fmt.Printf("数据库结构已是最新（%s）\n", s.dialect)
+		return nil
+	}
+	fmt.Printf("待执行的迁移（%s，共 %d 个）:\n", s.dialect, len(pending))
+	for _, m := range pending {
+		fmt.Printf("\n== %s ==\n", m.Name)
+		for _, stmt := range splitStatements(m.SQL) {
+			fmt.Println(stmt)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+func TestSplitStatements(t *testing.T) {
+	tests := []struct {
+		name string
+		sql  string
+		want []string
+	}{
+		{"空", "", nil},
+		{"只有注释", "-- 说明\n  -- 缩进的注释\n\n", nil},
+		{"单条", "CREATE TABLE a (id INTEGER);", []string{"CREATE TABLE a (id INTEGER);"}},
+		{
+			"多行语句与注释",
+			"-- 头部注释\nCREATE TABLE a (\n    id INTEGER, -- 行尾注释保留\n    name TEXT\n);\n\nCREATE INDEX i ON a (name);\n",
+			[]string{"CREATE TABLE a (\n    id INTEGER, -- 行尾注释保留\n    name TEXT\n);", "CREATE INDEX i ON a (name);"},
+		},
+		{"语句之间的注释被跳过", "ALTER TABLE a ADD COLUMN b TEXT;\n-- 下一条\nALTER TABLE a ADD COLUMN c TEXT;", []string{"ALTER TABLE a ADD COLUMN b TEXT;", "ALTER TABLE a ADD COLUMN c TEXT;"}},
+		{"行中的分号不拆分", "INSERT INTO a (name) VALUES ('x;y');", []string{"INSERT INTO a (name) VALUES ('x;y');"}},
+		{"末尾缺少分号", "CREATE TABLE a (id INTEGER);\nCREATE TABLE b (id INTEGER)", []string{"CREATE TABLE a (id INTEGER);", "CREATE TABLE b (id INTEGER)"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := splitStatements(tt.sql); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("splitStatements() = %q, 期望 %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// migratedModels 迁移完成后必须与之完全对应的模型（每个字段都有对应的列）
+var migratedModels = []any{
+	&TrafficRecord{}, &ConnectionRecord{}, &ReportCursor{}, &TrafficHourly{}, &TrafficDaily{},
+	&Device{}, &DeviceSession{}, &DeviceCommand{}, &NodeLatency{}, &DeviceToken{},
+	&User{}, &UserSession{}, &AuthEvent{}, &SubSnapshot{},
+}
+
+func TestRunMigrationsSQLite(t *testing.T) {
+	all, err := loadMigrations("sqlite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var baseline Migration
+	for _, m := range all {
+		if m.Version == 1 {
+			baseline = m
+		}
+	}
+	if baseline.SQL == "" {
+		t.Fatal("缺少 0001 基线迁移")
+	}
+
+	applyBaseline := func(t *testing.T, db *gorm.DB) {
+		for _, stmt := range splitStatements(baseline.SQL) {
+			if err := db.Exec(stmt).Error; err != nil {
+				t.Fatalf("执行基线失败: %v\n%s", err, stmt)
+			}
+		}
+		// 基线结构下已有的数据在迁移后必须保留
+		if err := db.Exec("INSERT INTO traffic_records (timestamp, device_id, node_name, up_delta, down_delta, is_proxy, active_conns) VALUES (?, 'legacy', 'HK', 1, 2, 1, 3)", time.Now()).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name       string
+		setup      func(t *testing.T, db *gorm.DB)
+		wantLegacy int64 // 迁移后 legacy 设备的流量记录数
+	}{
+		{"空数据库", func(*testing.T, *gorm.DB) {}, 0},
+		{"引入迁移之前由 AutoMigrate 建立的数据库（无 schema_version）", applyBaseline, 1},
+		{"已记录基线版本的数据库", func(t *testing.T, db *gorm.DB) {
+			applyBaseline(t, db)
+			if err := db.AutoMigrate(&SchemaVersion{}); err != nil {
+				t.Fatal(err)
+			}
+			if err := db.Create(&SchemaVersion{Version: 1, Name: baseline.Name, AppliedAt: time.Now()}).Error; err != nil {
+				t.Fatal(err)
+			}
+		}, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := openGormStore("sqlite", filepath.Join(t.TempDir(), "traffic.db"), false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+			tt.setup(t, s.db)
+
+			if err := s.Migrate(); err != nil {
+				t.Fatalf("迁移失败: %v", err)
+			}
+
+			var versions []int
+			if err := s.db.Model(&SchemaVersion{}).Order("version").Pluck("version", &versions).Error; err != nil {
+				t.Fatal(err)
+			}
+			if len(versions) != len(all) || versions[len(versions)-1] != all[len(all)-1].Version {
+				t.Errorf("schema_version = %v, 期望 1..%d", versions, all[len(all)-1].Version)
+			}
+			if pending, err := s.PendingMigrations(); err != nil || len(pending) != 0 {
+				t.Errorf("迁移后仍有待执行的迁移: %v (%v)", pending, err)
+			}
+
+			// 再次执行为空操作
+			if err := s.Migrate(); err != nil {
+				t.Fatalf("重复迁移失败: %v", err)
+			}
+
+			for _, model := range migratedModels {
+				stmt := &gorm.Statement{DB: s.db}
+				if err := stmt.Parse(model); err != nil {
+					t.Fatal(err)
+				}
+				if !s.db.Migrator().HasTable(model) {
+					t.Errorf("缺少表 %s", stmt.Schema.Table)
+					continue
+				}
+				for _, f := range stmt.Schema.Fields {
+					if f.DBName != "" && !s.db.Migrator().HasColumn(model, f.DBName) {
+						t.Errorf("表 %s 缺少列 %s", stmt.Schema.Table, f.DBName)
+					}
+				}
+			}
+
+			var legacy int64
+			s.db.Model(&TrafficRecord{}).Where("device_id = ?", "legacy").Count(&legacy)
+			if legacy != tt.wantLegacy {
+				t.Errorf("legacy 流量记录 = %d, 期望 %d", legacy, tt.wantLegacy)
+			}
+		})
+	}
+}
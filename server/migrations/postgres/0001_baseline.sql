@@ -0,0 +1,135 @@
+-- 基线结构：与此前 AutoMigrate 生成的表一致，已有数据库上执行为空操作
+
+CREATE TABLE IF NOT EXISTS traffic_records (
+    id           BIGSERIAL PRIMARY KEY,
+    timestamp    TIMESTAMPTZ,
+    device_id    TEXT,
+    node_name    TEXT,
+    up_delta     BIGINT,
+    down_delta   BIGINT,
+    is_proxy     BOOLEAN,
+    active_conns BIGINT
+);
+CREATE INDEX IF NOT EXISTS idx_traffic_records_timestamp ON traffic_records (timestamp);
+
+CREATE TABLE IF NOT EXISTS connection_records (
+    id           BIGSERIAL PRIMARY KEY,
+    device_id    TEXT,
+    conn_id      TEXT,
+    start_time   TIMESTAMPTZ,
+    end_time     TIMESTAMPTZ,
+    duration     BIGINT,
+    network      TEXT,
+    conn_type    TEXT,
+    source_ip    TEXT,
+    source_port  TEXT,
+    dest_ip      TEXT,
+    dest_port    TEXT,
+    host         TEXT,
+    rule         TEXT,
+    rule_payload TEXT,
+    process      TEXT,
+    process_path TEXT,
+    chains       TEXT,
+    node_name    TEXT,
+    upload       BIGINT,
+    download     BIGINT,
+    is_proxy     BOOLEAN
+);
+CREATE INDEX IF NOT EXISTS idx_connection_records_device_id ON connection_records (device_id);
+CREATE INDEX IF NOT EXISTS idx_connection_records_start_time ON connection_records (start_time);
+CREATE INDEX IF NOT EXISTS idx_connection_records_host ON connection_records (host);
+
+CREATE TABLE IF NOT EXISTS report_cursors (
+    device_id  TEXT,
+    stream     TEXT,
+    last_seq   BIGINT,
+    updated_at TIMESTAMPTZ,
+    PRIMARY KEY (device_id, stream)
+);
+
+CREATE TABLE IF NOT EXISTS traffic_hourly (
+    hour       BIGINT,
+    device_id  TEXT,
+    node_name  TEXT,
+    is_proxy   BOOLEAN,
+    up_delta   BIGINT,
+    down_delta BIGINT,
+    PRIMARY KEY (hour, device_id, node_name, is_proxy)
+);
+
+CREATE TABLE IF NOT EXISTS traffic_daily (
+    day        BIGINT,
+    device_id  TEXT,
+    node_name  TEXT,
+    is_proxy   BOOLEAN,
+    up_delta   BIGINT,
+    down_delta BIGINT,
+    PRIMARY KEY (day, device_id, node_name, is_proxy)
+);
+
+CREATE TABLE IF NOT EXISTS devices (
+    id         TEXT,
+    note       TEXT,
+    created_at TIMESTAMPTZ,
+    PRIMARY KEY (id)
+);
+
+CREATE TABLE IF NOT EXISTS device_tokens (
+    id           BIGSERIAL PRIMARY KEY,
+    device_id    TEXT,
+    label        TEXT,
+    prefix       TEXT,
+    token_hash   TEXT,
+    created_at   TIMESTAMPTZ,
+    last_used_at TIMESTAMPTZ,
+    revoked_at   TIMESTAMPTZ
+);
+CREATE INDEX IF NOT EXISTS idx_device_tokens_device_id ON device_tokens (device_id);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_device_tokens_token_hash ON device_tokens (token_hash);
+
+CREATE TABLE IF NOT EXISTS users (
+    id            BIGSERIAL PRIMARY KEY,
+    username      TEXT,
+    password_hash TEXT,
+    role          TEXT,
+    created_at    TIMESTAMPTZ,
+    last_login_at TIMESTAMPTZ
+);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_users_username ON users (username);
+
+CREATE TABLE IF NOT EXISTS user_sessions (
+    id         TEXT,
+    user_id    BIGINT,
+    client_ip  TEXT,
+    created_at TIMESTAMPTZ,
+    expires_at TIMESTAMPTZ,
+    revoked_at TIMESTAMPTZ,
+    PRIMARY KEY (id)
+);
+CREATE INDEX IF NOT EXISTS idx_user_sessions_user_id ON user_sessions (user_id);
+CREATE INDEX IF NOT EXISTS idx_user_sessions_expires_at ON user_sessions (expires_at);
+
+CREATE TABLE IF NOT EXISTS auth_events (
+    id         BIGSERIAL PRIMARY KEY,
+    time       TIMESTAMPTZ,
+    client_ip  TEXT,
+    kind       TEXT,
+    subject    TEXT,
+    success    BOOLEAN,
+    reason     TEXT,
+    path       TEXT,
+    user_agent TEXT
+);
+CREATE INDEX IF NOT EXISTS idx_auth_events_time ON auth_events (time);
+CREATE INDEX IF NOT EXISTS idx_auth_events_client_ip ON auth_events (client_ip);
+
+CREATE TABLE IF NOT EXISTS sub_snapshots (
+    id      BIGSERIAL PRIMARY KEY,
+    date    TIMESTAMPTZ,
+    sub_url TEXT,
+    used    BIGINT,
+    total   BIGINT,
+    expire  BIGINT
+);
+CREATE INDEX IF NOT EXISTS idx_sub_snapshots_date ON sub_snapshots (date);
@@ -0,0 +1,18 @@
+-- 设备在线状态：每次上报连接记录一条会话；devices 表保存最近一次的活跃时间、客户端版本与来源 IP
+
+CREATE TABLE IF NOT EXISTS device_sessions (
+    id             BIGSERIAL PRIMARY KEY,
+    device_id      TEXT,
+    token_id       BIGINT,
+    remote_ip      TEXT,
+    client_version TEXT,
+    started_at     TIMESTAMPTZ,
+    ended_at       TIMESTAMPTZ,
+    last_seen_at   TIMESTAMPTZ
+);
+CREATE INDEX IF NOT EXISTS idx_device_sessions_device_started ON device_sessions (device_id, started_at);
+CREATE INDEX IF NOT EXISTS idx_device_sessions_started_at ON device_sessions (started_at);
+
+ALTER TABLE devices ADD COLUMN IF NOT EXISTS last_seen_at TIMESTAMPTZ;
+ALTER TABLE devices ADD COLUMN IF NOT EXISTS client_version TEXT;
+ALTER TABLE devices ADD COLUMN IF NOT EXISTS last_ip TEXT;
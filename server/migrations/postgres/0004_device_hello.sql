@@ -0,0 +1,15 @@
+-- 客户端握手（hello）与心跳：devices 保存最近一次的握手信息与健康状态，device_sessions 保存每次连接的握手信息
+
+ALTER TABLE devices ADD COLUMN IF NOT EXISTS os TEXT;
+ALTER TABLE devices ADD COLUMN IF NOT EXISTS arch TEXT;
+ALTER TABLE devices ADD COLUMN IF NOT EXISTS mihomo_version TEXT;
+ALTER TABLE devices ADD COLUMN IF NOT EXISTS config_hash TEXT;
+ALTER TABLE devices ADD COLUMN IF NOT EXISTS heartbeat_at TIMESTAMPTZ;
+ALTER TABLE devices ADD COLUMN IF NOT EXISTS mihomo_reachable BOOLEAN;
+ALTER TABLE devices ADD COLUMN IF NOT EXISTS queue_depth BIGINT;
+ALTER TABLE devices ADD COLUMN IF NOT EXISTS dropped BIGINT;
+
+ALTER TABLE device_sessions ADD COLUMN IF NOT EXISTS os TEXT;
+ALTER TABLE device_sessions ADD COLUMN IF NOT EXISTS arch TEXT;
+ALTER TABLE device_sessions ADD COLUMN IF NOT EXISTS mihomo_version TEXT;
+ALTER TABLE device_sessions ADD COLUMN IF NOT EXISTS config_hash TEXT;
@@ -0,0 +1,17 @@
+-- 远程命令：经设备的 /ws 连接下发的命令及客户端回执
+
+CREATE TABLE IF NOT EXISTS device_commands (
+    id          TEXT,
+    device_id   TEXT,
+    action      TEXT,
+    args        TEXT,
+    issued_by   TEXT,
+    status      TEXT,
+    result      TEXT,
+    error       TEXT,
+    created_at  TIMESTAMPTZ,
+    finished_at TIMESTAMPTZ,
+    PRIMARY KEY (id)
+);
+CREATE INDEX IF NOT EXISTS idx_device_commands_device_created ON device_commands (device_id, created_at);
+CREATE INDEX IF NOT EXISTS idx_device_commands_created_at ON device_commands (created_at);
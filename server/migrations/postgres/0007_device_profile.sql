@@ -0,0 +1,3 @@
+-- 订阅 Profile：设备拉取 /sub 时默认使用的 templates/profiles/<profile>.yaml（空表示使用默认 Profile）
+
+ALTER TABLE devices ADD COLUMN IF NOT EXISTS profile TEXT;
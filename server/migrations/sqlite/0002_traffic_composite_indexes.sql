@@ -0,0 +1,5 @@
+-- 统计查询按设备 / 节点过滤后再按时间范围扫描，复合索引避免回表全扫
+
+CREATE INDEX IF NOT EXISTS idx_traffic_records_device_ts ON traffic_records (device_id, timestamp);
+CREATE INDEX IF NOT EXISTS idx_traffic_records_node_ts ON traffic_records (node_name, timestamp);
+CREATE INDEX IF NOT EXISTS idx_connection_records_device_end ON connection_records (device_id, end_time);
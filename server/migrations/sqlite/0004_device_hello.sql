@@ -0,0 +1,15 @@
+-- 客户端握手（hello）与心跳：devices 保存最近一次的握手信息与健康状态，device_sessions 保存每次连接的握手信息
+
+ALTER TABLE devices ADD COLUMN os TEXT;
+ALTER TABLE devices ADD COLUMN arch TEXT;
+ALTER TABLE devices ADD COLUMN mihomo_version TEXT;
+ALTER TABLE devices ADD COLUMN config_hash TEXT;
+ALTER TABLE devices ADD COLUMN heartbeat_at DATETIME;
+ALTER TABLE devices ADD COLUMN mihomo_reachable NUMERIC;
+ALTER TABLE devices ADD COLUMN queue_depth INTEGER;
+ALTER TABLE devices ADD COLUMN dropped INTEGER;
+
+ALTER TABLE device_sessions ADD COLUMN os TEXT;
+ALTER TABLE device_sessions ADD COLUMN arch TEXT;
+ALTER TABLE device_sessions ADD COLUMN mihomo_version TEXT;
+ALTER TABLE device_sessions ADD COLUMN config_hash TEXT;
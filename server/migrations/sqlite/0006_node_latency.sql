@@ -0,0 +1,11 @@
+-- 节点延迟：客户端定期测试策略组内节点的延迟，按设备 × 节点保存时间序列（delay 为 0 表示超时或失败）
+
+CREATE TABLE IF NOT EXISTS node_latencies (
+    id        INTEGER PRIMARY KEY AUTOINCREMENT,
+    timestamp DATETIME,
+    device_id TEXT,
+    node_name TEXT,
+    delay     INTEGER
+);
+CREATE INDEX IF NOT EXISTS idx_node_latencies_timestamp ON node_latencies (timestamp);
+CREATE INDEX IF NOT EXISTS idx_node_latencies_device_node_ts ON node_latencies (device_id, node_name, timestamp);
@@ -0,0 +1,403 @@
+// 设备在线状态：内存中按设备跟踪 /ws 上报连接，会话起止、最近活跃时间、客户端版本与来源 IP 写入数据库，
+// 并据此计算在线时长、发送离线告警
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	presenceTouchInterval = time.Minute        // 最近活跃时间的落库间隔，避免每帧都写库
+	presenceCheckInterval = time.Minute        // 离线告警的检查周期
+	clientVersionHeader   = "X-Client-Version" // 客户端在 /ws 握手时携带的版本号
+	heartbeatMissLimit    = 3                  // 连续错过多少个心跳周期后视为连接失效
+)
+
+// devicePresence 在线设备的内存状态（受 wsSessionsMu 保护）
+type devicePresence struct {
+	Sessions  int       // 在线连接数
+	Since     time.Time // 本次上线时间，即最早一个在线连接的建立时间
+	LastSeen  time.Time
+	RemoteIP  string
+	Hello     DeviceHello
+	Heartbeat DeviceHeartbeat
+}
+
+var devicePresences = make(map[string]*devicePresence)
+
+// bindDeviceID 确定连接所属设备（只绑定一次）并记录会话开始，该设备的第一个连接视为上线。
+// ServerToken 连接自报的设备未登记时断开连接，deviceID 保持为空
+func (s *wsSession) bindDeviceID(deviceID string) {
+	if deviceID == "" || s.deviceID != "" {
+		return
+	}
+	if err := checkLegacyReport(s.principal, deviceID); err != nil {
+		log.Printf("[WS] 拒绝连接 %s: %v", s.remoteIP, err)
+		s.conn.Close()
+		return
+	}
+	now := time.Now()
+
+	wsSessionsMu.Lock()
+	s.deviceID = deviceID
+	p, ok := devicePresences[deviceID]
+	if !ok {
+		p = &devicePresence{Since: s.startedAt}
+		devicePresences[deviceID] = p
+	}
+	p.Sessions++
+	p.LastSeen = now
+	p.RemoteIP = s.remoteIP
+	p.Hello = DeviceHello{ClientVersion: s.clientVersion}
+	online := p.Sessions == 1
+	wsSessionsMu.Unlock()
+
+	rec := &DeviceSession{
+		DeviceID:    deviceID,
+		TokenID:     s.principal.TokenID,
+		RemoteIP:    s.remoteIP,
+		StartedAt:   s.startedAt,
+		LastSeenAt:  now,
+		DeviceHello: DeviceHello{ClientVersion: s.clientVersion},
+	}
+	if err := store.StartDeviceSession(rec); err != nil {
+		log.Printf("[Presence] 记录设备 %s 的会话失败: %v", deviceID, err)
+	} else {
+		s.recordID = rec.ID
+		s.touchedAt = now
+	}
+
+	if online {
+		log.Printf("[WS] 设备上线: %s (%s, 版本 %s)", deviceID, s.remoteIP, displayVersion(s.clientVersion))
+		hub.publishDeviceEvent(deviceID, "online")
+	}
+}
+
+// touch 更新设备的最近活跃时间（每收到一帧调用一次），按 presenceTouchInterval 落库
+func (s *wsSession) touch(now time.Time) {
+	if s.deviceID == "" {
+		return
+	}
+	wsSessionsMu.Lock()
+	if p := devicePresences[s.deviceID]; p != nil {
+		p.LastSeen = now
+	}
+	wsSessionsMu.Unlock()
+
+	if s.recordID == 0 || now.Sub(s.touchedAt) < presenceTouchInterval {
+		return
+	}
+	s.touchedAt = now
+	if err := store.TouchDeviceSession(s.recordID, s.deviceID, now); err != nil {
+		log.Printf("[Presence] 更新设备 %s 的活跃时间失败: %v", s.deviceID, err)
+	}
+}
+
+// handleHello 处理握手帧：保存客户端环境信息，并按声明的心跳间隔启用读超时。
+// ServerToken 连接以帧内 device_id 绑定设备，设备 Token 连接以 Token 为准
+func (s *wsSession) handleHello(msg []byte) {
+	var f wsHelloFrame
+	if err := json.Unmarshal(msg, &f); err != nil {
+		log.Printf("[WS] hello 格式错误: %v", err)
+		return
+	}
+	s.bindDeviceID(f.DeviceID)
+	if s.deviceID == "" {
+		return
+	}
+
+	hello := f.hello()
+	if hello.ClientVersion == "" {
+		hello.ClientVersion = s.clientVersion
+	}
+	if f.HeartbeatInterval > 0 {
+		s.readTimeout = heartbeatMissLimit * time.Duration(f.HeartbeatInterval) * time.Second
+	}
+
+	wsSessionsMu.Lock()
+	if p := devicePresences[s.deviceID]; p != nil {
+		p.Hello = hello
+	}
+	for _, c := range f.Capabilities {
+		if c == commandCapability {
+			s.commands = true
+		}
+	}
+	wsSessionsMu.Unlock()
+
+	if err := store.SaveDeviceHello(s.recordID, s.deviceID, hello); err != nil {
+		log.Printf("[Presence] 保存设备 %s 的握手信息失败: %v", s.deviceID, err)
+	}
+	log.Printf("[WS] 设备握手: %s | 版本 %s | %s/%s | Mihomo %s | 配置 %s",
+		s.deviceID, displayVersion(hello.ClientVersion), hello.OS, hello.Arch, displayVersion(hello.MihomoVersion), hello.ConfigHash)
+}
+
+// handleHeartbeat 处理心跳帧：保存健康状态，Mihomo 可达性变化或发件箱出现丢弃时记录日志
+func (s *wsSession) handleHeartbeat(msg []byte) {
+	var f wsHeartbeatFrame
+	if err := json.Unmarshal(msg, &f); err != nil {
+		log.Printf("[WS] heartbeat 格式错误: %v", err)
+		return
+	}
+	s.bindDeviceID(f.DeviceID)
+	if s.deviceID == "" {
+		return
+	}
+
+	now := time.Now()
+	hb := DeviceHeartbeat{HeartbeatAt: &now, MihomoReachable: f.MihomoReachable, QueueDepth: f.QueueDepth, Dropped: f.Dropped}
+
+	var prev DeviceHeartbeat
+	wsSessionsMu.Lock()
+	if p := devicePresences[s.deviceID]; p != nil {
+		prev = p.Heartbeat
+		p.Heartbeat = hb
+	}
+	wsSessionsMu.Unlock()
+
+	if prev.HeartbeatAt == nil || prev.MihomoReachable != hb.MihomoReachable {
+		if !hb.MihomoReachable {
+			log.Printf("[Presence] ⚠️ 设备 %s 报告 Mihomo 不可达", s.deviceID)
+		} else if prev.HeartbeatAt != nil {
+			log.Printf("[Presence] 设备 %s 的 Mihomo 已恢复", s.deviceID)
+		}
+	}
+	if prev.HeartbeatAt != nil && hb.Dropped > prev.Dropped {
+		log.Printf("[Presence] ⚠️ 设备 %s 的发件箱已满，新丢弃 %d 帧（待发送 %d）", s.deviceID, hb.Dropped-prev.Dropped, hb.QueueDepth)
+	}
+
+	if err := store.SaveDeviceHeartbeat(s.deviceID, hb); err != nil {
+		log.Printf("[Presence] 保存设备 %s 的心跳失败: %v", s.deviceID, err)
+	}
+}
+
+// unbindDevice 记录会话结束，设备的最后一个连接断开时视为下线
+func (s *wsSession) unbindDevice() {
+	if s.deviceID == "" {
+		return
+	}
+	now := time.Now()
+
+	wsSessionsMu.Lock()
+	offline := false
+	if p := devicePresences[s.deviceID]; p != nil {
+		p.Sessions--
+		if p.Sessions <= 0 {
+			delete(devicePresences, s.deviceID)
+			offline = true
+		}
+	}
+	wsSessionsMu.Unlock()
+
+	if s.recordID != 0 {
+		if err := store.EndDeviceSession(s.recordID, s.deviceID, now); err != nil {
+			log.Printf("[Presence] 记录设备 %s 的会话结束失败: %v", s.deviceID, err)
+		}
+	}
+	if offline {
+		log.Printf("[WS] 设备下线: %s (在线 %s)", s.deviceID, now.Sub(s.startedAt).Round(time.Second))
+		hub.publishDeviceEvent(s.deviceID, "offline")
+	}
+}
+
+// onlineDevices 返回当前有上报连接的设备
+func onlineDevices() []string {
+	wsSessionsMu.Lock()
+	defer wsSessionsMu.Unlock()
+	ids := make([]string, 0, len(devicePresences))
+	for id := range devicePresences {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// presenceSnapshot 返回在线设备状态的副本
+func presenceSnapshot() map[string]devicePresence {
+	wsSessionsMu.Lock()
+	defer wsSessionsMu.Unlock()
+	snap := make(map[string]devicePresence, len(devicePresences))
+	for id, p := range devicePresences {
+		snap[id] = *p
+	}
+	return snap
+}
+
+func displayVersion(v string) string {
+	if v == "" {
+		return "未知"
+	}
+	return v
+}
+
+// closeStaleDeviceSessions 启动时结束上次进程遗留的会话：进程退出时来不及写入结束时间
+func closeStaleDeviceSessions() {
+	n, err := store.CloseStaleDeviceSessions()
+	if err != nil {
+		log.Printf("[Presence] 结束遗留会话失败: %v", err)
+	} else if n > 0 {
+		log.Printf("[Presence] 已结束 %d 个上次运行遗留的设备会话", n)
+	}
+}
+
+// watchOfflineDevices 定期检查设备离线时长：超过 offline_alert_minutes 时告警一次，告警后恢复上线再通知一次。
+// 启动前就已超过阈值的设备不补发告警
+func watchOfflineDevices() {
+	startedAt := time.Now()
+	alerted := make(map[string]bool) // 已处理的离线设备 → 是否实际发出了告警
+
+	for now := range time.Tick(presenceCheckInterval) {
+		confLock.RLock()
+		threshold := time.Duration(conf.OfflineAlertMinutes) * time.Minute
+		confLock.RUnlock()
+		if threshold <= 0 {
+			continue
+		}
+
+		devices, err := store.ListDevices()
+		if err != nil {
+			log.Printf("[Presence] 读取设备列表失败: %v", err)
+			continue
+		}
+		online := presenceSnapshot()
+
+		for _, d := range devices {
+			if p, ok := online[d.ID]; ok {
+				if sent, handled := alerted[d.ID]; handled {
+					delete(alerted, d.ID)
+					if sent {
+						log.Printf("[Presence] 设备 %s 已恢复在线", d.ID)
+						go sendEmail(fmt.Sprintf("设备恢复在线 - %s", d.ID),
+							fmt.Sprintf("设备 %s 已于 %s 恢复在线（%s，版本 %s）。",
+								d.ID, p.Since.In(reportLocation()).Format("2006-01-02 15:04:05"), p.RemoteIP, displayVersion(p.Hello.ClientVersion)))
+					}
+				}
+				continue
+			}
+			if d.LastSeenAt == nil {
+				continue
+			}
+			if _, handled := alerted[d.ID]; handled {
+				continue
+			}
+			offlineFor := now.Sub(*d.LastSeenAt)
+			if offlineFor < threshold {
+				continue
+			}
+			if d.LastSeenAt.Add(threshold).Before(startedAt) {
+				alerted[d.ID] = false
+				continue
+			}
+
+			alerted[d.ID] = true
+			minutes := int(offlineFor.Minutes())
+			log.Printf("[Presence] ⚠️ 设备 %s 已离线 %d 分钟", d.ID, minutes)
+			go sendEmail(fmt.Sprintf("设备离线告警 - %s", d.ID),
+				fmt.Sprintf("设备 %s 已离线 %d 分钟。\n最后活跃: %s\n最后来源 IP: %s\n客户端版本: %s",
+					d.ID, minutes, d.LastSeenAt.In(reportLocation()).Format("2006-01-02 15:04:05"), d.LastIP, displayVersion(d.ClientVersion)))
+		}
+	}
+}
+
+// handleGetDevices GET /api/devices — 所有已知设备及其在线状态。
+// 设备来自登记表与流量记录的并集；在线状态取自内存，离线设备的最近活跃时间取自数据库
+func handleGetDevices(c *gin.Context) {
+	devices, err := store.ListDevices()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	trafficIDs, err := store.DeviceIDs()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	known := make(map[string]bool, len(devices))
+	for _, d := range devices {
+		known[d.ID] = true
+	}
+	for _, id := range trafficIDs {
+		if !known[id] {
+			devices = append(devices, Device{ID: id})
+		}
+	}
+	sort.Slice(devices, func(i, j int) bool { return devices[i].ID < devices[j].ID })
+
+	online := presenceSnapshot()
+	now := time.Now()
+	list := make([]gin.H, 0, len(devices))
+	for _, d := range devices {
+		hello, hb := d.DeviceHello, d.DeviceHeartbeat
+		item := gin.H{
+			"device_id": d.ID,
+			"note":      d.Note,
+			"online":    false,
+			"uptime":    0,
+			"last_seen": d.LastSeenAt,
+			"remote_ip": d.LastIP,
+			"profile":   d.Profile,
+		}
+		if p, ok := online[d.ID]; ok {
+			hello, hb = p.Hello, p.Heartbeat
+			item["online"] = true
+			item["since"] = p.Since
+			item["uptime"] = int64(now.Sub(p.Since).Seconds())
+			item["last_seen"] = p.LastSeen
+			item["sessions"] = p.Sessions
+			item["remote_ip"] = p.RemoteIP
+		} else if d.LastSeenAt != nil {
+			item["offline_seconds"] = int64(now.Sub(*d.LastSeenAt).Seconds())
+		}
+		for k, v := range healthJSON(hello, hb) {
+			item[k] = v
+		}
+		list = append(list, item)
+	}
+	c.JSON(http.StatusOK, gin.H{"devices": list})
+}
+
+// healthJSON 设备握手信息与最近一次心跳的展示字段（尚未收到心跳时不含心跳字段）
+func healthJSON(hello DeviceHello, hb DeviceHeartbeat) gin.H {
+	h := gin.H{
+		"client_version": hello.ClientVersion,
+		"os":             hello.OS,
+		"arch":           hello.Arch,
+		"mihomo_version": hello.MihomoVersion,
+		"config_hash":    hello.ConfigHash,
+	}
+	if hb.HeartbeatAt != nil {
+		h["heartbeat_at"] = hb.HeartbeatAt
+		h["mihomo_reachable"] = hb.MihomoReachable
+		h["queue_depth"] = hb.QueueDepth
+		h["dropped"] = hb.Dropped
+	}
+	return h
+}
+
+// handleGetDeviceSessions GET /api/devices/:id/sessions — 设备最近的上报会话（?limit=，默认 50，最大 500）
+func handleGetDeviceSessions(c *gin.Context) {
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "50"))
+	if err != nil || limit <= 0 {
+		limit = 50
+	}
+	if limit > 500 {
+		limit = 500
+	}
+
+	sessions, err := store.ListDeviceSessions(c.Param("id"), limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"sessions": sessions})
+}
@@ -0,0 +1,233 @@
+// 订阅 Profile：templates/profiles/<name>.yaml 是一份局部 Mihomo 配置，覆盖 /sub 的基础设置（端口、DNS、tun 等），
+// 并可用 x-profile 段限定下发的策略组与规则目标。Profile 可通过 ?profile= 指定，或按设备保存
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	ProfilesDir    = TemplatesDir + "/profiles"
+	defaultProfile = "default"   // 未指定 Profile 时使用的文件（不存在则只用基础设置）
+	profileMetaKey = "x-profile" // Profile 自身的说明与筛选条件，不会下发
+)
+
+// profileNameRe Profile 名只允许字母、数字、- 与 _（同时用作文件名）
+var profileNameRe = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// profileGeneratedKeys 由模板与规则集生成的顶层键，Profile 中出现时忽略
+var profileGeneratedKeys = []string{"proxies", "proxy-providers", "proxy-groups", "rule-providers", "rules"}
+
+// subProfile 一个订阅 Profile
+type subProfile struct {
+	Name        string   `json:"name" yaml:"-"`
+	Description string   `json:"description" yaml:"description"`
+	Groups      []string `json:"groups" yaml:"groups"`   // 只保留这些策略组，空表示全部
+	Targets     []string `json:"targets" yaml:"targets"` // 只展开这些规则目标（CSV 中的 TargetGroup），空表示全部
+	Rules       string   `json:"rules" yaml:"rules"`     // 规则下发方式：inline（默认）或 provider
+
+	overrides *subConfig
+}
+
+// loadProfile 读取并解析 Profile，文件不存在时返回 ErrNotFound
+func loadProfile(name string) (*subProfile, error) {
+	if !profileNameRe.MatchString(name) {
+		return nil, fmt.Errorf("无效的 Profile 名: %q", name)
+	}
+	data, err := os.ReadFile(filepath.Join(ProfilesDir, name+".yaml"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	cfg, err := parseSubConfig(data)
+	if err != nil {
+		return nil, fmt.Errorf("解析 Profile %s 失败: %w", name, err)
+	}
+
+	p := &subProfile{Name: name, overrides: cfg}
+	if meta := cfg.get(profileMetaKey); meta != nil {
+		if err := meta.Decode(p); err != nil {
+			return nil, fmt.Errorf("Profile %s 的 %s 段无效: %w", name, profileMetaKey, err)
+		}
+		mappingDelete(cfg.root, profileMetaKey)
+	}
+	if p.Rules != "" && p.Rules != subRulesInline && p.Rules != subRulesProvider {
+		return nil, fmt.Errorf("Profile %s 的 rules 只能是 inline 或 provider", name)
+	}
+	for _, key := range profileGeneratedKeys {
+		if cfg.get(key) != nil {
+			log.Printf("[Sub] Profile %s 中的 %s 由模板生成，已忽略", name, key)
+			mappingDelete(cfg.root, key)
+		}
+	}
+	return p, nil
+}
+
+// listProfiles 列出 ProfilesDir 下全部可解析的 Profile（按文件名排序）
+func listProfiles() []*subProfile {
+	matches, _ := filepath.Glob(filepath.Join(ProfilesDir, "*.yaml"))
+	profiles := make([]*subProfile, 0, len(matches))
+	for _, path := range matches {
+		p, err := loadProfile(strings.TrimSuffix(filepath.Base(path), ".yaml"))
+		if err != nil {
+			log.Printf("[Sub] 跳过 Profile %s: %v", filepath.Base(path), err)
+			continue
+		}
+		profiles = append(profiles, p)
+	}
+	return profiles
+}
+
+// apply 把 Profile 的设置合并进配置
+func (p *subProfile) apply(cfg *subConfig) {
+	mergeMapping(cfg.root, p.overrides.root)
+}
+
+// filterTargets 按 Profile 筛选规则目标，保持原有顺序
+func (p *subProfile) filterTargets(targets []string) []string {
+	if len(p.Targets) == 0 {
+		return targets
+	}
+	allow := make(map[string]bool, len(p.Targets))
+	for _, t := range p.Targets {
+		allow[t] = true
+	}
+	var out []string
+	for _, t := range targets {
+		if allow[t] {
+			out = append(out, t)
+		}
+	}
+	return out
+}
+
+// mergeMapping 把 src 合并进 dst：两边都是 mapping 时递归合并，值为 null 时删除该键，其余情况整体替换
+func mergeMapping(dst, src *yaml.Node) {
+	for i := 0; i+1 < len(src.Content); i += 2 {
+		key, val := src.Content[i].Value, resolveNode(src.Content[i+1])
+		if val.Kind == yaml.ScalarNode && val.Tag == "!!null" {
+			mappingDelete(dst, key)
+			continue
+		}
+		if cur := mappingGet(dst, key); cur != nil && cur.Kind == yaml.MappingNode && val.Kind == yaml.MappingNode {
+			mergeMapping(cur, val)
+			continue
+		}
+		mappingSet(dst, key, val)
+	}
+}
+
+// subDeviceID 确定订阅所属的设备：设备 Token 只能拉取自己的订阅，其他身份取 ?device=（必须是已登记的设备）。
+// 失败时已写好响应并返回 false
+func subDeviceID(c *gin.Context, p *Principal) (string, bool) {
+	deviceID := strings.TrimSpace(c.Query("device"))
+	if p.Kind != "device" {
+		if deviceID == "" {
+			return "", true
+		}
+		known, err := knownDevice(deviceID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return "", false
+		}
+		if !known {
+			c.JSON(http.StatusNotFound, gin.H{"error": "设备不存在，新设备请先签发设备 Token: " + deviceID})
+			return "", false
+		}
+		return deviceID, true
+	}
+	if deviceID != "" && deviceID != p.DeviceID {
+		c.JSON(http.StatusForbidden, gin.H{"error": "设备 Token 只能拉取本设备的订阅"})
+		return "", false
+	}
+	return p.DeviceID, true
+}
+
+// resolveSubProfile 依次取 ?profile=、设备保存的 Profile、default；都没有时返回 nil（只用基础设置）。
+// ?profile= 无效或不存在时已写好响应并返回 false
+func resolveSubProfile(c *gin.Context, deviceID string) (*subProfile, bool) {
+	if name := strings.TrimSpace(c.Query("profile")); name != "" {
+		p, err := loadProfile(name)
+		if err != nil {
+			status := http.StatusBadRequest
+			if errors.Is(err, ErrNotFound) {
+				status = http.StatusNotFound
+				err = fmt.Errorf("Profile 不存在: %s", name)
+			}
+			c.JSON(status, gin.H{"error": err.Error()})
+			return nil, false
+		}
+		return p, true
+	}
+
+	if deviceID != "" {
+		d, err := store.GetDevice(deviceID)
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			log.Printf("[Sub] 读取设备 %s 失败: %v", deviceID, err)
+		}
+		if d != nil && d.Profile != "" {
+			p, err := loadProfile(d.Profile)
+			if err == nil {
+				return p, true
+			}
+			log.Printf("[Sub] ⚠️ 设备 %s 的 Profile %s 无法使用，改用默认: %v", deviceID, d.Profile, err)
+		}
+	}
+
+	p, err := loadProfile(defaultProfile)
+	if err != nil {
+		if !errors.Is(err, ErrNotFound) {
+			log.Printf("[Sub] ⚠️ 默认 Profile 无法使用: %v", err)
+		}
+		return nil, true
+	}
+	return p, true
+}
+
+// handleListProfiles GET /api/profiles — 可用的订阅 Profile
+func handleListProfiles(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"profiles": listProfiles()})
+}
+
+// handleSetDeviceProfile PUT /api/devices/:id/profile — 设置设备的订阅 Profile。
+// 请求体：{"profile": "router"}；profile 为空表示恢复默认
+func handleSetDeviceProfile(c *gin.Context) {
+	var req struct {
+		Profile string `json:"profile"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "请求格式错误"})
+		return
+	}
+	deviceID := c.Param("id")
+	req.Profile = strings.TrimSpace(req.Profile)
+	if req.Profile != "" {
+		if _, err := loadProfile(req.Profile); err != nil {
+			if errors.Is(err, ErrNotFound) {
+				err = fmt.Errorf("Profile 不存在: %s", req.Profile)
+			}
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	if err := store.SetDeviceProfile(deviceID, req.Profile); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	log.Printf("[Device] 设备 %s 的订阅 Profile 已设为 %q", deviceID, req.Profile)
+	c.JSON(http.StatusOK, gin.H{"device_id": deviceID, "profile": req.Profile})
+}
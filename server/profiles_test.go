@@ -0,0 +1,63 @@
+package main
+
+import "testing"
+
+func TestMergeMapping(t *testing.T) {
+	const base = `mixed-port: 7890
+dns:
+  enable: true
+  nameserver: [223.5.5.5, 119.29.29.29]
+  fallback-filter:
+    geoip: true
+    ipcidr: [240.0.0.0/4]
+tun:
+  enable: false
+log-level: info
+`
+	tests := []struct {
+		name      string
+		overrides string
+		want      string
+	}{
+		{"空覆盖不变", "", base},
+		{
+			"标量替换与新增键追加到末尾",
+			"mixed-port: 7891\nallow-lan: true\n",
+			"mixed-port: 7891\ndns:\n  enable: true\n  nameserver: [223.5.5.5, 119.29.29.29]\n  fallback-filter:\n    geoip: true\n    ipcidr: [240.0.0.0/4]\ntun:\n  enable: false\nlog-level: info\nallow-lan: true\n",
+		},
+		{
+			"mapping 递归合并，序列整体替换",
+			"dns:\n  nameserver:\n    - 1.1.1.1\n  fallback-filter:\n    geoip: false\n",
+			"mixed-port: 7890\ndns:\n  enable: true\n  nameserver:\n    - 1.1.1.1\n  fallback-filter:\n    geoip: false\n    ipcidr: [240.0.0.0/4]\ntun:\n  enable: false\nlog-level: info\n",
+		},
+		{
+			"null 删除键",
+			"log-level: null\ndns:\n  fallback-filter: ~\n",
+			"mixed-port: 7890\ndns:\n  enable: true\n  nameserver: [223.5.5.5, 119.29.29.29]\ntun:\n  enable: false\n",
+		},
+		{
+			"mapping 替换标量、标量替换 mapping",
+			"tun: off\nlog-level: {level: debug}\n",
+			"mixed-port: 7890\ndns:\n  enable: true\n  nameserver: [223.5.5.5, 119.29.29.29]\n  fallback-filter:\n    geoip: true\n    ipcidr: [240.0.0.0/4]\ntun: off\nlog-level: {level: debug}\n",
+		},
+		{
+			"覆盖中的锚点与合并键先展开",
+			"x-tun: &tun {stack: gvisor}\ntun:\n  <<: *tun\n  enable: true\n",
+			"mixed-port: 7890\ndns:\n  enable: true\n  nameserver: [223.5.5.5, 119.29.29.29]\n  fallback-filter:\n    geoip: true\n    ipcidr: [240.0.0.0/4]\ntun:\n  enable: true\n  stack: gvisor\nlog-level: info\nx-tun: {stack: gvisor}\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := mustParseSubConfig(t, base)
+			mergeMapping(cfg.root, mustParseSubConfig(t, tt.overrides).root)
+			data, err := cfg.marshal("")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != tt.want {
+				t.Errorf("输出 =\n%s\n期望\n%s", data, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,79 @@
+// 远程切换节点：经设备的远程命令读取 Mihomo 策略组（GET /proxies）并切换选中节点（PUT /proxies/{group}）
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// proxyGroup 设备上报的策略组
+type proxyGroup struct {
+	Name string   `json:"name"`
+	Type string   `json:"type"` // Selector / URLTest / Fallback / LoadBalance ...
+	Now  string   `json:"now"`  // 当前选中的节点
+	All  []string `json:"all"`  // 可选节点，按配置顺序
+}
+
+// relayProxyCommand 下发命令并解析回执中的策略组，失败时已写好响应并返回 false
+func relayProxyCommand(c *gin.Context, action string, args json.RawMessage) ([]proxyGroup, bool) {
+	principal := c.MustGet(principalKey).(*Principal)
+	cmd, err := runDeviceCommand(c.Param("id"), action, args, principal.String(), commandTimeout(0))
+	if err != nil {
+		resp := gin.H{"error": err.Error()}
+		if cmd != nil {
+			resp["command"] = commandJSON(cmd)
+		}
+		c.JSON(commandErrorStatus(err), resp)
+		return nil, false
+	}
+	if cmd.Status != CommandOK {
+		c.JSON(http.StatusBadGateway, gin.H{"error": cmd.Error, "command": commandJSON(cmd)})
+		return nil, false
+	}
+
+	var result struct {
+		Groups []proxyGroup `json:"groups"`
+	}
+	if err := json.Unmarshal([]byte(cmd.Result), &result); err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": "设备回执格式错误", "command": commandJSON(cmd)})
+		return nil, false
+	}
+	return result.Groups, true
+}
+
+// handleListProxies GET /api/devices/:id/proxies — 设备上的策略组及当前选中节点
+func handleListProxies(c *gin.Context) {
+	groups, ok := relayProxyCommand(c, "list_proxies", nil)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"device_id": c.Param("id"), "groups": groups})
+}
+
+// handleSelectProxy PUT /api/devices/:id/proxies/*group — 切换设备上策略组选中的节点。
+// 请求体：{"name": "节点名"}；group 用通配参数，组名中可以含 "/"
+func handleSelectProxy(c *gin.Context) {
+	var req struct {
+		Name string `json:"name"`
+	}
+	group := strings.TrimPrefix(c.Param("group"), "/")
+	if err := c.ShouldBindJSON(&req); err != nil || req.Name == "" || group == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "需要策略组名与 name"})
+		return
+	}
+
+	args, _ := json.Marshal(map[string]string{"group": group, "name": req.Name})
+	groups, ok := relayProxyCommand(c, "select_proxy", args)
+	if !ok {
+		return
+	}
+	resp := gin.H{"device_id": c.Param("id"), "group": group, "now": req.Name}
+	if len(groups) == 1 {
+		resp["now"] = groups[0].Now
+	}
+	c.JSON(http.StatusOK, resp)
+}
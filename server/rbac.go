@@ -0,0 +1,116 @@
+// 基于角色的访问控制：角色 → 权限映射，以及按路由声明权限的中间件
+
+package main
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 权限标识
+const (
+	PermStatsRead     = "stats:read"     // 查询统计、设备、连接记录
+	PermUpdateTrigger = "update:trigger" // 手动触发订阅与规则更新
+	PermDeviceCommand = "device:command" // 向设备下发远程命令
+	PermTokensManage  = "tokens:manage"  // 签发 / 吊销设备 Token
+	PermUsersManage   = "users:manage"   // 管理仪表盘账号
+	PermAuditRead     = "audit:read"     // 查看鉴权审计事件
+	PermReportWrite   = "report:write"   // 上报流量（/ws、/report）
+	PermSubRead       = "sub:read"       // 拉取订阅与模板（/sub、/templates/*）
+)
+
+// 角色
+const (
+	RoleViewer   = "viewer"
+	RoleOperator = "operator"
+	RoleAdmin    = "admin"
+	RoleDevice   = "device"
+)
+
+var rolePermissions = map[string][]string{
+	RoleViewer:   {PermStatsRead},
+	RoleOperator: {PermStatsRead, PermUpdateTrigger, PermDeviceCommand},
+	RoleAdmin:    {PermStatsRead, PermUpdateTrigger, PermDeviceCommand, PermTokensManage, PermUsersManage, PermAuditRead, PermSubRead},
+	RoleDevice:   {PermReportWrite, PermSubRead},
+}
+
+// isUserRole 仪表盘账号可分配的角色（device 角色仅属于设备 Token）
+func isUserRole(role string) bool {
+	return role == RoleViewer || role == RoleOperator || role == RoleAdmin
+}
+
+// role 返回调用方的角色：设备 Token 固定为 device，ServerToken 不受角色限制
+func (p *Principal) role() string {
+	switch p.Kind {
+	case "device":
+		return RoleDevice
+	case "user":
+		return p.Role
+	}
+	return ""
+}
+
+// Can 判断调用方是否拥有指定权限
+func (p *Principal) Can(perm string) bool {
+	if p.Kind == "master" {
+		return true
+	}
+	for _, granted := range rolePermissions[p.role()] {
+		if granted == perm {
+			return true
+		}
+	}
+	return false
+}
+
+// permissions 返回调用方拥有的全部权限（供 /api/me 返回给前端）
+func (p *Principal) permissions() []string {
+	if p.Kind == "master" {
+		var all []string
+		seen := make(map[string]bool)
+		for _, perms := range rolePermissions {
+			for _, perm := range perms {
+				if !seen[perm] {
+					seen[perm] = true
+					all = append(all, perm)
+				}
+			}
+		}
+		return all
+	}
+	return rolePermissions[p.role()]
+}
+
+// String 用于日志，不包含任何凭据内容
+func (p *Principal) String() string {
+	switch p.Kind {
+	case "device":
+		return "设备 " + p.DeviceID
+	case "user":
+		return "用户 " + p.Username + " (" + p.Role + ")"
+	}
+	return "ServerToken"
+}
+
+// authorize 检查权限，不满足时记录日志并返回 403
+func authorize(c *gin.Context, p *Principal, perm string) bool {
+	if p.Can(perm) {
+		return true
+	}
+	log.Printf("[RBAC] 拒绝访问: %s → %s %s (需要 %s, 来源 %s)", p, c.Request.Method, c.Request.URL.Path, perm, c.ClientIP())
+	c.JSON(http.StatusForbidden, gin.H{"error": "Forbidden: missing permission " + perm})
+	return false
+}
+
+// RequirePermission 路由级权限中间件，需放在 TokenAuthMiddleware 之后
+func RequirePermission(perm string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !authorize(c, c.MustGet(principalKey).(*Principal), perm) {
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
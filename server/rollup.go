@@ -0,0 +1,209 @@
+// 流量降采样：小时 / 日汇总表的增量维护、历史回填、分层保留与分层读取
+
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// TrafficHourly 按小时汇总的流量（设备 × 节点 × 是否代理），与原始记录在同一事务中增量累加。
+// 小时边界按报表时区计算（+05:30 等非整小时时区的小时起点不在 UTC 整点上）
+type TrafficHourly struct {
+	Hour      int64  `gorm:"primaryKey;autoIncrement:false"` // 报表时区中的小时起点（Unix 秒）
+	DeviceID  string `gorm:"primaryKey"`
+	NodeName  string `gorm:"primaryKey"`
+	IsProxy   bool   `gorm:"primaryKey"`
+	UpDelta   int64
+	DownDelta int64
+}
+
+func (TrafficHourly) TableName() string { return "traffic_hourly" }
+
+// TrafficDaily 按日汇总的流量，日边界按报表时区（Timezone）计算。
+// 修改 Timezone 只影响之后写入的数据，已有的日汇总保持原有边界。
+type TrafficDaily struct {
+	Day       int64  `gorm:"primaryKey;autoIncrement:false"` // 当日零点（Unix 秒）
+	DeviceID  string `gorm:"primaryKey"`
+	NodeName  string `gorm:"primaryKey"`
+	IsProxy   bool   `gorm:"primaryKey"`
+	UpDelta   int64
+	DownDelta int64
+}
+
+func (TrafficDaily) TableName() string { return "traffic_daily" }
+
+type rollupKey struct {
+	slot     int64
+	deviceID string
+	nodeName string
+	isProxy  bool
+}
+
+// buildRollups 把一批原始记录按小时 / 日（报表时区）与设备、节点、是否代理聚合为汇总行
+func buildRollups(records []TrafficRecord) ([]*TrafficHourly, []*TrafficDaily) {
+	hourly := make(map[rollupKey]*TrafficHourly)
+	daily := make(map[rollupKey]*TrafficDaily)
+	var hourRows []*TrafficHourly
+	var dayRows []*TrafficDaily
+	loc := reportLocation()
+	for _, r := range records {
+		hour := bucketStart(r.Timestamp, "hour", loc).Unix()
+		hk := rollupKey{hour, r.DeviceID, r.NodeName, r.IsProxy}
+		h, ok := hourly[hk]
+		if !ok {
+			h = &TrafficHourly{Hour: hour, DeviceID: r.DeviceID, NodeName: r.NodeName, IsProxy: r.IsProxy}
+			hourly[hk] = h
+			hourRows = append(hourRows, h)
+		}
+		h.UpDelta += r.UpDelta
+		h.DownDelta += r.DownDelta
+
+		day := bucketStart(r.Timestamp, "day", loc).Unix()
+		dk := rollupKey{day, r.DeviceID, r.NodeName, r.IsProxy}
+		d, ok := daily[dk]
+		if !ok {
+			d = &TrafficDaily{Day: day, DeviceID: r.DeviceID, NodeName: r.NodeName, IsProxy: r.IsProxy}
+			daily[dk] = d
+			dayRows = append(dayRows, d)
+		}
+		d.UpDelta += r.UpDelta
+		d.DownDelta += r.DownDelta
+	}
+	return hourRows, dayRows
+}
+
+// backfillRollups 汇总表为空而原始表有数据时（升级后首次启动），从原始记录回填。
+// 必须在写入管线启动前调用，避免与增量累加重复计数。
+func backfillRollups() {
+	rawCount, hourlyCount, err := store.CountTraffic()
+	if err != nil {
+		log.Printf("[Rollup] 统计记录数失败: %v", err)
+		return
+	}
+	if hourlyCount > 0 || rawCount == 0 {
+		return
+	}
+
+	log.Printf("[Rollup] 汇总表为空，开始从 %d 条原始记录回填...", rawCount)
+	start := time.Now()
+	if err := store.BackfillRollups(); err != nil {
+		log.Printf("[Rollup] 回填失败: %v", err)
+		return
+	}
+	log.Printf("[Rollup] 回填完成，耗时 %s", time.Since(start).Round(time.Millisecond))
+}
+
+// retentionDays 读取各层保留天数（0 表示永久保留）
+func retentionDays() (raw, hourly, daily int) {
+	confLock.RLock()
+	defer confLock.RUnlock()
+	return conf.RawRetentionDays, conf.HourlyRetentionDays, conf.DailyRetentionDays
+}
+
+// tierBoundaries 计算分层读取的分界点：[rawFrom, ∞) 读原始表，[hourlyFrom, rawFrom) 读小时表，
+// 更早的读日表。分界点对齐到小时 / 日，保证每一段都被对应的表完整覆盖。
+func tierBoundaries(now time.Time) (rawFrom, hourlyFrom time.Time) {
+	rawDays, hourlyDays, _ := retentionDays()
+
+	rawFrom = nextBucket(bucketStart(now.AddDate(0, 0, -rawDays), "hour", reportLocation()), "hour")
+	if hourlyDays == 0 {
+		return rawFrom, time.Time{}
+	}
+	hourlyFrom = nextBucket(reportDayStart(now.AddDate(0, 0, -hourlyDays)), "day")
+	if hourlyFrom.After(rawFrom) {
+		hourlyFrom = rawFrom
+	}
+	return rawFrom, hourlyFrom
+}
+
+// queryTrafficSlots 分层读取 [from, to) 内的流量：原始保留期内读原始表，
+// 更早的部分读小时表，超出小时表保留期的读日表（此时粒度为整日）
+func queryTrafficSlots(q SlotQuery) ([]tsRow, error) {
+	rawFrom, hourlyFrom := tierBoundaries(time.Now())
+	from, to := q.From, q.To
+
+	var rows []tsRow
+	fetch := func(tier string, from, to time.Time) error {
+		sub := q
+		sub.From, sub.To = from, to
+		r, err := store.TrafficSlots(tier, sub)
+		rows = append(rows, r...)
+		return err
+	}
+	if to.After(rawFrom) {
+		if err := fetch(TierRaw, maxTime(from, rawFrom), to); err != nil {
+			return nil, err
+		}
+	}
+	if from.Before(rawFrom) && to.After(hourlyFrom) {
+		if err := fetch(TierHourly, maxTime(from, hourlyFrom), minTime(to, rawFrom)); err != nil {
+			return nil, err
+		}
+	}
+	if !hourlyFrom.IsZero() && from.Before(hourlyFrom) {
+		if err := fetch(TierDaily, from, minTime(to, hourlyFrom)); err != nil {
+			return nil, err
+		}
+	}
+	return rows, nil
+}
+
+// sumTraffic 返回 [from, to) 内代理与直连的上下行总量（自动选择原始表或汇总表）
+func sumTraffic(from, to time.Time) (proxyTotal, localTotal int64, err error) {
+	rows, err := queryTrafficSlots(SlotQuery{From: from, To: to, Slot: 86400, Group: "proxy"})
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, r := range rows {
+		if r.GroupKey == "proxy" {
+			proxyTotal += r.Up + r.Down
+		} else {
+			localTotal += r.Up + r.Down
+		}
+	}
+	return proxyTotal, localTotal, nil
+}
+
+func maxTime(a, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+	return b
+}
+
+func minTime(a, b time.Time) time.Time {
+	if a.Before(b) {
+		return a
+	}
+	return b
+}
+
+// cleanupRollups 按各自的保留天数清理小时表与日表
+func cleanupRollups() {
+	_, hourlyDays, dailyDays := retentionDays()
+	now := time.Now()
+
+	var hourBefore, dayBefore int64
+	if hourlyDays > 0 {
+		hourBefore = reportDayStart(now.AddDate(0, 0, -hourlyDays)).Unix()
+	}
+	if dailyDays > 0 {
+		dayBefore = reportDayStart(now.AddDate(0, 0, -dailyDays)).Unix()
+	}
+	if hourBefore == 0 && dayBefore == 0 {
+		return
+	}
+
+	hourly, daily, err := store.PurgeRollups(hourBefore, dayBefore)
+	if err != nil {
+		log.Printf("清理过期汇总失败: %v", err)
+		return
+	}
+	if hourBefore > 0 {
+		log.Printf("已清理 %d 天前的小时汇总，共删除 %d 条记录", hourlyDays, hourly)
+	}
+	if dayBefore > 0 {
+		log.Printf("已清理 %d 天前的日汇总，共删除 %d 条记录", dailyDays, daily)
+	}
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBuildRollupsReportTimezone(t *testing.T) {
+	kolkata := mustLoadLocation(t, "Asia/Kolkata")
+	saved := reportLoc
+	reportLoc = kolkata
+	defer func() { reportLoc = saved }()
+
+	// 10:10 与 10:50（IST）在同一小时；11:05 是下一个小时，按 UTC 整点切分则会错分
+	records := []TrafficRecord{
+		{Timestamp: time.Date(2026, 10, 18, 10, 10, 0, 0, kolkata), DeviceID: "d", NodeName: "HK", UpDelta: 1},
+		{Timestamp: time.Date(2026, 10, 18, 10, 50, 0, 0, kolkata), DeviceID: "d", NodeName: "HK", UpDelta: 2},
+		{Timestamp: time.Date(2026, 10, 18, 11, 5, 0, 0, kolkata), DeviceID: "d", NodeName: "HK", UpDelta: 4},
+	}
+	hours, days := buildRollups(records)
+
+	want := map[int64]int64{
+		time.Date(2026, 10, 18, 10, 0, 0, 0, kolkata).Unix(): 3,
+		time.Date(2026, 10, 18, 11, 0, 0, 0, kolkata).Unix(): 4,
+	}
+	if len(hours) != len(want) {
+		t.Fatalf("小时汇总 %d 行, 期望 %d", len(hours), len(want))
+	}
+	for _, h := range hours {
+		if h.UpDelta != want[h.Hour] {
+			t.Errorf("小时 %s 上行 = %d, 期望 %d", time.Unix(h.Hour, 0).In(kolkata), h.UpDelta, want[h.Hour])
+		}
+	}
+	if len(days) != 1 || days[0].Day != time.Date(2026, 10, 18, 0, 0, 0, 0, kolkata).Unix() || days[0].UpDelta != 7 {
+		t.Errorf("日汇总 = %+v", days)
+	}
+}
@@ -0,0 +1,90 @@
+// 规则目标映射：规则集清单 CSV 中的 TargetGroup → RuleSet/ 下的规则集文件。
+// 映射表为 templates/86_target_map.csv，未列出的 target 使用 86<Target>Rules.yaml；规则编译（processRules）与 /sub 共用
+
+package main
+
+import (
+	"encoding/csv"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// targetNameRe 可以直接拼成文件名的 target（其余 target 必须在映射表中列出）
+var targetNameRe = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// ruleFileSkeleton 新建规则集文件的初始内容：只有手工规则区，编译时在 [MANUAL_END] 之后追加规则
+const ruleFileSkeleton = `payload:
+  # ==========================================
+  # [MANUAL_START] Private
+  # ==========================================
+  
+  # ==========================================
+  # [MANUAL_END] Private
+
+`
+
+// ruleTargetMap target → 规则集文件名
+type ruleTargetMap map[string]string
+
+// loadRuleTargets 读取映射表（Target,RuleFile 两列，# 开头为注释），文件不存在时返回空表
+func loadRuleTargets() ruleTargetMap {
+	m := make(ruleTargetMap)
+	data, err := os.ReadFile(TargetMapFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("[CSV] 读取规则目标映射失败 %s: %v", TargetMapFile, err)
+		}
+		return m
+	}
+
+	reader := csv.NewReader(strings.NewReader(string(data)))
+	reader.FieldsPerRecord = -1
+	records, err := reader.ReadAll()
+	if err != nil {
+		log.Printf("[CSV] 解析规则目标映射失败: %v", err)
+		return m
+	}
+	for _, record := range records {
+		if len(record) < 2 {
+			continue
+		}
+		target := strings.TrimSpace(record[0])
+		file := strings.TrimSpace(record[1])
+		if target == "" || strings.HasPrefix(target, "#") {
+			continue
+		}
+		if file != filepath.Base(file) || !strings.HasSuffix(file, ".yaml") {
+			log.Printf("[CSV] 规则目标映射 %s → %q 无效（只能是 RuleSet/ 下的 .yaml 文件名），已忽略", target, file)
+			continue
+		}
+		m[target] = file
+	}
+	return m
+}
+
+// file 返回 target 对应的规则集文件名，无法确定时返回空字符串
+func (m ruleTargetMap) file(target string) string {
+	if f, ok := m[target]; ok {
+		return f
+	}
+	if targetNameRe.MatchString(target) {
+		return "86" + target + "Rules.yaml"
+	}
+	return ""
+}
+
+// ensureRuleFile 规则集文件不存在时按 ruleFileSkeleton 创建，返回是否新建
+func ensureRuleFile(path string) (bool, error) {
+	if _, err := os.Stat(path); err == nil {
+		return false, nil
+	} else if !os.IsNotExist(err) {
+		return false, err
+	}
+	if err := os.WriteFile(path, []byte(ruleFileSkeleton), 0644); err != nil {
+		return false, err
+	}
+	return true, nil
+}
@@ -105,11 +105,15 @@ func fetchSubInfo(url string) (used, total, expire int64, err error) {
 }
 
 func processDailyReport() {
-	today := time.Now().Truncate(24 * time.Hour)
+	dayStart := reportDayStart(time.Now())
 
 	var proxyTotal, localTotal int64
-	db.Model(&TrafficRecord{}).Where("timestamp >= ? AND is_proxy = ?", today, true).Select("COALESCE(SUM(up_delta + down_delta), 0)").Scan(&proxyTotal)
-	db.Model(&TrafficRecord{}).Where("timestamp >= ? AND is_proxy = ?", today, false).Select("COALESCE(SUM(up_delta + down_delta), 0)").Scan(&localTotal)
+	if summary, err := store.Summary(dayStart); err == nil {
+		proxyTotal = summary.ProxyUp + summary.ProxyDown
+		localTotal = summary.LocalUp + summary.LocalDown
+	} else {
+		log.Printf("统计今日流量失败: %v", err)
+	}
 
 	confLock.RLock()
 	subUrls := conf.SubUrls
@@ -120,12 +124,14 @@ func processDailyReport() {
 	for fileName, url := range subUrls {
 		used, total, expire, err := fetchSubInfo(url)
 		if err == nil {
-			db.Create(&SubSnapshot{Date: today, SubUrl: url, Used: used, Total: total, Expire: expire})
+			store.SaveSubSnapshot(&SubSnapshot{Date: dayStart, SubUrl: url, Used: used, Total: total, Expire: expire})
 
-			var lastSub SubSnapshot
-			db.Where("sub_url = ? AND date < ?", url, today).Order("date desc").First(&lastSub)
+			var lastUsed int64
+			if lastSub, err := store.LatestSubSnapshot(url, dayStart); err == nil {
+				lastUsed = lastSub.Used
+			}
 
-			dailyUsed := used - lastSub.Used
+			dailyUsed := used - lastUsed
 			if dailyUsed < 0 {
 				dailyUsed = 0
 			}
@@ -151,13 +157,24 @@ func processDailyReport() {
 			formatBytes(totalAirportUsageToday), formatBytes(proxyTotal), formatBytes(diff))
 	}
 
+	// 本月累计：月初可能早于原始记录保留期，由 sumTraffic 自动改读汇总表
+	monthStart := bucketStart(time.Now(), "month", reportLocation())
+	monthProxy, monthLocal, err := sumTraffic(monthStart, time.Now())
+	monthMsg := "【本月累计】\n"
+	if err != nil {
+		monthMsg += fmt.Sprintf("统计失败: %v", err)
+	} else {
+		monthMsg += fmt.Sprintf("- 代理流量: %s\n- 本地流量: %s\n- 总计流量: %s",
+			formatBytes(monthProxy), formatBytes(monthLocal), formatBytes(monthProxy+monthLocal))
+	}
+
 	confLock.RLock()
 	emailTo := conf.EmailTo
 	confLock.RUnlock()
 
-	subject := fmt.Sprintf("流量日报 - %s", today.Format("2006-01-02"))
-	body := fmt.Sprintf("今日汇总:\n- 代理流量: %s\n- 本地流量: %s\n- 总计流量: %s\n\n%s\n\n%s",
-		formatBytes(proxyTotal), formatBytes(localTotal), formatBytes(proxyTotal+localTotal), subMsg, leakMsg)
+	subject := fmt.Sprintf("流量日报 - %s", dayStart.Format("2006-01-02"))
+	body := fmt.Sprintf("今日汇总:\n- 代理流量: %s\n- 本地流量: %s\n- 总计流量: %s\n\n%s\n\n%s\n\n%s",
+		formatBytes(proxyTotal), formatBytes(localTotal), formatBytes(proxyTotal+localTotal), monthMsg, subMsg, leakMsg)
 
 	sendEmail(subject, body)
 	log.Printf("日报邮件已发送至: %s", emailTo)
@@ -165,7 +182,7 @@ func processDailyReport() {
 
 func updateSubscriptionData() {
 	log.Println("正在执行启动时订阅数据更新...")
-	today := time.Now().Truncate(24 * time.Hour)
+	today := reportDayStart(time.Now())
 
 	confLock.RLock()
 	subUrls := conf.SubUrls
@@ -174,7 +191,9 @@ func updateSubscriptionData() {
 	for fileName, url := range subUrls {
 		used, total, expire, err := fetchSubInfo(url)
 		if err == nil {
-			db.Create(&SubSnapshot{Date: today, SubUrl: url, Used: used, Total: total, Expire: expire})
+			if err := store.SaveSubSnapshot(&SubSnapshot{Date: today, SubUrl: url, Used: used, Total: total, Expire: expire}); err != nil {
+				log.Printf("订阅 [%s] 快照写入失败: %v", fileName, err)
+			}
 			log.Printf("订阅 [%s] 更新成功 | 已用: %s", fileName, formatBytes(used))
 		} else {
 			log.Printf("订阅 [%s] 更新失败: %v", fileName, err)
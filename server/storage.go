@@ -0,0 +1,251 @@
+// 存储层接口：handlers / websocket / service 只通过 Store 访问数据，具体后端（SQLite / PostgreSQL）由配置选择
+
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ErrNotFound 查询的记录不存在（各后端统一转换为该错误）
+var ErrNotFound = errors.New("record not found")
+
+// ErrDuplicate 写入违反唯一约束（如用户名已存在）
+var ErrDuplicate = errors.New("duplicate record")
+
+// ReportBatch 一帧上报数据。Stream 与 Seq 非空时按 (DeviceID, Stream) 的游标去重
+type ReportBatch struct {
+	DeviceID string
+	Stream   string
+	Seq      uint64
+	Traffic  []TrafficRecord
+	Conns    []ConnectionRecord
+}
+
+// SlotQuery 按时间槽聚合流量的查询条件，Group 为 device / node / proxy，留空不分组
+type SlotQuery struct {
+	From, To time.Time
+	Slot     int64 // 时间槽宽度（秒）
+	Group    string
+	Device   string
+	Node     string
+}
+
+// 流量分层（原始表 / 小时汇总 / 日汇总）
+const (
+	TierRaw    = "raw"
+	TierHourly = "hourly"
+	TierDaily  = "daily"
+)
+
+// NodeTotal 节点流量合计
+type NodeTotal struct {
+	NodeName string `json:"node_name"`
+	Total    int64  `json:"total"`
+	IsProxy  bool   `json:"is_proxy"`
+}
+
+// TrafficSummary 代理 / 直连的上下行合计
+type TrafficSummary struct {
+	ProxyUp   int64 `json:"proxy_up"`
+	ProxyDown int64 `json:"proxy_down"`
+	LocalUp   int64 `json:"local_up"`
+	LocalDown int64 `json:"local_down"`
+}
+
+// DeviceTraffic 单个设备的上下行合计
+type DeviceTraffic struct {
+	DeviceID string
+	Up       int64
+	Down     int64
+}
+
+// DeviceNodeUsage 设备在单个节点上的上下行合计
+type DeviceNodeUsage struct {
+	DeviceID, NodeName string
+	Up, Down           int64
+}
+
+// LatencyStat 设备在单个节点上的延迟统计（只统计成功的测试，Failures 为超时 / 失败次数）
+type LatencyStat struct {
+	DeviceID string `json:"device_id"`
+	NodeName string `json:"node"`
+	Avg      int64  `json:"avg"`
+	Min      int64  `json:"min"`
+	Max      int64  `json:"max"`
+	Samples  int64  `json:"samples"`
+	Failures int64  `json:"failures"`
+}
+
+// latencyRow 按时间槽预聚合的延迟。保留总和与计数，折叠到桶时再求平均
+type latencyRow struct {
+	Slot     int64
+	GroupKey string
+	DelaySum int64 // 成功测试的延迟总和（毫秒）
+	OK       int64
+	Failures int64
+	Min      int64
+	Max      int64
+}
+
+// ConnQuery 连接审计记录查询条件
+type ConnQuery struct {
+	Device string
+	Host   string // 模糊匹配
+	Limit  int
+}
+
+// AuthEventQuery 鉴权审计事件查询条件
+type AuthEventQuery struct {
+	ClientIP string
+	Success  *bool
+	Limit    int
+}
+
+// Store 数据存储接口
+type Store interface {
+	// Dialect 返回后端名称（sqlite / postgres）
+	Dialect() string
+	// Migrate 执行未应用的版本化迁移（migrations/<方言>/）及后端特有的初始化
+	Migrate() error
+	// PendingMigrations 返回尚未应用的迁移
+	PendingMigrations() ([]Migration, error)
+	Close() error
+
+	// WriteReports 在一个事务内完成去重、写入原始记录、累加汇总表与推进游标，返回每帧是否为重复帧
+	WriteReports(batches []ReportBatch) ([]bool, error)
+	// CountTraffic 返回原始表与小时汇总表的行数（判断是否需要回填）
+	CountTraffic() (raw, hourly int64, err error)
+	// BackfillRollups 从原始记录重建小时 / 日汇总
+	BackfillRollups() error
+	// TrafficSlots 从指定分层按时间槽与分组聚合 [From, To) 内的流量
+	TrafficSlots(tier string, q SlotQuery) ([]tsRow, error)
+	// NodeTotals 返回 since 之后各节点的流量合计（降序）
+	NodeTotals(since time.Time) ([]NodeTotal, error)
+	// Summary 返回 since 之后代理 / 直连的上下行合计
+	Summary(since time.Time) (TrafficSummary, error)
+	// DeviceIDs 返回出现过的全部设备 ID
+	DeviceIDs() ([]string, error)
+	// DeviceTrafficSince 返回 since 之后各设备的流量（原始表）
+	DeviceTrafficSince(since time.Time) ([]DeviceTraffic, error)
+	// DeviceTrafficTotals 返回各设备的累计流量（日汇总表）
+	DeviceTrafficTotals() ([]DeviceTraffic, error)
+	// DeviceNodeUsage 返回 since 之后各设备在各节点上的流量
+	DeviceNodeUsage(since time.Time) ([]DeviceNodeUsage, error)
+	// LatestActiveConns 返回各设备 since 之后最新一条记录中的活跃连接数
+	LatestActiveConns(deviceIDs []string, since time.Time) (map[string]int, error)
+	// Connections 查询已关闭连接的审计记录（按结束时间倒序）
+	Connections(q ConnQuery) ([]ConnectionRecord, error)
+	// PurgeRaw 删除 before 之前的原始流量与连接记录
+	PurgeRaw(before time.Time) (traffic, conns int64, err error)
+	// PurgeRollups 删除早于指定小时 / 日起点的汇总（Unix 秒，0 表示不清理）
+	PurgeRollups(hourBefore, dayBefore int64) (hourly, daily int64, err error)
+
+	SaveSubSnapshot(snap *SubSnapshot) error
+	// LatestSubSnapshot 返回订阅最新的快照，before 非零时只取该时间之前的
+	LatestSubSnapshot(subURL string, before time.Time) (*SubSnapshot, error)
+
+	// FindDeviceToken 按摘要查找未吊销的设备 Token
+	FindDeviceToken(hash string) (*DeviceToken, error)
+	// DeviceTokenRevoked 按摘要判断是否为已签发但已吊销的设备 Token
+	DeviceTokenRevoked(hash string) (bool, error)
+	TouchDeviceToken(id uint, at time.Time) error
+	// CreateDeviceToken 写入 Token，设备不存在时一并登记
+	CreateDeviceToken(dt *DeviceToken) error
+	ListDeviceTokens(deviceID string) ([]DeviceToken, error)
+	GetDeviceToken(id uint) (*DeviceToken, error)
+	RevokeDeviceToken(id uint, at time.Time) error
+
+	// StartDeviceSession 记录一次上报连接的建立（设备不存在时一并登记），并更新设备的最近活跃时间、版本与 IP
+	StartDeviceSession(sess *DeviceSession) error
+	// TouchDeviceSession 更新会话与设备的最近活跃时间
+	TouchDeviceSession(id uint, deviceID string, at time.Time) error
+	// EndDeviceSession 记录会话结束
+	EndDeviceSession(id uint, deviceID string, at time.Time) error
+	// SaveDeviceHello 保存握手信息到会话（sessionID 非零时）与设备
+	SaveDeviceHello(sessionID uint, deviceID string, hello DeviceHello) error
+	// SaveDeviceHeartbeat 保存设备最近一次心跳（同时更新最近活跃时间）
+	SaveDeviceHeartbeat(deviceID string, hb DeviceHeartbeat) error
+	// CloseStaleDeviceSessions 结束上次进程遗留的未关闭会话（以最近活跃时间作为结束时间）
+	CloseStaleDeviceSessions() (int64, error)
+	ListDevices() ([]Device, error)
+	// GetDevice 按 ID 查找已登记的设备
+	GetDevice(id string) (*Device, error)
+	// SetDeviceProfile 设置设备的订阅 Profile（设备不存在时一并登记）
+	SetDeviceProfile(deviceID, profile string) error
+	// ListDeviceSessions 返回设备最近的会话（按开始时间倒序）
+	ListDeviceSessions(deviceID string, limit int) ([]DeviceSession, error)
+	// PurgeDeviceSessions 删除 before 之前开始且已结束的会话
+	PurgeDeviceSessions(before time.Time) (int64, error)
+
+	CreateDeviceCommand(cmd *DeviceCommand) error
+	GetDeviceCommand(id string) (*DeviceCommand, error)
+	// CompleteDeviceCommand 记录设备回执（只接受目标设备的回执，超时后到达的回执也会覆盖）
+	CompleteDeviceCommand(id, deviceID, status, result, errMsg string, at time.Time) error
+	// ExpireDeviceCommand 将仍处于 sent 状态的命令标记为超时 / 失败
+	ExpireDeviceCommand(id, status, errMsg string, at time.Time) error
+	// ListDeviceCommands 返回设备最近的命令（按下发时间倒序）
+	ListDeviceCommands(deviceID string, limit int) ([]DeviceCommand, error)
+	PurgeDeviceCommands(before time.Time) (int64, error)
+
+	SaveNodeLatency(samples []NodeLatency) error
+	// LatencyStats 返回 since 之后各设备在各节点上的延迟统计
+	LatencyStats(since time.Time) ([]LatencyStat, error)
+	// LatencySlots 按时间槽与分组（device / node，留空不分组）聚合 [From, To) 内的延迟
+	LatencySlots(q SlotQuery) ([]latencyRow, error)
+	PurgeNodeLatency(before time.Time) (int64, error)
+
+	GetUser(id uint) (*User, error)
+	FindUser(username string) (*User, error)
+	ListUsers() ([]User, error)
+	// CreateUser 写入用户，用户名已存在时返回 ErrDuplicate
+	CreateUser(user *User) error
+	UpdateUser(id uint, updates map[string]any) error
+	DeleteUser(id uint) error
+	CountUsers() (int64, error)
+	// CountAdmins 统计管理员数量，exceptID 非零时排除该用户
+	CountAdmins(exceptID uint) (int64, error)
+	TouchUserLogin(id uint, at time.Time) error
+
+	CreateSession(session *UserSession) error
+	// GetActiveSession 返回未登出且未过期的会话
+	GetActiveSession(id string) (*UserSession, error)
+	RevokeSession(id string, at time.Time) error
+	RevokeUserSessions(userID uint, at time.Time) error
+	PurgeSessions(before time.Time) (int64, error)
+
+	CreateAuthEvent(event *AuthEvent) error
+	ListAuthEvents(q AuthEventQuery) ([]AuthEvent, error)
+	PurgeAuthEvents(before time.Time) (int64, error)
+}
+
+var store Store
+
+// storeDSN 根据配置选择后端：DSN 非空或 DBPath 为 postgres:// 连接串时使用 PostgreSQL，否则为 SQLite 文件路径
+func storeDSN() (dialect, dsn string) {
+	confLock.RLock()
+	defer confLock.RUnlock()
+	if conf.DSN != "" {
+		return "postgres", conf.DSN
+	}
+	if isPostgresDSN(conf.DBPath) {
+		return "postgres", conf.DBPath
+	}
+	return "sqlite", conf.DBPath
+}
+
+func isPostgresDSN(s string) bool {
+	return strings.HasPrefix(s, "postgres://") || strings.HasPrefix(s, "postgresql://")
+}
+
+// dataDir 返回本地数据目录（session.key 等文件所在位置）。使用 PostgreSQL 时 DBPath 不是文件路径，退回 ./data
+func dataDir() string {
+	confLock.RLock()
+	defer confLock.RUnlock()
+	if conf.DBPath == "" || isPostgresDSN(conf.DBPath) {
+		return "./data"
+	}
+	return filepath.Dir(conf.DBPath)
+}
@@ -0,0 +1,771 @@
+// Store 的 gorm 实现，SQLite 与 PostgreSQL（可选 TimescaleDB）共用，方言差异集中在本文件
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/glebarez/sqlite"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+type gormStore struct {
+	db          *gorm.DB
+	dialect     string
+	timescaleDB bool
+}
+
+// openGormStore 按方言打开数据库连接
+func openGormStore(dialect, dsn string, timescaleDB bool) (*gormStore, error) {
+	s := &gormStore{dialect: dialect, timescaleDB: timescaleDB}
+
+	var err error
+	switch dialect {
+	case "postgres":
+		s.db, err = gorm.Open(postgres.Open(dsn), &gorm.Config{})
+		if err != nil {
+			return nil, err
+		}
+		if sqlDB, err := s.db.DB(); err == nil {
+			sqlDB.SetMaxOpenConns(16)
+			sqlDB.SetMaxIdleConns(4)
+		}
+	default:
+		// 高并发读写优化：启用 WAL 模式 (Write-Ahead Logging) 并设置 busy_timeout
+		s.db, err = gorm.Open(sqlite.Open(dsn+"?_pragma=journal_mode(WAL)&_pragma=busy_timeout(5000)&_pragma=synchronous(NORMAL)"), &gorm.Config{})
+		if err != nil {
+			return nil, err
+		}
+		// glebarez/sqlite (pure go) 强制串行写入（1）+ WAL 最稳，写入是高频小包，避免 "database is locked"
+		if sqlDB, err := s.db.DB(); err == nil {
+			sqlDB.SetMaxOpenConns(1)
+		}
+	}
+	return s, nil
+}
+
+func (s *gormStore) Dialect() string { return s.dialect }
+
+func (s *gormStore) Close() error {
+	sqlDB, err := s.db.DB()
+	if err != nil {
+		return err
+	}
+	return sqlDB.Close()
+}
+
+func (s *gormStore) Migrate() error {
+	if err := s.runMigrations(); err != nil {
+		return err
+	}
+	if s.dialect == "postgres" && s.timescaleDB {
+		return s.createHypertable()
+	}
+	return nil
+}
+
+// createHypertable 把 traffic_records 转为按 timestamp 分区的 TimescaleDB 超表。
+// 超表的唯一约束必须包含分区列，因此主键改为 (id, timestamp)
+func (s *gormStore) createHypertable() error {
+	var isHypertable bool
+	if err := s.db.Raw("SELECT EXISTS (SELECT 1 FROM timescaledb_information.hypertables WHERE hypertable_name = 'traffic_records')").Scan(&isHypertable).Error; err == nil && isHypertable {
+		return nil
+	}
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		for _, stmt := range []string{
+			"CREATE EXTENSION IF NOT EXISTS timescaledb",
+			"ALTER TABLE traffic_records DROP CONSTRAINT IF EXISTS traffic_records_pkey",
+			"ALTER TABLE traffic_records ADD PRIMARY KEY (id, timestamp)",
+			"SELECT create_hypertable('traffic_records', 'timestamp', migrate_data => TRUE, if_not_exists => TRUE)",
+		} {
+			if err := tx.Exec(stmt).Error; err != nil {
+				return fmt.Errorf("TimescaleDB 初始化失败 (%s): %w", stmt, err)
+			}
+		}
+		log.Println("[Store] traffic_records 已转换为 TimescaleDB 超表")
+		return nil
+	})
+}
+
+// timeArg 时间查询参数。SQLite 把时间存为带时区偏移的文本并按文本比较，
+// 参数需转换为入库时使用的本地时区表示；PostgreSQL 按时间值比较，原样传入
+func (s *gormStore) timeArg(t time.Time) time.Time {
+	if s.dialect == "sqlite" {
+		return t.Local()
+	}
+	return t
+}
+
+// epochExpr 把时间列转换为 Unix 秒的 SQL 表达式
+func (s *gormStore) epochExpr(column string) string {
+	if s.dialect == "postgres" {
+		return fmt.Sprintf("CAST(EXTRACT(EPOCH FROM %s) AS BIGINT)", column)
+	}
+	return fmt.Sprintf("CAST(strftime('%%s', %s) AS INTEGER)", column)
+}
+
+// groupExpr 分组维度对应的 SQL 表达式
+func groupExpr(group string) string {
+	switch group {
+	case "device":
+		return "device_id"
+	case "node":
+		return "node_name"
+	case "proxy":
+		return "CASE WHEN is_proxy THEN 'proxy' ELSE 'direct' END"
+	}
+	return "'total'"
+}
+
+// notFound 把 gorm 的记录不存在转换为 ErrNotFound
+func notFound(err error) error {
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return ErrNotFound
+	}
+	return err
+}
+
+// duplicated 借助驱动的错误转换识别唯一约束冲突并转换为 ErrDuplicate，其余错误原样返回
+func (s *gormStore) duplicated(err error) error {
+	if t, ok := s.db.Dialector.(gorm.ErrorTranslator); ok && errors.Is(t.Translate(err), gorm.ErrDuplicatedKey) {
+		return ErrDuplicate
+	}
+	return err
+}
+
+// ---- 上报写入与汇总 ----
+
+type cursorKey struct {
+	deviceID string
+	stream   string
+}
+
+func (s *gormStore) WriteReports(batches []ReportBatch) ([]bool, error) {
+	dups := make([]bool, len(batches))
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		cursors := make(map[cursorKey]uint64)
+		dirty := make(map[cursorKey]bool)
+		var traffic []TrafficRecord
+		var conns []ConnectionRecord
+
+		for i, b := range batches {
+			if b.Seq > 0 && b.Stream != "" {
+				key := cursorKey{b.DeviceID, b.Stream}
+				last, ok := cursors[key]
+				if !ok {
+					var cursor ReportCursor
+					if err := tx.Where("device_id = ? AND stream = ?", key.deviceID, key.stream).Limit(1).Find(&cursor).Error; err != nil {
+						return err
+					}
+					last = cursor.LastSeq
+				}
+				if b.Seq <= last {
+					dups[i] = true
+					cursors[key] = last
+					continue
+				}
+				cursors[key] = b.Seq
+				dirty[key] = true
+			}
+			traffic = append(traffic, b.Traffic...)
+			conns = append(conns, b.Conns...)
+		}
+
+		if len(traffic) > 0 {
+			if err := tx.CreateInBatches(traffic, 200).Error; err != nil {
+				return err
+			}
+			if err := upsertRollups(tx, traffic); err != nil {
+				return err
+			}
+		}
+		if len(conns) > 0 {
+			if err := tx.CreateInBatches(conns, 200).Error; err != nil {
+				return err
+			}
+		}
+
+		now := time.Now()
+		for key := range dirty {
+			if err := tx.Clauses(clause.OnConflict{UpdateAll: true}).Create(&ReportCursor{
+				DeviceID:  key.deviceID,
+				Stream:    key.stream,
+				LastSeq:   cursors[key],
+				UpdatedAt: now,
+			}).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return dups, err
+}
+
+// upsertRollups 把一批原始记录累加进小时表和日表（需在写入原始记录的同一事务中调用）
+func upsertRollups(tx *gorm.DB, records []TrafficRecord) error {
+	hourRows, dayRows := buildRollups(records)
+	if len(hourRows) == 0 {
+		return nil
+	}
+	if err := tx.Clauses(rollupUpsert("traffic_hourly", "hour")).CreateInBatches(hourRows, 200).Error; err != nil {
+		return err
+	}
+	return tx.Clauses(rollupUpsert("traffic_daily", "day")).CreateInBatches(dayRows, 200).Error
+}
+
+// rollupUpsert 主键冲突时把增量累加到已有行
+func rollupUpsert(table, slotColumn string) clause.OnConflict {
+	return clause.OnConflict{
+		Columns: []clause.Column{{Name: slotColumn}, {Name: "device_id"}, {Name: "node_name"}, {Name: "is_proxy"}},
+		DoUpdates: clause.Assignments(map[string]any{
+			"up_delta":   gorm.Expr(table + ".up_delta + excluded.up_delta"),
+			"down_delta": gorm.Expr(table + ".down_delta + excluded.down_delta"),
+		}),
+	}
+}
+
+func (s *gormStore) CountTraffic() (raw, hourly int64, err error) {
+	if err = s.db.Model(&TrafficRecord{}).Count(&raw).Error; err != nil {
+		return
+	}
+	err = s.db.Model(&TrafficHourly{}).Count(&hourly).Error
+	return
+}
+
+func (s *gormStore) BackfillRollups() error {
+	var batch []TrafficRecord
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		return tx.Model(&TrafficRecord{}).FindInBatches(&batch, 5000, func(_ *gorm.DB, _ int) error {
+			return upsertRollups(tx, batch)
+		}).Error
+	})
+}
+
+// ---- 流量查询 ----
+
+func (s *gormStore) TrafficSlots(tier string, q SlotQuery) ([]tsRow, error) {
+	var query *gorm.DB
+	switch tier {
+	case TierRaw:
+		query = s.db.Model(&TrafficRecord{}).
+			Select(fmt.Sprintf("(%s / %d) * %d AS slot, %s AS group_key, SUM(up_delta) AS up, SUM(down_delta) AS down", s.epochExpr("timestamp"), q.Slot, q.Slot, groupExpr(q.Group))).
+			Where("timestamp >= ? AND timestamp < ?", s.timeArg(q.From), s.timeArg(q.To))
+	case TierHourly, TierDaily:
+		var model any = &TrafficHourly{}
+		slotColumn := "hour"
+		if tier == TierDaily {
+			model, slotColumn = &TrafficDaily{}, "day"
+		}
+		query = s.db.Model(model).
+			Select(fmt.Sprintf("(%s / %d) * %d AS slot, %s AS group_key, SUM(up_delta) AS up, SUM(down_delta) AS down", slotColumn, q.Slot, q.Slot, groupExpr(q.Group))).
+			Where(slotColumn+" >= ? AND "+slotColumn+" < ?", q.From.Unix(), q.To.Unix())
+	default:
+		return nil, fmt.Errorf("未知的数据分层: %s", tier)
+	}
+	if q.Device != "" {
+		query = query.Where("device_id = ?", q.Device)
+	}
+	if q.Node != "" {
+		query = query.Where("node_name = ?", q.Node)
+	}
+
+	var rows []tsRow
+	err := query.Group("slot, group_key").Scan(&rows).Error
+	return rows, err
+}
+
+func (s *gormStore) NodeTotals(since time.Time) ([]NodeTotal, error) {
+	// PostgreSQL 要求非聚合列出现在 GROUP BY 中，is_proxy 取 bool_or / MAX 聚合
+	isProxy := "MAX(is_proxy)"
+	if s.dialect == "postgres" {
+		isProxy = "BOOL_OR(is_proxy)"
+	}
+	var rows []NodeTotal
+	err := s.db.Model(&TrafficRecord{}).
+		Select("node_name, SUM(up_delta + down_delta) AS total, "+isProxy+" AS is_proxy").
+		Where("timestamp >= ?", s.timeArg(since)).
+		Group("node_name").Order("total DESC").Scan(&rows).Error
+	return rows, err
+}
+
+func (s *gormStore) Summary(since time.Time) (TrafficSummary, error) {
+	var sum TrafficSummary
+	err := s.db.Model(&TrafficRecord{}).
+		Select(`COALESCE(SUM(CASE WHEN is_proxy THEN up_delta ELSE 0 END), 0) AS proxy_up,
+			COALESCE(SUM(CASE WHEN is_proxy THEN down_delta ELSE 0 END), 0) AS proxy_down,
+			COALESCE(SUM(CASE WHEN is_proxy THEN 0 ELSE up_delta END), 0) AS local_up,
+			COALESCE(SUM(CASE WHEN is_proxy THEN 0 ELSE down_delta END), 0) AS local_down`).
+		Where("timestamp >= ?", s.timeArg(since)).Scan(&sum).Error
+	return sum, err
+}
+
+func (s *gormStore) DeviceIDs() ([]string, error) {
+	var ids []string
+	err := s.db.Model(&TrafficRecord{}).Distinct("device_id").Where("device_id <> ?", "").Pluck("device_id", &ids).Error
+	return ids, err
+}
+
+func (s *gormStore) DeviceTrafficSince(since time.Time) ([]DeviceTraffic, error) {
+	var rows []DeviceTraffic
+	err := s.db.Model(&TrafficRecord{}).Select("device_id, SUM(up_delta) AS up, SUM(down_delta) AS down").
+		Where("timestamp >= ?", s.timeArg(since)).Group("device_id").Scan(&rows).Error
+	return rows, err
+}
+
+func (s *gormStore) DeviceTrafficTotals() ([]DeviceTraffic, error) {
+	var rows []DeviceTraffic
+	err := s.db.Model(&TrafficDaily{}).Select("device_id, SUM(up_delta) AS up, SUM(down_delta) AS down").
+		Group("device_id").Scan(&rows).Error
+	return rows, err
+}
+
+func (s *gormStore) DeviceNodeUsage(since time.Time) ([]DeviceNodeUsage, error) {
+	var rows []DeviceNodeUsage
+	err := s.db.Model(&TrafficRecord{}).Select("device_id, node_name, SUM(up_delta) AS up, SUM(down_delta) AS down").
+		Where("timestamp >= ?", s.timeArg(since)).Group("device_id, node_name").Scan(&rows).Error
+	return rows, err
+}
+
+func (s *gormStore) LatestActiveConns(deviceIDs []string, since time.Time) (map[string]int, error) {
+	result := make(map[string]int, len(deviceIDs))
+	for _, id := range deviceIDs {
+		var latest TrafficRecord
+		err := s.db.Where("device_id = ? AND timestamp >= ?", id, s.timeArg(since)).
+			Order("timestamp DESC, id DESC").Limit(1).Find(&latest).Error
+		if err != nil {
+			return nil, err
+		}
+		if latest.ID != 0 {
+			result[id] = latest.ActiveConns
+		}
+	}
+	return result, nil
+}
+
+func (s *gormStore) Connections(q ConnQuery) ([]ConnectionRecord, error) {
+	query := s.db.Model(&ConnectionRecord{})
+	if q.Device != "" {
+		query = query.Where("device_id = ?", q.Device)
+	}
+	if q.Host != "" {
+		// SQLite 的 LIKE 对 ASCII 不区分大小写，PostgreSQL 需用 ILIKE 保持一致
+		like := "LIKE"
+		if s.dialect == "postgres" {
+			like = "ILIKE"
+		}
+		query = query.Where("host "+like+" ?", "%"+q.Host+"%")
+	}
+	var records []ConnectionRecord
+	err := query.Order("end_time DESC, id DESC").Limit(q.Limit).Find(&records).Error
+	return records, err
+}
+
+func (s *gormStore) PurgeRaw(before time.Time) (traffic, conns int64, err error) {
+	result := s.db.Where("timestamp < ?", s.timeArg(before)).Delete(&TrafficRecord{})
+	if result.Error != nil {
+		return 0, 0, result.Error
+	}
+	traffic = result.RowsAffected
+	result = s.db.Where("end_time < ?", s.timeArg(before)).Delete(&ConnectionRecord{})
+	return traffic, result.RowsAffected, result.Error
+}
+
+func (s *gormStore) PurgeRollups(hourBefore, dayBefore int64) (hourly, daily int64, err error) {
+	if hourBefore > 0 {
+		result := s.db.Where("hour < ?", hourBefore).Delete(&TrafficHourly{})
+		if result.Error != nil {
+			return 0, 0, result.Error
+		}
+		hourly = result.RowsAffected
+	}
+	if dayBefore > 0 {
+		result := s.db.Where("day < ?", dayBefore).Delete(&TrafficDaily{})
+		if result.Error != nil {
+			return hourly, 0, result.Error
+		}
+		daily = result.RowsAffected
+	}
+	return hourly, daily, nil
+}
+
+// ---- 订阅快照 ----
+
+func (s *gormStore) SaveSubSnapshot(snap *SubSnapshot) error {
+	snap.Date = s.timeArg(snap.Date)
+	return s.db.Create(snap).Error
+}
+
+func (s *gormStore) LatestSubSnapshot(subURL string, before time.Time) (*SubSnapshot, error) {
+	query := s.db.Where("sub_url = ?", subURL)
+	if !before.IsZero() {
+		query = query.Where("date < ?", s.timeArg(before))
+	}
+	var snap SubSnapshot
+	if err := query.Order("date DESC, id DESC").First(&snap).Error; err != nil {
+		return nil, notFound(err)
+	}
+	return &snap, nil
+}
+
+// ---- 设备 Token ----
+
+func (s *gormStore) FindDeviceToken(hash string) (*DeviceToken, error) {
+	var dt DeviceToken
+	if err := s.db.Where("token_hash = ? AND revoked_at IS NULL", hash).First(&dt).Error; err != nil {
+		return nil, notFound(err)
+	}
+	return &dt, nil
+}
+
+func (s *gormStore) DeviceTokenRevoked(hash string) (bool, error) {
+	var n int64
+	err := s.db.Model(&DeviceToken{}).Where("token_hash = ? AND revoked_at IS NOT NULL", hash).Count(&n).Error
+	return n > 0, err
+}
+
+func (s *gormStore) TouchDeviceToken(id uint, at time.Time) error {
+	return s.db.Model(&DeviceToken{}).Where("id = ?", id).Update("last_used_at", at).Error
+}
+
+func (s *gormStore) CreateDeviceToken(dt *DeviceToken) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.FirstOrCreate(&Device{ID: dt.DeviceID}, Device{ID: dt.DeviceID}).Error; err != nil {
+			return err
+		}
+		return tx.Create(dt).Error
+	})
+}
+
+func (s *gormStore) ListDeviceTokens(deviceID string) ([]DeviceToken, error) {
+	query := s.db.Model(&DeviceToken{})
+	if deviceID != "" {
+		query = query.Where("device_id = ?", deviceID)
+	}
+	var tokens []DeviceToken
+	err := query.Order("device_id, id").Find(&tokens).Error
+	return tokens, err
+}
+
+func (s *gormStore) GetDeviceToken(id uint) (*DeviceToken, error) {
+	var dt DeviceToken
+	if err := s.db.First(&dt, id).Error; err != nil {
+		return nil, notFound(err)
+	}
+	return &dt, nil
+}
+
+func (s *gormStore) RevokeDeviceToken(id uint, at time.Time) error {
+	return s.db.Model(&DeviceToken{}).Where("id = ?", id).Update("revoked_at", at).Error
+}
+
+// ---- 设备在线状态 ----
+
+func (s *gormStore) StartDeviceSession(sess *DeviceSession) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.FirstOrCreate(&Device{ID: sess.DeviceID}, Device{ID: sess.DeviceID}).Error; err != nil {
+			return err
+		}
+		if err := tx.Create(sess).Error; err != nil {
+			return err
+		}
+		return tx.Model(&Device{}).Where("id = ?", sess.DeviceID).Updates(map[string]any{
+			"last_seen_at":   sess.StartedAt,
+			"client_version": sess.ClientVersion,
+			"last_ip":        sess.RemoteIP,
+		}).Error
+	})
+}
+
+func (s *gormStore) TouchDeviceSession(id uint, deviceID string, at time.Time) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&DeviceSession{}).Where("id = ?", id).Update("last_seen_at", at).Error; err != nil {
+			return err
+		}
+		return tx.Model(&Device{}).Where("id = ?", deviceID).Update("last_seen_at", at).Error
+	})
+}
+
+func (s *gormStore) EndDeviceSession(id uint, deviceID string, at time.Time) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&DeviceSession{}).Where("id = ?", id).
+			Updates(map[string]any{"ended_at": at, "last_seen_at": at}).Error; err != nil {
+			return err
+		}
+		return tx.Model(&Device{}).Where("id = ?", deviceID).Update("last_seen_at", at).Error
+	})
+}
+
+func (s *gormStore) SaveDeviceHello(sessionID uint, deviceID string, hello DeviceHello) error {
+	fields := map[string]any{
+		"client_version": hello.ClientVersion,
+		"os":             hello.OS,
+		"arch":           hello.Arch,
+		"mihomo_version": hello.MihomoVersion,
+		"config_hash":    hello.ConfigHash,
+	}
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		if sessionID != 0 {
+			if err := tx.Model(&DeviceSession{}).Where("id = ?", sessionID).Updates(fields).Error; err != nil {
+				return err
+			}
+		}
+		return tx.Model(&Device{}).Where("id = ?", deviceID).Updates(fields).Error
+	})
+}
+
+func (s *gormStore) SaveDeviceHeartbeat(deviceID string, hb DeviceHeartbeat) error {
+	return s.db.Model(&Device{}).Where("id = ?", deviceID).Updates(map[string]any{
+		"heartbeat_at":     hb.HeartbeatAt,
+		"mihomo_reachable": hb.MihomoReachable,
+		"queue_depth":      hb.QueueDepth,
+		"dropped":          hb.Dropped,
+		"last_seen_at":     hb.HeartbeatAt,
+	}).Error
+}
+
+func (s *gormStore) CloseStaleDeviceSessions() (int64, error) {
+	result := s.db.Model(&DeviceSession{}).Where("ended_at IS NULL").Update("ended_at", gorm.Expr("last_seen_at"))
+	return result.RowsAffected, result.Error
+}
+
+func (s *gormStore) ListDevices() ([]Device, error) {
+	var devices []Device
+	err := s.db.Order("id").Find(&devices).Error
+	return devices, err
+}
+
+func (s *gormStore) GetDevice(id string) (*Device, error) {
+	var d Device
+	if err := s.db.Where("id = ?", id).First(&d).Error; err != nil {
+		return nil, notFound(err)
+	}
+	return &d, nil
+}
+
+func (s *gormStore) SetDeviceProfile(deviceID, profile string) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.FirstOrCreate(&Device{ID: deviceID}, Device{ID: deviceID}).Error; err != nil {
+			return err
+		}
+		return tx.Model(&Device{}).Where("id = ?", deviceID).Update("profile", profile).Error
+	})
+}
+
+func (s *gormStore) ListDeviceSessions(deviceID string, limit int) ([]DeviceSession, error) {
+	var sessions []DeviceSession
+	err := s.db.Where("device_id = ?", deviceID).Order("started_at DESC").Limit(limit).Find(&sessions).Error
+	return sessions, err
+}
+
+func (s *gormStore) PurgeDeviceSessions(before time.Time) (int64, error) {
+	result := s.db.Where("ended_at IS NOT NULL AND started_at < ?", s.timeArg(before)).Delete(&DeviceSession{})
+	return result.RowsAffected, result.Error
+}
+
+// ---- 远程命令 ----
+
+func (s *gormStore) CreateDeviceCommand(cmd *DeviceCommand) error {
+	return s.db.Create(cmd).Error
+}
+
+func (s *gormStore) GetDeviceCommand(id string) (*DeviceCommand, error) {
+	var cmd DeviceCommand
+	if err := s.db.Where("id = ?", id).First(&cmd).Error; err != nil {
+		return nil, notFound(err)
+	}
+	return &cmd, nil
+}
+
+func (s *gormStore) CompleteDeviceCommand(id, deviceID, status, result, errMsg string, at time.Time) error {
+	return s.db.Model(&DeviceCommand{}).Where("id = ? AND device_id = ?", id, deviceID).Updates(map[string]any{
+		"status":      status,
+		"result":      result,
+		"error":       errMsg,
+		"finished_at": at,
+	}).Error
+}
+
+func (s *gormStore) ExpireDeviceCommand(id, status, errMsg string, at time.Time) error {
+	return s.db.Model(&DeviceCommand{}).Where("id = ? AND status = ?", id, CommandSent).Updates(map[string]any{
+		"status":      status,
+		"error":       errMsg,
+		"finished_at": at,
+	}).Error
+}
+
+func (s *gormStore) ListDeviceCommands(deviceID string, limit int) ([]DeviceCommand, error) {
+	var cmds []DeviceCommand
+	err := s.db.Where("device_id = ?", deviceID).Order("created_at DESC").Limit(limit).Find(&cmds).Error
+	return cmds, err
+}
+
+func (s *gormStore) PurgeDeviceCommands(before time.Time) (int64, error) {
+	result := s.db.Where("created_at < ?", s.timeArg(before)).Delete(&DeviceCommand{})
+	return result.RowsAffected, result.Error
+}
+
+// ---- 节点延迟 ----
+
+func (s *gormStore) SaveNodeLatency(samples []NodeLatency) error {
+	if len(samples) == 0 {
+		return nil
+	}
+	return s.db.CreateInBatches(samples, 200).Error
+}
+
+// latencyAggregates 延迟聚合列：delay 为 0 的失败测试不参与平均与极值
+const latencyAggregates = `COALESCE(SUM(CASE WHEN delay > 0 THEN delay ELSE 0 END), 0) AS delay_sum,
+	COALESCE(SUM(CASE WHEN delay > 0 THEN 1 ELSE 0 END), 0) AS ok,
+	COALESCE(SUM(CASE WHEN delay > 0 THEN 0 ELSE 1 END), 0) AS failures,
+	COALESCE(MIN(CASE WHEN delay > 0 THEN delay END), 0) AS min,
+	COALESCE(MAX(delay), 0) AS max`
+
+func (s *gormStore) LatencyStats(since time.Time) ([]LatencyStat, error) {
+	var rows []struct {
+		DeviceID, NodeName               string
+		DelaySum, OK, Failures, Min, Max int64
+	}
+	err := s.db.Model(&NodeLatency{}).
+		Select("device_id, node_name, "+latencyAggregates).
+		Where("timestamp >= ?", s.timeArg(since)).
+		Group("device_id, node_name").Order("device_id, node_name").Scan(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+	stats := make([]LatencyStat, 0, len(rows))
+	for _, r := range rows {
+		st := LatencyStat{DeviceID: r.DeviceID, NodeName: r.NodeName, Min: r.Min, Max: r.Max, Samples: r.OK + r.Failures, Failures: r.Failures}
+		if r.OK > 0 {
+			st.Avg = r.DelaySum / r.OK
+		}
+		stats = append(stats, st)
+	}
+	return stats, nil
+}
+
+func (s *gormStore) LatencySlots(q SlotQuery) ([]latencyRow, error) {
+	query := s.db.Model(&NodeLatency{}).
+		Select(fmt.Sprintf("(%s / %d) * %d AS slot, %s AS group_key, %s", s.epochExpr("timestamp"), q.Slot, q.Slot, groupExpr(q.Group), latencyAggregates)).
+		Where("timestamp >= ? AND timestamp < ?", s.timeArg(q.From), s.timeArg(q.To))
+	if q.Device != "" {
+		query = query.Where("device_id = ?", q.Device)
+	}
+	if q.Node != "" {
+		query = query.Where("node_name = ?", q.Node)
+	}
+
+	var rows []latencyRow
+	err := query.Group("slot, group_key").Scan(&rows).Error
+	return rows, err
+}
+
+func (s *gormStore) PurgeNodeLatency(before time.Time) (int64, error) {
+	result := s.db.Where("timestamp < ?", s.timeArg(before)).Delete(&NodeLatency{})
+	return result.RowsAffected, result.Error
+}
+
+// ---- 用户与会话 ----
+
+func (s *gormStore) GetUser(id uint) (*User, error) {
+	var user User
+	if err := s.db.First(&user, id).Error; err != nil {
+		return nil, notFound(err)
+	}
+	return &user, nil
+}
+
+func (s *gormStore) FindUser(username string) (*User, error) {
+	var user User
+	if err := s.db.Where("username = ?", username).First(&user).Error; err != nil {
+		return nil, notFound(err)
+	}
+	return &user, nil
+}
+
+func (s *gormStore) ListUsers() ([]User, error) {
+	var users []User
+	err := s.db.Order("id").Find(&users).Error
+	return users, err
+}
+
+func (s *gormStore) CreateUser(user *User) error {
+	return s.duplicated(s.db.Create(user).Error)
+}
+
+func (s *gormStore) UpdateUser(id uint, updates map[string]any) error {
+	return s.db.Model(&User{}).Where("id = ?", id).Updates(updates).Error
+}
+
+func (s *gormStore) DeleteUser(id uint) error {
+	return s.db.Delete(&User{}, id).Error
+}
+
+func (s *gormStore) CountUsers() (int64, error) {
+	var n int64
+	err := s.db.Model(&User{}).Count(&n).Error
+	return n, err
+}
+
+func (s *gormStore) CountAdmins(exceptID uint) (int64, error) {
+	var n int64
+	err := s.db.Model(&User{}).Where("role = ? AND id <> ?", RoleAdmin, exceptID).Count(&n).Error
+	return n, err
+}
+
+func (s *gormStore) TouchUserLogin(id uint, at time.Time) error {
+	return s.db.Model(&User{}).Where("id = ?", id).Update("last_login_at", at).Error
+}
+
+func (s *gormStore) CreateSession(session *UserSession) error {
+	return s.db.Create(session).Error
+}
+
+func (s *gormStore) GetActiveSession(id string) (*UserSession, error) {
+	var session UserSession
+	if err := s.db.Where("id = ? AND revoked_at IS NULL AND expires_at > ?", id, s.timeArg(time.Now())).First(&session).Error; err != nil {
+		return nil, notFound(err)
+	}
+	return &session, nil
+}
+
+func (s *gormStore) RevokeSession(id string, at time.Time) error {
+	return s.db.Model(&UserSession{}).Where("id = ?", id).Update("revoked_at", at).Error
+}
+
+func (s *gormStore) RevokeUserSessions(userID uint, at time.Time) error {
+	return s.db.Model(&UserSession{}).Where("user_id = ? AND revoked_at IS NULL", userID).Update("revoked_at", at).Error
+}
+
+func (s *gormStore) PurgeSessions(before time.Time) (int64, error) {
+	result := s.db.Where("expires_at < ?", s.timeArg(before)).Delete(&UserSession{})
+	return result.RowsAffected, result.Error
+}
+
+// ---- 鉴权审计 ----
+
+func (s *gormStore) CreateAuthEvent(event *AuthEvent) error {
+	return s.db.Create(event).Error
+}
+
+func (s *gormStore) ListAuthEvents(q AuthEventQuery) ([]AuthEvent, error) {
+	query := s.db.Model(&AuthEvent{})
+	if q.ClientIP != "" {
+		query = query.Where("client_ip = ?", q.ClientIP)
+	}
+	if q.Success != nil {
+		query = query.Where("success = ?", *q.Success)
+	}
+	var events []AuthEvent
+	err := query.Order("time DESC").Limit(q.Limit).Find(&events).Error
+	return events, err
+}
+
+func (s *gormStore) PurgeAuthEvents(before time.Time) (int64, error) {
+	result := s.db.Where("time < ?", s.timeArg(before)).Delete(&AuthEvent{})
+	return result.RowsAffected, result.Error
+}
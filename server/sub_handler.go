@@ -1,116 +1,26 @@
 // 动态订阅分发 Handler
 // 读取同级目录下的 *.yaml 节点模板、*.csv 规则清单和 RuleSet/ 规则集，
-// 动态拼接成完整的 Clash 配置文件，以 text/yaml 格式返回。
+// 在 subconfig.go 的文档模型上组装成完整的 Clash 配置文件，以 text/yaml 格式返回。
 
 package main
 
 import (
+	"crypto/hmac"
+	"crypto/sha256"
 	"encoding/csv"
-	"fmt"
+	"encoding/hex"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 
 	"github.com/gin-gonic/gin"
+	"gopkg.in/yaml.v3"
 )
 
-// parseYAMLSection 从 YAML 内容中提取指定顶层 key 下的完整 block（包括 key 行及其下属缩进行）。
-// 返回 key:content 形式的字符串；若 key 不存在或 block 为空则返回 ""。
-func parseYAMLSection(content, key string) string {
-	lines := strings.Split(content, "\n")
-	startLine := -1
-
-	for i, line := range lines {
-		if strings.HasPrefix(line, key+":") {
-			startLine = i
-			break
-		}
-	}
-
-	if startLine == -1 {
-		return ""
-	}
-
-	// 收集从 key 行开始、后续所有缩进行（或空行），直到遇到下一个同级 key 或文件结束
-	var blockLines []string
-	blockLines = append(blockLines, lines[startLine])
-
-	for i := startLine + 1; i < len(lines); i++ {
-		line := lines[i]
-		if line == "" {
-			blockLines = append(blockLines, line)
-			continue
-		}
-		if len(line) > 0 && line[0] != ' ' && line[0] != '\t' && strings.Contains(line, ":") {
-			break
-		}
-		blockLines = append(blockLines, line)
-	}
-
-	return strings.Join(blockLines, "\n")
-}
-
-// loadTemplateSections 读取目录下所有 *.yaml 节点模板文件，
-// 提取每个文件的 proxies 和 proxy-groups section，合并后返回。
-func loadTemplateSections(dir string) (proxies string, proxyGroups string) {
-	matches, err := filepath.Glob(filepath.Join(dir, "*.yaml"))
-	if err != nil {
-		log.Printf("[Sub] 搜索模板文件失败: %v", err)
-		return
-	}
-
-	var allProxies []string
-	var allGroups []string
-
-	for _, path := range matches {
-		baseName := filepath.Base(path)
-		// 跳过 RuleSet 目录内的文件和非节点模板
-		if strings.HasPrefix(baseName, "86") {
-			continue
-		}
-
-		data, err := os.ReadFile(path)
-		if err != nil {
-			log.Printf("[Sub] 读取模板 %s 失败: %v", baseName, err)
-			continue
-		}
-
-		content := string(data)
-		if strings.TrimSpace(content) == "" {
-			continue
-		}
-
-		sec := parseYAMLSection(content, "proxies")
-		if sec != "" {
-			// 去掉第一行（"proxies:"），只保留列表项部分
-			lines := strings.SplitN(sec, "\n", 2)
-			if len(lines) > 1 {
-				trimmed := strings.TrimSpace(lines[1])
-				if trimmed != "" {
-					allProxies = append(allProxies, lines[1])
-				}
-			}
-		}
-
-		sec = parseYAMLSection(content, "proxy-groups")
-		if sec != "" {
-			lines := strings.SplitN(sec, "\n", 2)
-			if len(lines) > 1 {
-				trimmed := strings.TrimSpace(lines[1])
-				if trimmed != "" {
-					allGroups = append(allGroups, lines[1])
-				}
-			}
-		}
-	}
-
-	proxies = strings.Join(allProxies, "\n")
-	proxyGroups = strings.Join(allGroups, "\n")
-	return
-}
-
 // CSVRule 表示 CSV 中的一条规则映射记录
 type CSVRule struct {
 	Name     string
@@ -164,186 +74,302 @@ func readCSVRules(csvPath string) (rules []CSVRule, orderedTargets []string) {
 	return
 }
 
-// loadRuleSets 读取 RuleSet/ 目录下所有 86*.yaml 规则集文件，
-// 返回 target → 文件完整内容 的映射。
-func loadRuleSets(ruleDir string) map[string]string {
-	result := make(map[string]string)
-	matches, err := filepath.Glob(filepath.Join(ruleDir, "86*.yaml"))
-	if err != nil {
-		log.Printf("[Sub] 搜索规则集失败: %v", err)
-		return result
+// handleSub 处理 GET /sub 请求，动态生成并返回 Clash 订阅配置。
+// 需要通过 ?token= 查询参数进行鉴权，token 为 ServerSetting.ini 中的 ServerToken 或未吊销的设备 Token。
+// ?profile= 指定 Profile（templates/profiles/<name>.yaml），缺省时使用 ?device= 设备保存的 Profile 或 default。
+// 能确定设备时注入 x-flow-collect 与 external-controller / secret，客户端拿到订阅即可直接上报。
+// ?rules=provider 时规则以 rule-providers 下发（缺省取 Profile 的设置，默认 inline）
+func handleSub(c *gin.Context) {
+	principal, ok := authenticateQueryToken(c, PermSubRead, true)
+	if !ok {
+		return
+	}
+	deviceID, ok := subDeviceID(c, principal)
+	if !ok {
+		return
+	}
+	profile, ok := resolveSubProfile(c, deviceID)
+	if !ok {
+		return
+	}
+	rulesMode, ok := subRulesMode(c, principal, profile)
+	if !ok {
+		return
 	}
 
-	for _, path := range matches {
-		baseName := filepath.Base(path)
-		data, err := os.ReadFile(path)
-		if err != nil {
-			log.Printf("[Sub] 读取规则集 %s 失败: %v", baseName, err)
-			continue
-		}
-		result[baseName] = string(data)
+	profileName := "-"
+	if profile != nil {
+		profileName = profile.Name
 	}
-	return result
-}
+	log.Printf("[Sub] 收到订阅请求: %s (device=%s, profile=%s, rules=%s)", c.ClientIP(), deviceID, profileName, rulesMode)
 
-// targetToFile 将 CSV 中的 target 名映射到对应的规则集文件名
-func targetToFile(target string) string {
-	switch target {
-	case "Japan":
-		return "86JPRules.yaml"
-	case "HK":
-		return "86HKRules.yaml"
-	case "US":
-		return "86USRules.yaml"
-	case "bemly":
-		return "86BemlyRules.yaml"
-	case "Switch":
-		return "86SwitchRules.yaml"
-	case "DIRECT":
-		return "86DirectRules.yaml"
-	case "REJECT":
-		return "86RejectRules.yaml"
-	default:
-		return ""
+	// 1. 基础设置，再叠加 Profile
+	cfg, err := parseSubConfig([]byte(subBaseConfig))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "基础配置无效: " + err.Error()})
+		return
+	}
+	if profile != nil {
+		profile.apply(cfg)
+	}
+	if deviceID != "" {
+		injectFlowCollect(c, cfg, principal, deviceID)
 	}
-}
 
-// handleSub 处理 GET /sub 请求，动态生成并返回 Clash 订阅配置。
-// 需要通过 ?token= 查询参数进行鉴权，token 必须匹配 ServerSetting.ini 中的 ServerToken。
-func handleSub(c *gin.Context) {
-	token := c.Query("token")
+	// 2. 合并所有节点模板的 proxies、proxy-groups 与 proxy-providers，按 Profile 筛选策略组
+	tpl := loadNodeTemplates(TemplatesDir)
+	if profile != nil && len(profile.Groups) > 0 {
+		tpl.keepGroups(profile.Groups)
+	}
+	tpl.warnDanglingRefs()
 
-	confLock.RLock()
-	expectedToken := conf.ServerToken
-	confLock.RUnlock()
+	// 3. 按 CSV 中 target 出现的顺序展开规则集，或声明为 rule-providers
+	_, orderedTargets := readCSVRules(CSVFile)
+	if profile != nil {
+		orderedTargets = profile.filterTargets(orderedTargets)
+	}
+	sets := resolveRuleSets(orderedTargets, tpl)
+	var rules []string
+	var ruleProviders []*yaml.Node
+	ruleSets := 0
+	if rulesMode == subRulesProvider {
+		rules, ruleProviders = buildRuleProviders(sets, subPublicBase(c), c.Query("token"))
+		ruleSets = len(ruleProviders) / 2
+	} else {
+		rules, ruleSets = buildSubRules(sets)
+	}
+
+	// 4. 组装文档
+	cfg.set("proxies", sequenceNode(tpl.proxies))
+	if len(tpl.providers) > 0 {
+		cfg.set("proxy-providers", &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map", Content: tpl.providers})
+	}
+	cfg.set("proxy-groups", sequenceNode(tpl.groups))
+	if len(ruleProviders) > 0 {
+		cfg.set("rule-providers", &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map", Content: ruleProviders})
+	}
+	cfg.set("rules", stringSequence(rules))
 
-	if token == "" || token != expectedToken {
-		log.Printf("[Sub] 鉴权失败: %s (token=%s)", c.ClientIP(), token)
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized: invalid or missing token"})
+	header := "FlowCollect Dynamic Subscription\nAuto-generated by server. Do not edit manually."
+	if profile != nil {
+		header += "\nProfile: " + profile.Name
+	}
+	out, err := cfg.marshal(header)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "生成订阅失败: " + err.Error()})
 		return
 	}
 
-	log.Printf("[Sub] 收到订阅请求: %s (device=%s)", c.ClientIP(), c.Query("device"))
+	// 5. 返回 YAML 响应
+	c.Data(http.StatusOK, "text/yaml; charset=utf-8", out)
+	log.Printf("[Sub] 订阅已下发: %d 个节点, %d 个策略组, %d 个规则集, %d 条规则", len(tpl.proxies), len(tpl.groups), ruleSets, len(rules))
+}
 
-	// 1. 合并所有节点模板的 proxies 和 proxy-groups
-	proxiesSection, proxyGroupsSection := loadTemplateSections(TemplatesDir)
+// subRulesMode 规则下发方式：?rules= 优先，其次 Profile 的设置，默认 inline。取值无效时已写好响应并返回 false。
+// provider 方式的规则集 url 带有本次订阅的 token，只允许设备 Token 使用，ServerToken 与控制台会话不会写进配置：
+// 显式传入 ?rules=provider 时返回 400，来自 Profile 时退回 inline，管理员仍可直接查看设备的订阅
+func subRulesMode(c *gin.Context, p *Principal, profile *subProfile) (string, bool) {
+	mode := strings.TrimSpace(c.Query("rules"))
+	switch mode {
+	case "":
+		if profile == nil || profile.Rules == "" {
+			return subRulesInline, true
+		}
+		if profile.Rules == subRulesProvider && p.Kind != "device" {
+			log.Printf("[Sub] Profile %s 使用 rules=provider，但本次不是设备 Token 拉取，改为 inline 下发", profile.Name)
+			return subRulesInline, true
+		}
+		return profile.Rules, true
+	case subRulesInline:
+		return mode, true
+	case subRulesProvider:
+		if p.Kind != "device" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "rules=provider 只能使用设备 Token 拉取，其他身份请使用 rules=inline"})
+			return "", false
+		}
+		return mode, true
+	}
+	c.JSON(http.StatusBadRequest, gin.H{"error": "rules 只能是 inline 或 provider"})
+	return "", false
+}
 
-	// 2. 读取 CSV 规则清单
-	_, orderedTargets := readCSVRules(CSVFile)
+// injectFlowCollect 写入设备的 x-flow-collect（上报地址、设备 Token、设备 ID），保留 Profile 中的其他字段（如 latency-groups）；
+// 并保证 external-controller 与 secret 存在，客户端从同一份配置读取二者访问 Mihomo。
+// 只有用设备 Token 拉取时才写入 remote-token，ServerToken 不会下发到设备上
+func injectFlowCollect(c *gin.Context, cfg *subConfig, p *Principal, deviceID string) {
+	if v := cfg.get("external-controller"); v == nil || v.Value == "" {
+		cfg.set("external-controller", scalarNode("127.0.0.1:9090"))
+	}
+	if v := cfg.get("secret"); v == nil || v.Value == "" {
+		cfg.set("secret", scalarNode(deviceControllerSecret(deviceID)))
+	}
 
-	// 3. 加载所有规则集文件
-	ruleSets := loadRuleSets(RuleDir)
-	if len(ruleSets) == 0 {
-		log.Println("[Sub] 警告: 未找到任何规则集文件，订阅将仅包含节点配置")
-	}
-
-	// 4. 构建完整的 Clash YAML 配置
-	var sb strings.Builder
-
-	// ── 基础配置 ──
-	sb.WriteString("# FlowCollect Dynamic Subscription\n")
-	sb.WriteString("# Auto-generated by server. Do not edit manually.\n\n")
-	sb.WriteString("port: 7890\n")
-	sb.WriteString("socks-port: 7891\n")
-	sb.WriteString("allow-lan: true\n")
-	sb.WriteString("mode: rule\n")
-	sb.WriteString("log-level: info\n")
-	sb.WriteString("external-controller: 127.0.0.1:9090\n\n")
-
-	// ── DNS 配置 ──
-	sb.WriteString("dns:\n")
-	sb.WriteString("  enable: true\n")
-	sb.WriteString("  listen: 0.0.0.0:53\n")
-	sb.WriteString("  enhanced-mode: fake-ip\n")
-	sb.WriteString("  fake-ip-range: 198.18.0.1/16\n")
-	sb.WriteString("  nameserver:\n")
-	sb.WriteString("    - 223.5.5.5\n")
-	sb.WriteString("    - 119.29.29.29\n")
-	sb.WriteString("  fallback:\n")
-	sb.WriteString("    - tls://8.8.8.8:853\n")
-	sb.WriteString("    - tls://1.1.1.1:853\n\n")
-
-	// ── Proxies ──
-	sb.WriteString("proxies:\n")
-	if strings.TrimSpace(proxiesSection) != "" {
-		sb.WriteString(proxiesSection)
-		if !strings.HasSuffix(proxiesSection, "\n") {
-			sb.WriteString("\n")
-		}
+	ext := cfg.get("x-flow-collect")
+	if ext == nil || ext.Kind != yaml.MappingNode {
+		ext = &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+		cfg.set("x-flow-collect", ext)
+	}
+	mappingSet(ext, "remote-server", scalarNode(subRemoteServer(c)))
+	if p.Kind == "device" {
+		mappingSet(ext, "remote-token", scalarNode(c.Query("token")))
 	} else {
-		sb.WriteString("  []\n")
+		log.Printf("[Sub] 设备 %s 的订阅未使用设备 Token 拉取，不注入 remote-token", deviceID)
 	}
-	sb.WriteString("\n")
+	mappingSet(ext, "device-id", scalarNode(deviceID))
+}
 
-	// ── Proxy Groups ──
-	sb.WriteString("proxy-groups:\n")
-	if strings.TrimSpace(proxyGroupsSection) != "" {
-		sb.WriteString(proxyGroupsSection)
-		if !strings.HasSuffix(proxyGroupsSection, "\n") {
-			sb.WriteString("\n")
-		}
+// subPublicBase 客户端访问本服务的外部地址：优先 public_url，否则取本次请求的地址（经反向代理时读取 X-Forwarded-*）
+func subPublicBase(c *gin.Context) string {
+	confLock.RLock()
+	base := conf.PublicURL
+	confLock.RUnlock()
+	if base != "" {
+		return base
 	}
-	sb.WriteString("  - name: DIRECT\n")
-	sb.WriteString("    type: select\n")
-	sb.WriteString("    proxies:\n")
-	sb.WriteString("      - DIRECT\n\n")
+	scheme, host := "http", c.Request.Host
+	if c.Request.TLS != nil {
+		scheme = "https"
+	}
+	if v := c.GetHeader("X-Forwarded-Proto"); v != "" {
+		scheme = strings.TrimSpace(strings.Split(v, ",")[0])
+	}
+	if v := c.GetHeader("X-Forwarded-Host"); v != "" {
+		host = strings.TrimSpace(strings.Split(v, ",")[0])
+	}
+	return scheme + "://" + host
+}
 
-	// ── Rules ──
-	sb.WriteString("rules:\n")
+// subRemoteServer 客户端的上报地址：subPublicBase 的 http(s) 转为 ws(s)，未带路径时指向 /ws
+func subRemoteServer(c *gin.Context) string {
+	base := subPublicBase(c)
+	u, err := url.Parse(base)
+	if err != nil {
+		return base
+	}
+	switch u.Scheme {
+	case "https":
+		u.Scheme = "wss"
+	case "http":
+		u.Scheme = "ws"
+	}
+	if u.Path == "" || u.Path == "/" {
+		u.Path = "/ws"
+	}
+	return u.String()
+}
+
+// deviceControllerSecret 设备的 Mihomo external-controller 密钥，由会话签名密钥与设备 ID 派生，每次下发保持不变
+func deviceControllerSecret(deviceID string) string {
+	mac := hmac.New(sha256.New, loadSessionKey())
+	mac.Write([]byte("controller-secret:" + deviceID))
+	return hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// 规则下发方式：inline 把规则集条目展开进 rules；provider 声明 rule-providers 指向 /templates/RuleSet/，
+// rules 中只有 RULE-SET 引用，由 Mihomo 按 interval 自行拉取更新
+const (
+	subRulesInline   = "inline"
+	subRulesProvider = "provider"
+
+	subRuleProviderInterval = 86400 // rule-providers 的更新间隔（秒）
+)
+
+// subRuleSet 一个待下发的规则集
+type subRuleSet struct {
+	Target string // 目标策略组
+	File   string // RuleDir 下的规则集文件名
+}
 
-	ruleCount := 0
-	for _, target := range orderedTargets {
-		fileName := targetToFile(target)
+// resolveRuleSets 按规则目标映射（ruletargets.go）把 target 映射为规则集文件。无法映射的 target
+// 与没有同名策略组（或内置出站）的 target 跳过（引用不存在的策略组会导致 Mihomo 拒绝加载配置）
+func resolveRuleSets(targets []string, tpl *subTemplates) []subRuleSet {
+	targetFiles := loadRuleTargets()
+	var sets []subRuleSet
+	for _, target := range targets {
+		fileName := targetFiles.file(target)
 		if fileName == "" {
-			log.Printf("[Sub] 未知 target: %s，跳过", target)
+			log.Printf("[Sub] target %s 没有规则集映射，跳过", target)
 			continue
 		}
-
-		content, ok := ruleSets[fileName]
-		if !ok {
-			log.Printf("[Sub] 规则集文件 %s 未找到，跳过 target=%s", fileName, target)
+		if !tpl.has(target) {
+			log.Printf("[Sub] ⚠️ target %s 没有同名策略组，跳过", target)
 			continue
 		}
+		sets = append(sets, subRuleSet{Target: target, File: fileName})
+	}
+	return sets
+}
 
-		sb.WriteString(fmt.Sprintf("  # === Rules for %s ===\n", target))
-		sb.WriteString(content)
-		if !strings.HasSuffix(content, "\n") {
-			sb.WriteString("\n")
+// buildSubRules 把各规则集的条目加上目标策略组，去掉重复条目（先出现的生效），末尾兜底 MATCH,DIRECT。
+// 返回规则与实际展开的规则集数
+func buildSubRules(sets []subRuleSet) ([]string, int) {
+	var rules []string
+	seen := make(map[string]bool)
+	ruleSets := 0
+	for _, set := range sets {
+		payload, err := loadRulePayload(filepath.Join(RuleDir, set.File))
+		if err != nil {
+			log.Printf("[Sub] 规则集文件 %s 读取失败，跳过 target=%s: %v", set.File, set.Target, err)
+			continue
 		}
-		sb.WriteString("\n")
-
-		ruleCount++
+		invalid := 0
+		for _, entry := range payload {
+			entry = strings.TrimSpace(entry)
+			if entry == "" || seen[entry] {
+				continue
+			}
+			seen[entry] = true
+			rule, ok := ruleWithTarget(entry, set.Target)
+			if !ok {
+				invalid++
+				continue
+			}
+			rules = append(rules, rule)
+		}
+		if invalid > 0 {
+			log.Printf("[Sub] 规则集 %s 中有 %d 条无效条目（缺少类型或值），已丢弃", set.File, invalid)
+		}
+		ruleSets++
 	}
-
-	if ruleCount == 0 {
-		sb.WriteString("  - MATCH,DIRECT\n")
+	if len(rules) == 0 {
+		log.Println("[Sub] 警告: 未找到任何规则集，订阅将仅包含节点配置")
 	}
+	return append(rules, "MATCH,DIRECT"), ruleSets
+}
 
-	// ── 附加配置 ──
-	sb.WriteString("mixed-port: 7890\n")
-	sb.WriteString("sniffing:\n")
-	sb.WriteString("  enable: true\n")
-	sb.WriteString("  sniff:\n")
-	sb.WriteString("    - TLS\n")
-	sb.WriteString("    - HTTP\n")
-
-	// 5. 返回 YAML 响应
-	c.Data(http.StatusOK, "text/yaml; charset=utf-8", []byte(sb.String()))
-	log.Printf("[Sub] 订阅已下发: %d 个模板, %d 条规则链", proxiesSection != "", ruleCount)
+// buildRuleProviders 为各规则集声明 classical 类型的 rule-provider（url 为 /templates/RuleSet/<文件>?token=），
+// rules 按规则集顺序引用：RULE-SET,<规则集名>,<目标>，末尾兜底 MATCH,DIRECT。
+// 返回规则与 rule-providers 的键值对（依次为 key、value）
+func buildRuleProviders(sets []subRuleSet, base, token string) ([]string, []*yaml.Node) {
+	var rules []string
+	var providers []*yaml.Node
+	for _, set := range sets {
+		if _, err := os.Stat(filepath.Join(RuleDir, set.File)); err != nil {
+			log.Printf("[Sub] 规则集文件 %s 不可用，跳过 target=%s: %v", set.File, set.Target, err)
+			continue
+		}
+		name := strings.TrimSuffix(set.File, filepath.Ext(set.File))
+		provider := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+		mappingSet(provider, "type", scalarNode("http"))
+		mappingSet(provider, "behavior", scalarNode("classical"))
+		mappingSet(provider, "format", scalarNode("yaml"))
+		mappingSet(provider, "url", scalarNode(base+"/templates/RuleSet/"+url.PathEscape(set.File)+"?token="+url.QueryEscape(token)))
+		mappingSet(provider, "path", scalarNode("./ruleset/"+set.File))
+		mappingSet(provider, "interval", &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!int", Value: strconv.Itoa(subRuleProviderInterval)})
+		providers = append(providers, scalarNode(name), provider)
+		rules = append(rules, "RULE-SET,"+name+","+set.Target)
+	}
+	if len(rules) == 0 {
+		log.Println("[Sub] 警告: 未找到任何规则集，订阅将仅包含节点配置")
+	}
+	return append(rules, "MATCH,DIRECT"), providers
 }
 
 // handleTemplateFile 处理 GET /templates/*filepath 请求，返回 templates 目录下的原始文件。
 // 支持 token 鉴权，用于 proxy-providers / rule-providers 拉取节点模板和规则集。
 // 示例: /templates/shanhuyun_node.yaml?token=xxx, /templates/RuleSet/86JPRules.yaml?token=xxx
 func handleTemplateFile(c *gin.Context) {
-	token := c.Query("token")
-
-	confLock.RLock()
-	expectedToken := conf.ServerToken
-	confLock.RUnlock()
-
-	if token == "" || token != expectedToken {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized: invalid or missing token"})
+	if _, ok := authenticateQueryToken(c, PermSubRead, false); !ok {
 		return
 	}
 
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestSubRulesMode(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	device := &Principal{Kind: "device", DeviceID: "phone"}
+	master := &Principal{Kind: "master"}
+	provider := &subProfile{Name: "router", Rules: subRulesProvider}
+
+	tests := []struct {
+		name     string
+		query    string
+		p        *Principal
+		profile  *subProfile
+		want     string
+		wantCode int // 0 表示未写出响应
+	}{
+		{"默认 inline", "", master, nil, subRulesInline, 0},
+		{"Profile 未设置", "", master, &subProfile{Name: "desktop"}, subRulesInline, 0},
+		{"设备使用 Profile 的 provider", "", device, provider, subRulesProvider, 0},
+		{"其他身份的 Profile provider 退回 inline", "", master, provider, subRulesInline, 0},
+		{"查询参数优先于 Profile", "rules=inline", device, provider, subRulesInline, 0},
+		{"设备显式 provider", "rules=provider", device, nil, subRulesProvider, 0},
+		{"其他身份显式 provider", "rules=provider", master, nil, "", http.StatusBadRequest},
+		{"无效取值", "rules=remote", device, nil, "", http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+			c.Request = httptest.NewRequest(http.MethodGet, "/sub?"+tt.query, nil)
+
+			got, ok := subRulesMode(c, tt.p, tt.profile)
+			if got != tt.want || ok != (tt.wantCode == 0) {
+				t.Errorf("subRulesMode() = %q, %v, 期望 %q", got, ok, tt.want)
+			}
+			if tt.wantCode != 0 && w.Code != tt.wantCode {
+				t.Errorf("状态码 = %d, 期望 %d", w.Code, tt.wantCode)
+			}
+		})
+	}
+}
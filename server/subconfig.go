@@ -0,0 +1,404 @@
+// 订阅配置模型：以 yaml.Node 表示 Mihomo 配置文档，解析节点模板、合并节点与策略组（检测重名）、
+// 把规则集 payload 转为带目标的规则，最后整体序列化，保证下发的始终是合法 YAML
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// subBaseConfig 订阅的基础设置。端口只使用 mixed-port（HTTP + SOCKS），不再同时声明同端口的 port
+const subBaseConfig = `mixed-port: 7890
+socks-port: 7891
+allow-lan: true
+mode: rule
+log-level: info
+external-controller: 127.0.0.1:9090
+dns:
+  enable: true
+  listen: 0.0.0.0:53
+  enhanced-mode: fake-ip
+  fake-ip-range: 198.18.0.1/16
+  nameserver:
+    - 223.5.5.5
+    - 119.29.29.29
+  fallback:
+    - tls://8.8.8.8:853
+    - tls://1.1.1.1:853
+sniffer:
+  enable: true
+  sniff:
+    HTTP:
+      ports: [80, 8080-8880]
+    TLS:
+      ports: [443, 8443]
+`
+
+// builtinOutbounds Mihomo 内置的出站名，节点与策略组不能与之重名
+var builtinOutbounds = map[string]bool{
+	"DIRECT": true, "REJECT": true, "REJECT-DROP": true, "PASS": true, "COMPATIBLE": true,
+}
+
+// subConfig 一份 Mihomo 配置文档（顶层为 mapping，键保持插入顺序）
+type subConfig struct {
+	doc  *yaml.Node
+	root *yaml.Node
+}
+
+// parseSubConfig 解析配置文档，空文档视为空 mapping
+func parseSubConfig(data []byte) (*subConfig, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	if doc.Kind == 0 {
+		doc = yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{{Kind: yaml.MappingNode, Tag: "!!map"}}}
+	}
+	if doc.Kind != yaml.DocumentNode || len(doc.Content) == 0 || doc.Content[0].Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("根节点不是 mapping")
+	}
+	return &subConfig{doc: &doc, root: doc.Content[0]}, nil
+}
+
+func (c *subConfig) get(key string) *yaml.Node {
+	return mappingGet(c.root, key)
+}
+
+// set 设置顶层键，已存在时原位替换，否则追加到末尾
+func (c *subConfig) set(key string, value *yaml.Node) {
+	mappingSet(c.root, key, value)
+}
+
+// marshal 序列化为 YAML，header 作为文档头注释
+func (c *subConfig) marshal(header string) ([]byte, error) {
+	c.doc.HeadComment = header
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(c.doc); err != nil {
+		return nil, err
+	}
+	if err := enc.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func mappingGet(m *yaml.Node, key string) *yaml.Node {
+	if m == nil || m.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(m.Content); i += 2 {
+		if m.Content[i].Value == key {
+			return m.Content[i+1]
+		}
+	}
+	return nil
+}
+
+func mappingSet(m *yaml.Node, key string, value *yaml.Node) {
+	for i := 0; i+1 < len(m.Content); i += 2 {
+		if m.Content[i].Value == key {
+			m.Content[i+1] = value
+			return
+		}
+	}
+	m.Content = append(m.Content, scalarNode(key), value)
+}
+
+func mappingDelete(m *yaml.Node, key string) {
+	for i := 0; i+1 < len(m.Content); i += 2 {
+		if m.Content[i].Value == key {
+			m.Content = append(m.Content[:i], m.Content[i+2:]...)
+			return
+		}
+	}
+}
+
+func scalarNode(v string) *yaml.Node {
+	return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: v}
+}
+
+func sequenceNode(items []*yaml.Node) *yaml.Node {
+	n := &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq", Content: items}
+	if len(items) == 0 {
+		n.Style = yaml.FlowStyle // 输出 []
+	}
+	return n
+}
+
+func stringSequence(values []string) *yaml.Node {
+	items := make([]*yaml.Node, 0, len(values))
+	for _, v := range values {
+		items = append(items, scalarNode(v))
+	}
+	return sequenceNode(items)
+}
+
+// resolveNode 深拷贝节点并展开别名与合并键（<<），使节点脱离原文档后仍然完整：
+// 模板里的锚点往往定义在不会被复制的顶层键下，直接复制别名会产生悬空引用
+func resolveNode(n *yaml.Node) *yaml.Node {
+	if n == nil {
+		return nil
+	}
+	if n.Kind == yaml.AliasNode {
+		return resolveNode(n.Alias)
+	}
+	out := *n
+	out.Anchor = ""
+	out.Content = nil
+	if n.Kind != yaml.MappingNode {
+		for _, child := range n.Content {
+			out.Content = append(out.Content, resolveNode(child))
+		}
+		return &out
+	}
+
+	// 先收集显式键，再用合并来源补齐缺失的键（显式键优先）
+	var merges []*yaml.Node
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		if n.Content[i].Value == "<<" && n.Content[i].Tag == "!!merge" {
+			merges = append(merges, n.Content[i+1])
+			continue
+		}
+		out.Content = append(out.Content, resolveNode(n.Content[i]), resolveNode(n.Content[i+1]))
+	}
+	for _, m := range merges {
+		src := resolveNode(m)
+		sources := []*yaml.Node{src}
+		if src.Kind == yaml.SequenceNode {
+			sources = src.Content
+		}
+		for _, s := range sources {
+			for i := 0; i+1 < len(s.Content); i += 2 {
+				if mappingGet(&out, s.Content[i].Value) == nil {
+					out.Content = append(out.Content, s.Content[i], s.Content[i+1])
+				}
+			}
+		}
+	}
+	return &out
+}
+
+// nodeName 返回节点 / 策略组的 name 字段
+func nodeName(n *yaml.Node) string {
+	if v := mappingGet(n, "name"); v != nil && v.Kind == yaml.ScalarNode {
+		return strings.TrimSpace(v.Value)
+	}
+	return ""
+}
+
+// subTemplates 从节点模板中合并出的节点、代理集合与策略组
+type subTemplates struct {
+	proxies   []*yaml.Node
+	groups    []*yaml.Node
+	providers []*yaml.Node      // proxy-providers 的键值对，依次为 key、value
+	names     map[string]string // 节点 / 策略组 / 代理集合名 → 来源文件
+}
+
+func newSubTemplates() *subTemplates {
+	return &subTemplates{names: make(map[string]string)}
+}
+
+// claim 登记名称，与内置出站或已有名称重复时返回 false 并记录日志（先出现的保留）
+func (t *subTemplates) claim(kind, name, source string) bool {
+	if name == "" {
+		log.Printf("[Sub] %s 中有缺少 name 的%s，已跳过", source, kind)
+		return false
+	}
+	if builtinOutbounds[name] {
+		log.Printf("[Sub] %s 中的%s %q 与内置出站重名，已跳过", source, kind, name)
+		return false
+	}
+	if prev, ok := t.names[name]; ok {
+		log.Printf("[Sub] %s 中的%s %q 与 %s 中的重名，保留先出现的", source, kind, name, prev)
+		return false
+	}
+	t.names[name] = source
+	return true
+}
+
+// add 合并一份模板中的 proxies、proxy-groups 与 proxy-providers
+func (t *subTemplates) add(cfg *subConfig, source string) {
+	if seq := cfg.get("proxies"); seq != nil && seq.Kind == yaml.SequenceNode {
+		for _, p := range seq.Content {
+			p = resolveNode(p)
+			if p.Kind == yaml.MappingNode && t.claim("节点", nodeName(p), source) {
+				t.proxies = append(t.proxies, p)
+			}
+		}
+	}
+	if seq := cfg.get("proxy-groups"); seq != nil && seq.Kind == yaml.SequenceNode {
+		for _, g := range seq.Content {
+			g = resolveNode(g)
+			if g.Kind == yaml.MappingNode && t.claim("策略组", nodeName(g), source) {
+				t.groups = append(t.groups, g)
+			}
+		}
+	}
+	if m := cfg.get("proxy-providers"); m != nil && m.Kind == yaml.MappingNode {
+		m = resolveNode(m)
+		for i := 0; i+1 < len(m.Content); i += 2 {
+			// 代理集合与节点不在同一命名空间，只检查集合之间的重名
+			key := "provider:" + m.Content[i].Value
+			if prev, ok := t.names[key]; ok {
+				log.Printf("[Sub] %s 中的代理集合 %q 与 %s 中的重名，保留先出现的", source, m.Content[i].Value, prev)
+				continue
+			}
+			t.names[key] = source
+			t.providers = append(t.providers, m.Content[i], m.Content[i+1])
+		}
+	}
+}
+
+// has 名称是否为已合并的节点 / 策略组或内置出站
+func (t *subTemplates) has(name string) bool {
+	_, ok := t.names[name]
+	return ok || builtinOutbounds[name]
+}
+
+// keepGroups 只保留 names 中列出的策略组，其余策略组连同剩余策略组中对它们的引用一并移除
+func (t *subTemplates) keepGroups(names []string) {
+	keep := make(map[string]bool, len(names))
+	for _, n := range names {
+		keep[n] = true
+	}
+	dropped := make(map[string]bool)
+	kept := t.groups[:0]
+	for _, g := range t.groups {
+		name := nodeName(g)
+		if keep[name] {
+			kept = append(kept, g)
+			delete(keep, name)
+			continue
+		}
+		dropped[name] = true
+		delete(t.names, name)
+	}
+	t.groups = kept
+	for _, name := range names {
+		if keep[name] {
+			log.Printf("[Sub] ⚠️ Profile 中的策略组 %q 不存在", name)
+		}
+	}
+
+	for _, g := range t.groups {
+		seq := mappingGet(g, "proxies")
+		if seq == nil {
+			continue
+		}
+		refs := seq.Content[:0]
+		for _, ref := range seq.Content {
+			if !dropped[ref.Value] {
+				refs = append(refs, ref)
+			}
+		}
+		seq.Content = refs
+	}
+}
+
+// loadNodeTemplates 解析 dir 下的节点模板（*.yaml，跳过 86 开头的规则集），按文件名顺序合并
+func loadNodeTemplates(dir string) *subTemplates {
+	t := newSubTemplates()
+	matches, err := filepath.Glob(filepath.Join(dir, "*.yaml"))
+	if err != nil {
+		log.Printf("[Sub] 搜索模板文件失败: %v", err)
+		return t
+	}
+
+	for _, path := range matches {
+		baseName := filepath.Base(path)
+		if strings.HasPrefix(baseName, "86") {
+			continue
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			log.Printf("[Sub] 读取模板 %s 失败: %v", baseName, err)
+			continue
+		}
+		cfg, err := parseSubConfig(data)
+		if err != nil {
+			log.Printf("[Sub] 解析模板 %s 失败，已跳过: %v", baseName, err)
+			continue
+		}
+		t.add(cfg, baseName)
+	}
+	return t
+}
+
+// warnDanglingRefs 记录策略组中引用了不存在的节点 / 策略组 / 代理集合的情况（Mihomo 加载时会报错）
+func (t *subTemplates) warnDanglingRefs() {
+	for _, g := range t.groups {
+		if seq := mappingGet(g, "proxies"); seq != nil {
+			for _, ref := range seq.Content {
+				if !t.has(ref.Value) {
+					log.Printf("[Sub] ⚠️ 策略组 %q 引用了不存在的节点或策略组 %q", nodeName(g), ref.Value)
+				}
+			}
+		}
+		if seq := mappingGet(g, "use"); seq != nil {
+			for _, ref := range seq.Content {
+				if _, ok := t.names["provider:"+ref.Value]; !ok {
+					log.Printf("[Sub] ⚠️ 策略组 %q 引用了不存在的代理集合 %q", nodeName(g), ref.Value)
+				}
+			}
+		}
+	}
+}
+
+// loadRulePayload 读取规则集文件（payload 列表）
+func loadRulePayload(path string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var rs struct {
+		Payload []string `yaml:"payload"`
+	}
+	if err := yaml.Unmarshal(data, &rs); err != nil {
+		return nil, err
+	}
+	return rs.Payload, nil
+}
+
+// ruleWithTarget 为规则集条目加上目标策略组：DOMAIN-SUFFIX,a.com → DOMAIN-SUFFIX,a.com,Target。
+// no-resolve / src 等附加参数必须位于目标之后；AND / OR / NOT 逻辑规则的目标紧跟在最后一个括号之后。
+// 条目缺少类型或值（如 "DOMAIN-SUFFIX,"）时返回 false，由调用方丢弃
+func ruleWithTarget(entry, target string) (string, bool) {
+	entry = strings.TrimSpace(entry)
+	if isLogicRule(entry) {
+		i := strings.LastIndex(entry, ")")
+		if i < 0 {
+			return "", false
+		}
+		return entry[:i+1] + "," + target + entry[i+1:], true
+	}
+	parts := strings.Split(entry, ",")
+	for i := range parts {
+		parts[i] = strings.TrimSpace(parts[i])
+	}
+	if len(parts) < 2 || parts[0] == "" || parts[1] == "" {
+		return "", false
+	}
+	n := len(parts)
+	for n > 2 && (parts[n-1] == "no-resolve" || parts[n-1] == "src") {
+		n--
+	}
+	out := append([]string{}, parts[:n]...)
+	out = append(out, target)
+	out = append(out, parts[n:]...)
+	return strings.Join(out, ","), true
+}
+
+// isLogicRule 是否为 AND / OR / NOT 逻辑规则。只看前缀：普通规则的值里也可能出现括号（如 DOMAIN-REGEX）
+func isLogicRule(entry string) bool {
+	upper := strings.ToUpper(entry)
+	return strings.HasPrefix(upper, "AND,") || strings.HasPrefix(upper, "OR,") || strings.HasPrefix(upper, "NOT,")
+}
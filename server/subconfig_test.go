@@ -0,0 +1,228 @@
+package main
+
+import (
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestRuleWithTarget(t *testing.T) {
+	tests := []struct {
+		name   string
+		entry  string
+		want   string
+		wantOK bool
+	}{
+		{"普通规则", "DOMAIN-SUFFIX,a.com", "DOMAIN-SUFFIX,a.com,Proxy", true},
+		{"去除空白", "  DOMAIN , a.com ", "DOMAIN,a.com,Proxy", true},
+		{"no-resolve 位于目标之后", "IP-CIDR,10.0.0.0/8,no-resolve", "IP-CIDR,10.0.0.0/8,Proxy,no-resolve", true},
+		{"src 与 no-resolve", "IP-CIDR,10.0.0.0/8,src,no-resolve", "IP-CIDR,10.0.0.0/8,Proxy,src,no-resolve", true},
+		{"DOMAIN-REGEX 中的括号不视为逻辑规则", "DOMAIN-REGEX,^(www|api)\\.a\\.com$", "DOMAIN-REGEX,^(www|api)\\.a\\.com$,Proxy", true},
+		{"AND 逻辑规则", "AND,((DOMAIN,a.com),(NETWORK,UDP))", "AND,((DOMAIN,a.com),(NETWORK,UDP)),Proxy", true},
+		{"小写 or 逻辑规则", "or,((DOMAIN,a.com),(DOMAIN,b.com))", "or,((DOMAIN,a.com),(DOMAIN,b.com)),Proxy", true},
+		{"NOT 逻辑规则的附加参数", "NOT,((IP-CIDR,10.0.0.0/8)),no-resolve", "NOT,((IP-CIDR,10.0.0.0/8)),Proxy,no-resolve", true},
+		{"逻辑规则缺少括号", "AND,DOMAIN", "", false},
+		{"缺少值", "DOMAIN-SUFFIX,", "", false},
+		{"值为空白", "DOMAIN-SUFFIX,  ,no-resolve", "", false},
+		{"缺少类型", ",a.com", "", false},
+		{"只有类型", "MATCH", "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := ruleWithTarget(tt.entry, "Proxy")
+			if got != tt.want || ok != tt.wantOK {
+				t.Errorf("ruleWithTarget(%q) = %q, %v, 期望 %q, %v", tt.entry, got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+func mustParseSubConfig(t *testing.T, data string) *subConfig {
+	t.Helper()
+	cfg, err := parseSubConfig([]byte(data))
+	if err != nil {
+		t.Fatalf("parseSubConfig: %v", err)
+	}
+	return cfg
+}
+
+// marshalTemplates 把收集到的节点、策略组与代理集合写入空配置后序列化
+func marshalTemplates(t *testing.T, tp *subTemplates) string {
+	t.Helper()
+	out := mustParseSubConfig(t, "")
+	out.set("proxies", sequenceNode(tp.proxies))
+	out.set("proxy-groups", sequenceNode(tp.groups))
+	out.set("proxy-providers", &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map", Content: tp.providers})
+	data, err := out.marshal("")
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	return string(data)
+}
+
+// 锚点、合并键（单个与列表）、流式写法与重名条目
+const (
+	templateA = `x-common: &common
+  type: ss
+  cipher: aes-128-gcm
+x-tls: &tls {tls: true, skip-cert-verify: false}
+proxies:
+  - <<: *common
+    name: HK
+    server: hk.example.com
+    port: 443
+  - {name: JP, <<: [*common, *tls], server: jp.example.com, type: vmess}
+  - name: DIRECT
+    type: ss
+  - name: HK
+    type: vmess
+  - type: ss
+proxy-groups:
+  - name: Auto
+    type: url-test
+    proxies: [HK, JP]
+  - &sel
+    name: Select
+    type: select
+    proxies:
+      - Auto
+      - HK
+proxy-providers:
+  airport:
+    type: http
+    url: https://a.example.com/sub
+`
+	templateB = `proxies:
+  - {name: JP, type: trojan}
+  - {name: SG, type: trojan}
+proxy-groups:
+  - {name: Auto, type: select, proxies: [SG]}
+  - {name: Media, type: select, proxies: [Select, SG, Auto]}
+proxy-providers:
+  airport: {type: file}
+  backup: {type: file, path: ./b.yaml}
+`
+)
+
+func TestSubTemplatesAdd(t *testing.T) {
+	tp := newSubTemplates()
+	tp.add(mustParseSubConfig(t, templateA), "a.yaml")
+	tp.add(mustParseSubConfig(t, templateB), "b.yaml")
+
+	// 合并键展开后显式写出的键在前；重名的节点、策略组、代理集合保留先出现的；与内置出站重名及缺少 name 的节点被跳过
+	want := `proxies:
+  - name: HK
+    server: hk.example.com
+    port: 443
+    type: ss
+    cipher: aes-128-gcm
+  - {name: JP, server: jp.example.com, type: vmess, cipher: aes-128-gcm, tls: true, skip-cert-verify: false}
+  - {name: SG, type: trojan}
+proxy-groups:
+  - name: Auto
+    type: url-test
+    proxies: [HK, JP]
+  - name: Select
+    type: select
+    proxies:
+      - Auto
+      - HK
+  - {name: Media, type: select, proxies: [Select, SG, Auto]}
+proxy-providers:
+  airport:
+    type: http
+    url: https://a.example.com/sub
+  backup: {type: file, path: ./b.yaml}
+`
+	if got := marshalTemplates(t, tp); got != want {
+		t.Errorf("输出 =\n%s\n期望\n%s", got, want)
+	}
+	for _, name := range []string{"HK", "JP", "SG", "Auto", "Select", "Media", "DIRECT"} {
+		if !tp.has(name) {
+			t.Errorf("has(%q) = false", name)
+		}
+	}
+	// 代理集合与节点不在同一命名空间
+	if tp.has("airport") {
+		t.Error("代理集合名不应被当作节点或策略组")
+	}
+}
+
+func TestSubTemplatesKeepGroups(t *testing.T) {
+	tests := []struct {
+		name string
+		keep []string
+		want string // 保留下来的 proxy-groups 部分
+	}{
+		{
+			"只保留指定的组，引用被删除组的条目一并去掉",
+			[]string{"Media", "Auto", "Missing"},
+			`proxy-groups:
+  - name: Auto
+    type: url-test
+    proxies: [HK, JP]
+  - {name: Media, type: select, proxies: [SG, Auto]}
+`,
+		},
+		{
+			"保留被引用的组",
+			[]string{"Select"},
+			`proxy-groups:
+  - name: Select
+    type: select
+    proxies:
+      - HK
+`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tp := newSubTemplates()
+			tp.add(mustParseSubConfig(t, templateA), "a.yaml")
+			tp.add(mustParseSubConfig(t, templateB), "b.yaml")
+			tp.keepGroups(tt.keep)
+
+			out := mustParseSubConfig(t, "")
+			out.set("proxy-groups", sequenceNode(tp.groups))
+			data, err := out.marshal("")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != tt.want {
+				t.Errorf("输出 =\n%s\n期望\n%s", data, tt.want)
+			}
+		})
+	}
+}
+
+func TestResolveNode(t *testing.T) {
+	cfg := mustParseSubConfig(t, `base: &base {a: 1, b: [x, y]}
+extra: &extra {b: [z], c: 3}
+alias: *base
+merged:
+  <<: [*base, *extra]
+  a: 0
+`)
+	tests := []struct {
+		key  string
+		want string
+	}{
+		{"alias", "{a: 1, b: [x, y]}\n"},
+		// 显式的键优先，列表中靠前的合并源优先
+		{"merged", "a: 0\nb: [x, y]\nc: 3\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.key, func(t *testing.T) {
+			data, err := yaml.Marshal(resolveNode(cfg.get(tt.key)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != tt.want {
+				t.Errorf("resolveNode(%s) =\n%s期望\n%s", tt.key, data, tt.want)
+			}
+		})
+	}
+}
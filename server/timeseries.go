@@ -0,0 +1,265 @@
+// 历史流量时间序列查询：任意时间范围、可选桶宽与分组维度，也可查询节点延迟序列
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const tsMaxBuckets = 2000 // 单次查询最多返回的桶数
+
+// tsRow 数据库按细粒度（分钟 / 15 分钟 / 小时）预聚合后的一行
+type tsRow struct {
+	Slot     int64 // 细粒度时间槽的起始 Unix 秒
+	GroupKey string
+	Up       int64
+	Down     int64
+}
+
+// tsSeries 一个分组的序列，Up/Down 与响应中的 buckets 一一对应
+type tsSeries struct {
+	Key       string  `json:"key"`
+	Up        []int64 `json:"up"`
+	Down      []int64 `json:"down"`
+	TotalUp   int64   `json:"total_up"`
+	TotalDown int64   `json:"total_down"`
+}
+
+// bucketStart 返回 t 所在桶的起始时间（按 loc 计算日 / 周 / 月边界，周以周一为起点）
+func bucketStart(t time.Time, bucket string, loc *time.Location) time.Time {
+	t = t.In(loc)
+	switch bucket {
+	case "minute":
+		return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), 0, 0, loc)
+	case "hour":
+		return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), 0, 0, 0, loc)
+	case "day":
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, loc)
+	case "week":
+		offset := (int(t.Weekday()) + 6) % 7
+		return time.Date(t.Year(), t.Month(), t.Day()-offset, 0, 0, 0, 0, loc)
+	case "month":
+		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, loc)
+	}
+	return t
+}
+
+// nextBucket 返回下一个桶的起始时间
+func nextBucket(start time.Time, bucket string) time.Time {
+	switch bucket {
+	case "minute":
+		return start.Add(time.Minute)
+	case "hour":
+		return start.Add(time.Hour)
+	case "day":
+		return start.AddDate(0, 0, 1)
+	case "week":
+		return start.AddDate(0, 0, 7)
+	case "month":
+		return start.AddDate(0, 1, 0)
+	}
+	return start
+}
+
+// slotSeconds 选择数据库预聚合的粒度：分钟桶按分钟；其余按小时，
+// 时区偏移不是整小时（如 +05:30）时退到 15 分钟，保证细粒度槽不会跨越桶边界
+func slotSeconds(bucket string, from time.Time, loc *time.Location) int64 {
+	if bucket == "minute" {
+		return 60
+	}
+	if _, offset := from.In(loc).Zone(); offset%3600 != 0 {
+		return 900
+	}
+	return 3600
+}
+
+// parseTimeParam 解析时间参数：Unix 秒、RFC3339、"2006-01-02 15:04" 或 "2006-01-02"（后两者按 loc 解释）
+func parseTimeParam(s string, loc *time.Location) (time.Time, error) {
+	if sec, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(sec, 0), nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	for _, layout := range []string{"2006-01-02 15:04", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, s, loc); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("无法解析时间: %s", s)
+}
+
+// validGroup 是否为支持的分组维度
+func validGroup(group string) bool {
+	switch group {
+	case "", "none", "device", "node", "proxy":
+		return true
+	}
+	return false
+}
+
+// handleGetTimeseries GET /api/timeseries
+// 参数：from / to（默认最近 24 小时）、bucket（minute/hour/day/week/month，默认 hour）、
+// group（device/node/proxy，默认不分组）、device / node（可选过滤）、
+// metric（traffic 默认；latency 返回节点延迟，只保留原始保留期内的数据，group 仅支持 device/node）
+func handleGetTimeseries(c *gin.Context) {
+	loc := reportLocation()
+
+	to := time.Now()
+	if s := c.Query("to"); s != "" {
+		t, err := parseTimeParam(s, loc)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		to = t
+	}
+	from := to.Add(-24 * time.Hour)
+	if s := c.Query("from"); s != "" {
+		t, err := parseTimeParam(s, loc)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		from = t
+	}
+	if !from.Before(to) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "from 必须早于 to"})
+		return
+	}
+
+	bucket := c.DefaultQuery("bucket", "hour")
+	switch bucket {
+	case "minute", "hour", "day", "week", "month":
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "bucket 仅支持 minute/hour/day/week/month"})
+		return
+	}
+	group := c.Query("group")
+	if !validGroup(group) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "group 仅支持 device/node/proxy"})
+		return
+	}
+	metric := c.DefaultQuery("metric", "traffic")
+	switch {
+	case metric == "latency" && group == "proxy":
+		c.JSON(http.StatusBadRequest, gin.H{"error": "延迟序列的 group 仅支持 device/node"})
+		return
+	case metric != "traffic" && metric != "latency":
+		c.JSON(http.StatusBadRequest, gin.H{"error": "metric 仅支持 traffic/latency"})
+		return
+	}
+
+	// 桶边界：第一个桶从 from 所在桶的起点开始，覆盖到 to
+	var starts []time.Time
+	for t := bucketStart(from, bucket, loc); t.Before(to); t = nextBucket(t, bucket) {
+		starts = append(starts, t)
+		if len(starts) > tsMaxBuckets {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("桶数量超过上限 %d，请缩小范围或增大 bucket", tsMaxBuckets)})
+			return
+		}
+	}
+	rangeStart := starts[0]
+	rangeEnd := nextBucket(starts[len(starts)-1], bucket)
+	buckets := make([]int64, len(starts))
+	for i, t := range starts {
+		buckets[i] = t.Unix()
+	}
+	q := SlotQuery{
+		From:   rangeStart,
+		To:     rangeEnd,
+		Slot:   slotSeconds(bucket, rangeStart, loc),
+		Group:  group,
+		Device: c.Query("device"),
+		Node:   c.Query("node"),
+	}
+
+	if metric == "latency" {
+		rows, err := store.LatencySlots(q)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"metric":   metric,
+			"from":     rangeStart.Unix(),
+			"to":       rangeEnd.Unix(),
+			"bucket":   bucket,
+			"group":    group,
+			"timezone": loc.String(),
+			"buckets":  buckets,
+			"series":   foldLatency(rows, starts),
+		})
+		return
+	}
+
+	rows, err := queryTrafficSlots(q)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	// 细粒度槽折叠到桶：starts 递增，二分查找槽所在的桶
+	seriesMap := make(map[string]*tsSeries)
+	var keys []string
+	for _, r := range rows {
+		at := time.Unix(r.Slot, 0)
+		idx := searchBucket(starts, at)
+		if idx < 0 {
+			continue
+		}
+		s, ok := seriesMap[r.GroupKey]
+		if !ok {
+			s = &tsSeries{Key: r.GroupKey, Up: make([]int64, len(starts)), Down: make([]int64, len(starts))}
+			seriesMap[r.GroupKey] = s
+			keys = append(keys, r.GroupKey)
+		}
+		s.Up[idx] += r.Up
+		s.Down[idx] += r.Down
+		s.TotalUp += r.Up
+		s.TotalDown += r.Down
+	}
+
+	series := make([]*tsSeries, 0, len(keys))
+	for _, k := range keys {
+		series = append(series, seriesMap[k])
+	}
+	// 按总流量降序，图例中流量大的分组排在前面
+	sort.Slice(series, func(i, j int) bool {
+		return series[i].TotalUp+series[i].TotalDown > series[j].TotalUp+series[j].TotalDown
+	})
+
+	c.JSON(http.StatusOK, gin.H{
+		"metric":   metric,
+		"from":     rangeStart.Unix(),
+		"to":       rangeEnd.Unix(),
+		"bucket":   bucket,
+		"group":    group,
+		"timezone": loc.String(),
+		"buckets":  buckets,
+		"series":   series,
+	})
+}
+
+// searchBucket 返回 at 所在桶的下标，不在范围内时返回 -1
+func searchBucket(starts []time.Time, at time.Time) int {
+	lo, hi := 0, len(starts)-1
+	if at.Before(starts[0]) {
+		return -1
+	}
+	for lo < hi {
+		mid := (lo + hi + 1) / 2
+		if starts[mid].After(at) {
+			hi = mid - 1
+		} else {
+			lo = mid
+		}
+	}
+	return lo
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func mustLoadLocation(t *testing.T, name string) *time.Location {
+	t.Helper()
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		t.Skipf("缺少时区数据 %s: %v", name, err)
+	}
+	return loc
+}
+
+func TestBucketStart(t *testing.T) {
+	shanghai := mustLoadLocation(t, "Asia/Shanghai")
+	kolkata := mustLoadLocation(t, "Asia/Kolkata")
+	newYork := mustLoadLocation(t, "America/New_York")
+
+	tests := []struct {
+		name   string
+		at     time.Time
+		bucket string
+		loc    *time.Location
+		want   time.Time
+	}{
+		{"分钟", time.Date(2026, 10, 18, 9, 41, 59, 999, shanghai), "minute", shanghai, time.Date(2026, 10, 18, 9, 41, 0, 0, shanghai)},
+		{"小时", time.Date(2026, 10, 18, 9, 41, 0, 0, shanghai), "hour", shanghai, time.Date(2026, 10, 18, 9, 0, 0, 0, shanghai)},
+		{"非整小时时区按本地小时对齐", time.Date(2026, 10, 18, 5, 20, 0, 0, time.UTC), "hour", kolkata, time.Date(2026, 10, 18, 10, 0, 0, 0, kolkata)},
+		{"天按报表时区而不是 UTC", time.Date(2026, 10, 17, 20, 0, 0, 0, time.UTC), "day", shanghai, time.Date(2026, 10, 18, 0, 0, 0, 0, shanghai)},
+		{"周日归入前一个周一", time.Date(2026, 10, 18, 23, 59, 0, 0, shanghai), "week", shanghai, time.Date(2026, 10, 12, 0, 0, 0, 0, shanghai)},
+		{"周一即为起点", time.Date(2026, 10, 12, 0, 0, 0, 0, shanghai), "week", shanghai, time.Date(2026, 10, 12, 0, 0, 0, 0, shanghai)},
+		{"跨年的周", time.Date(2027, 1, 1, 12, 0, 0, 0, shanghai), "week", shanghai, time.Date(2026, 12, 28, 0, 0, 0, 0, shanghai)},
+		{"月末", time.Date(2026, 1, 31, 23, 59, 59, 0, shanghai), "month", shanghai, time.Date(2026, 1, 1, 0, 0, 0, 0, shanghai)},
+		{"夏令时开始当天的小时", time.Date(2026, 3, 8, 3, 30, 0, 0, newYork), "hour", newYork, time.Date(2026, 3, 8, 3, 0, 0, 0, newYork)},
+		{"夏令时开始当天的零点", time.Date(2026, 3, 8, 12, 0, 0, 0, newYork), "day", newYork, time.Date(2026, 3, 8, 0, 0, 0, 0, newYork)},
+		{"夏令时结束当天的零点", time.Date(2026, 11, 1, 23, 0, 0, 0, newYork), "day", newYork, time.Date(2026, 11, 1, 0, 0, 0, 0, newYork)},
+		{"未知桶宽原样返回", time.Date(2026, 10, 18, 9, 41, 0, 0, shanghai), "year", shanghai, time.Date(2026, 10, 18, 9, 41, 0, 0, shanghai)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := bucketStart(tt.at, tt.bucket, tt.loc); !got.Equal(tt.want) {
+				t.Errorf("bucketStart(%s, %s) = %s, 期望 %s", tt.at, tt.bucket, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNextBucket(t *testing.T) {
+	shanghai := mustLoadLocation(t, "Asia/Shanghai")
+	newYork := mustLoadLocation(t, "America/New_York")
+
+	tests := []struct {
+		name   string
+		start  time.Time
+		bucket string
+		want   time.Time
+		length time.Duration // 桶的实际时长
+	}{
+		{"分钟", time.Date(2026, 10, 18, 9, 59, 0, 0, shanghai), "minute", time.Date(2026, 10, 18, 10, 0, 0, 0, shanghai), time.Minute},
+		{"小时跨天", time.Date(2026, 10, 18, 23, 0, 0, 0, shanghai), "hour", time.Date(2026, 10, 19, 0, 0, 0, 0, shanghai), time.Hour},
+		{"夏令时开始的一天只有 23 小时", time.Date(2026, 3, 8, 0, 0, 0, 0, newYork), "day", time.Date(2026, 3, 9, 0, 0, 0, 0, newYork), 23 * time.Hour},
+		{"夏令时结束的一天有 25 小时", time.Date(2026, 11, 1, 0, 0, 0, 0, newYork), "day", time.Date(2026, 11, 2, 0, 0, 0, 0, newYork), 25 * time.Hour},
+		{"夏令时开始跳过 02:00", time.Date(2026, 3, 8, 1, 0, 0, 0, newYork), "hour", time.Date(2026, 3, 8, 3, 0, 0, 0, newYork), time.Hour},
+		{"周跨月", time.Date(2026, 9, 28, 0, 0, 0, 0, shanghai), "week", time.Date(2026, 10, 5, 0, 0, 0, 0, shanghai), 7 * 24 * time.Hour},
+		{"含夏令时切换的周", time.Date(2026, 10, 26, 0, 0, 0, 0, newYork), "week", time.Date(2026, 11, 2, 0, 0, 0, 0, newYork), 7*24*time.Hour + time.Hour},
+		{"二月", time.Date(2026, 2, 1, 0, 0, 0, 0, shanghai), "month", time.Date(2026, 3, 1, 0, 0, 0, 0, shanghai), 28 * 24 * time.Hour},
+		{"闰年二月", time.Date(2028, 2, 1, 0, 0, 0, 0, shanghai), "month", time.Date(2028, 3, 1, 0, 0, 0, 0, shanghai), 29 * 24 * time.Hour},
+		{"十二月跨年", time.Date(2026, 12, 1, 0, 0, 0, 0, shanghai), "month", time.Date(2027, 1, 1, 0, 0, 0, 0, shanghai), 31 * 24 * time.Hour},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := nextBucket(tt.start, tt.bucket)
+			if !got.Equal(tt.want) {
+				t.Errorf("nextBucket(%s, %s) = %s, 期望 %s", tt.start, tt.bucket, got, tt.want)
+			}
+			if d := got.Sub(tt.start); d != tt.length {
+				t.Errorf("桶时长 = %s, 期望 %s", d, tt.length)
+			}
+		})
+	}
+}
+
+func TestSearchBucket(t *testing.T) {
+	newYork := mustLoadLocation(t, "America/New_York")
+
+	// 夏令时结束当天（01:00-02:00 出现两次）的小时桶：起点按 nextBucket 逐个生成
+	from := time.Date(2026, 11, 1, 0, 0, 0, 0, newYork)
+	starts := []time.Time{from}
+	for i := 0; i < 4; i++ {
+		starts = append(starts, nextBucket(starts[len(starts)-1], "hour"))
+	}
+	firstOneAM := from.Add(time.Hour + 30*time.Minute)    // 01:30 EDT
+	secondOneAM := from.Add(2*time.Hour + 30*time.Minute) // 01:30 EST
+
+	tests := []struct {
+		name string
+		at   time.Time
+		want int
+	}{
+		{"早于第一个桶", from.Add(-time.Second), -1},
+		{"第一个桶起点", from, 0},
+		{"桶内", from.Add(59 * time.Minute), 0},
+		{"下一个桶起点", starts[1], 1},
+		{"第一次 01:30", firstOneAM, 1},
+		{"第二次 01:30 落在重复的小时", secondOneAM, 2},
+		{"最后一个桶", starts[4].Add(time.Minute), 4},
+		{"晚于最后一个桶起点时归入最后一个桶（查询范围已按 to 截断）", starts[4].Add(24 * time.Hour), 4},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := searchBucket(starts, tt.at); got != tt.want {
+				t.Errorf("searchBucket(%s) = %d, 期望 %d", tt.at, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,400 @@
+// 仪表盘用户与登录会话：bcrypt 密码、HMAC 签名的短期会话 Token、登出与过期
+
+package main
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// sessionTokenPrefix 会话 Token 的固定前缀：fcs_<载荷>.<签名>
+const sessionTokenPrefix = "fcs_"
+
+var (
+	sessionKey     []byte
+	sessionKeyOnce sync.Once
+)
+
+// loadSessionKey 读取会话签名密钥（数据目录下的 session.key），不存在时生成
+func loadSessionKey() []byte {
+	sessionKeyOnce.Do(func() {
+		path := filepath.Join(dataDir(), "session.key")
+
+		if data, err := os.ReadFile(path); err == nil && len(data) >= 32 {
+			sessionKey = data
+			return
+		}
+
+		key := make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			log.Fatal("生成会话签名密钥失败:", err)
+		}
+		if err := os.WriteFile(path, key, 0600); err != nil {
+			log.Printf("⚠️ 保存会话签名密钥失败，重启后已登录会话将失效: %v", err)
+		}
+		sessionKey = key
+	})
+	return sessionKey
+}
+
+func signSessionPayload(payload string) string {
+	mac := hmac.New(sha256.New, loadSessionKey())
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// newSessionToken 签发会话 Token，载荷为 "<会话 ID>:<过期时间戳>"
+func newSessionToken(sessionID string, expiresAt time.Time) string {
+	payload := base64.RawURLEncoding.EncodeToString([]byte(sessionID + ":" + strconv.FormatInt(expiresAt.Unix(), 10)))
+	return sessionTokenPrefix + payload + "." + signSessionPayload(payload)
+}
+
+// decodeSessionToken 校验签名并取出会话 ID 与过期时间戳，不检查是否过期
+func decodeSessionToken(token string) (string, int64, bool) {
+	body, ok := strings.CutPrefix(token, sessionTokenPrefix)
+	if !ok {
+		return "", 0, false
+	}
+	payload, sig, ok := strings.Cut(body, ".")
+	if !ok || !hmac.Equal([]byte(sig), []byte(signSessionPayload(payload))) {
+		return "", 0, false
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return "", 0, false
+	}
+	sessionID, exp, ok := strings.Cut(string(raw), ":")
+	if !ok {
+		return "", 0, false
+	}
+	expUnix, err := strconv.ParseInt(exp, 10, 64)
+	if err != nil {
+		return "", 0, false
+	}
+	return sessionID, expUnix, true
+}
+
+// parseSessionToken 校验签名与过期时间，返回会话 ID
+func parseSessionToken(token string) (string, bool) {
+	sessionID, expUnix, ok := decodeSessionToken(token)
+	if !ok || time.Now().Unix() >= expUnix {
+		return "", false
+	}
+	return sessionID, true
+}
+
+// authenticateSession 识别会话 Token：签名有效、未过期且未登出
+func authenticateSession(token string) (*Principal, bool) {
+	sessionID, ok := parseSessionToken(token)
+	if !ok {
+		return nil, false
+	}
+
+	session, err := store.GetActiveSession(sessionID)
+	if err != nil {
+		return nil, false
+	}
+	user, err := store.GetUser(session.UserID)
+	if err != nil {
+		return nil, false
+	}
+	return &Principal{Kind: "user", UserID: user.ID, Username: user.Username, Role: user.Role, SessionID: session.ID}, true
+}
+
+func hashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	return string(hash), err
+}
+
+func validatePassword(password string) error {
+	if len(password) < 8 {
+		return errors.New("密码长度至少 8 位")
+	}
+	return nil
+}
+
+// dummyPasswordHash 用户不存在时也做一次 bcrypt 比较，避免通过响应时间枚举用户名
+var dummyPasswordHash, _ = bcrypt.GenerateFromPassword([]byte("flowcollect"), bcrypt.DefaultCost)
+
+// checkPassword 校验用户名与密码，成功时返回用户
+func checkPassword(username, password string) (*User, bool) {
+	user, err := store.FindUser(username)
+	if err != nil {
+		bcrypt.CompareHashAndPassword(dummyPasswordHash, []byte(password))
+		return nil, false
+	}
+	if bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password)) != nil {
+		return nil, false
+	}
+	return user, true
+}
+
+// createSession 为用户创建登录会话，返回会话 Token 与过期时间
+func createSession(user *User, clientIP string) (string, time.Time, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", time.Time{}, err
+	}
+
+	confLock.RLock()
+	ttl := time.Duration(conf.SessionTTL) * time.Second
+	confLock.RUnlock()
+
+	now := time.Now()
+	session := UserSession{
+		ID:        hex.EncodeToString(b),
+		UserID:    user.ID,
+		ClientIP:  clientIP,
+		CreatedAt: now,
+		ExpiresAt: now.Add(ttl),
+	}
+	if err := store.CreateSession(&session); err != nil {
+		return "", time.Time{}, err
+	}
+	store.TouchUserLogin(user.ID, now)
+	return newSessionToken(session.ID, session.ExpiresAt), session.ExpiresAt, nil
+}
+
+// handleLogout POST /api/logout — 使当前会话立即失效
+func handleLogout(c *gin.Context) {
+	p := c.MustGet(principalKey).(*Principal)
+	if p.Kind != "user" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "当前凭据不是登录会话"})
+		return
+	}
+	if err := store.RevokeSession(p.SessionID, time.Now()); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	recordAuthEvent(c, "logout", p.Username, true, "")
+	log.Printf("[Auth] 用户 %s 已登出", p.Username)
+	c.JSON(http.StatusOK, gin.H{"message": "已登出"})
+}
+
+// handleMe GET /api/me — 返回当前登录用户，供前端校验会话是否仍有效
+func handleMe(c *gin.Context) {
+	p := c.MustGet(principalKey).(*Principal)
+	c.JSON(http.StatusOK, gin.H{"kind": p.Kind, "username": p.Username, "role": p.role(), "permissions": p.permissions()})
+}
+
+// cleanupSessions 删除已过期的会话记录
+func cleanupSessions() {
+	n, err := store.PurgeSessions(time.Now())
+	if err != nil {
+		log.Printf("清理过期会话失败: %v", err)
+	} else if n > 0 {
+		log.Printf("已清理 %d 个过期会话", n)
+	}
+}
+
+// createAdmin 创建管理员账号（-create-admin 启动参数）。
+// 密码取自环境变量 FLOWCOLLECT_ADMIN_PASSWORD，未设置时从标准输入读取一行。
+func createAdmin(username string) error {
+	username = strings.TrimSpace(username)
+	password := os.Getenv("FLOWCOLLECT_ADMIN_PASSWORD")
+	if password == "" {
+		fmt.Printf("请输入用户 %s 的密码: ", username)
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && line == "" {
+			return fmt.Errorf("读取密码失败: %w", err)
+		}
+		password = strings.TrimRight(line, "\r\n")
+	}
+	if err := validatePassword(password); err != nil {
+		return err
+	}
+
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+
+	user, err := store.FindUser(username)
+	switch {
+	case errors.Is(err, ErrNotFound):
+		if err := store.CreateUser(&User{Username: username, PasswordHash: hash, Role: RoleAdmin}); err != nil {
+			return err
+		}
+		log.Printf("✅ 已创建管理员账号: %s", username)
+	case err != nil:
+		return err
+	default:
+		// 已存在则重置密码并提升为管理员，用于找回登录
+		if err := store.UpdateUser(user.ID, map[string]any{"password_hash": hash, "role": RoleAdmin}); err != nil {
+			return err
+		}
+		revokeUserSessions(user.ID)
+		log.Printf("✅ 已重置管理员账号密码: %s（原有会话已失效）", username)
+	}
+	return nil
+}
+
+// revokeUserSessions 使用户的所有会话失效（改密、降权、删除账号时调用）
+func revokeUserSessions(userID uint) {
+	if err := store.RevokeUserSessions(userID, time.Now()); err != nil {
+		log.Printf("[Auth] 吊销用户 #%d 的会话失败: %v", userID, err)
+	}
+}
+
+// countOtherAdmins 统计除指定用户外的管理员数量，防止移除最后一个管理员
+func countOtherAdmins(userID uint) int64 {
+	n, _ := store.CountAdmins(userID)
+	return n
+}
+
+// userFromParam 按路由参数 :id 查找用户，不存在时已写出 404
+func userFromParam(c *gin.Context) (*User, bool) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err == nil {
+		if user, err := store.GetUser(uint(id)); err == nil {
+			return user, true
+		}
+	}
+	c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
+	return nil, false
+}
+
+// handleListUsers GET /api/users
+func handleListUsers(c *gin.Context) {
+	users, err := store.ListUsers()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"users": users})
+}
+
+// handleCreateUser POST /api/users — {username, password, role}
+func handleCreateUser(c *gin.Context) {
+	var req struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+		Role     string `json:"role"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil || strings.TrimSpace(req.Username) == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "username 不能为空"})
+		return
+	}
+	if req.Role == "" {
+		req.Role = RoleViewer
+	}
+	if !isUserRole(req.Role) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "无效的角色: " + req.Role})
+		return
+	}
+	if err := validatePassword(req.Password); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	hash, err := hashPassword(req.Password)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	user := User{Username: strings.TrimSpace(req.Username), PasswordHash: hash, Role: req.Role}
+	if err := store.CreateUser(&user); err != nil {
+		if errors.Is(err, ErrDuplicate) {
+			c.JSON(http.StatusConflict, gin.H{"error": "用户名已存在"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	log.Printf("[Auth] %s 创建了用户 %s (%s)", c.MustGet(principalKey).(*Principal), user.Username, user.Role)
+	c.JSON(http.StatusOK, gin.H{"user": user})
+}
+
+// handleUpdateUser PUT /api/users/:id — 修改角色和/或重置密码，已有会话随之失效
+func handleUpdateUser(c *gin.Context) {
+	user, ok := userFromParam(c)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		Password string `json:"password"`
+		Role     string `json:"role"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	updates := map[string]any{}
+	if req.Role != "" && req.Role != user.Role {
+		if !isUserRole(req.Role) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "无效的角色: " + req.Role})
+			return
+		}
+		if user.Role == RoleAdmin && countOtherAdmins(user.ID) == 0 {
+			c.JSON(http.StatusConflict, gin.H{"error": "不能降级最后一个管理员"})
+			return
+		}
+		updates["role"] = req.Role
+	}
+	if req.Password != "" {
+		if err := validatePassword(req.Password); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		hash, err := hashPassword(req.Password)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		updates["password_hash"] = hash
+	}
+	if len(updates) == 0 {
+		c.JSON(http.StatusOK, gin.H{"user": user})
+		return
+	}
+
+	if err := store.UpdateUser(user.ID, updates); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if role, ok := updates["role"].(string); ok {
+		user.Role = role
+	}
+	revokeUserSessions(user.ID)
+	log.Printf("[Auth] %s 修改了用户 %s (角色: %s)", c.MustGet(principalKey).(*Principal), user.Username, user.Role)
+	c.JSON(http.StatusOK, gin.H{"user": user})
+}
+
+// handleDeleteUser DELETE /api/users/:id
+func handleDeleteUser(c *gin.Context) {
+	user, ok := userFromParam(c)
+	if !ok {
+		return
+	}
+	if user.Role == RoleAdmin && countOtherAdmins(user.ID) == 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "不能删除最后一个管理员"})
+		return
+	}
+
+	if err := store.DeleteUser(user.ID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	revokeUserSessions(user.ID)
+	log.Printf("[Auth] %s 删除了用户 %s", c.MustGet(principalKey).(*Principal), user.Username)
+	c.JSON(http.StatusOK, gin.H{"message": "已删除"})
+}
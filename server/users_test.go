@@ -0,0 +1,31 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func TestCreateUserDuplicate(t *testing.T) {
+	s, err := openGormStore("sqlite", filepath.Join(t.TempDir(), "traffic.db"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if err := s.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.CreateUser(&User{Username: "alice", PasswordHash: "x", Role: RoleViewer}); err != nil {
+		t.Fatalf("创建用户失败: %v", err)
+	}
+	if err := s.CreateUser(&User{Username: "alice", PasswordHash: "y", Role: RoleAdmin}); !errors.Is(err, ErrDuplicate) {
+		t.Errorf("重复用户名返回 %v, 期望 ErrDuplicate", err)
+	}
+
+	// 其他错误原样返回，由调用方按 500 处理
+	s.Close()
+	if err := s.CreateUser(&User{Username: "bob", PasswordHash: "z", Role: RoleViewer}); err == nil || errors.Is(err, ErrDuplicate) {
+		t.Errorf("数据库已关闭时返回 %v, 期望非 ErrDuplicate 的错误", err)
+	}
+}
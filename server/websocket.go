@@ -1,10 +1,14 @@
-// WebSocket 实时上报接收端点
+// WebSocket 实时上报接收端点（仪表盘订阅端点见 live.go）
 
 package main
 
 import (
+	"encoding/json"
 	"log"
 	"net/http"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -20,17 +24,320 @@ var upgrader = websocket.Upgrader{
 	},
 }
 
+// wsFrameHeader 所有上报帧共有的头部。Stream/Seq 由客户端发件箱分配，旧版客户端不携带
+type wsFrameHeader struct {
+	Type   string `json:"type"`
+	Stream string `json:"stream"`
+	Seq    uint64 `json:"seq"`
+}
+
+// wsTrafficFrame 节点流量增量（type 为 "traffic"，旧版客户端不带 type 字段）
+type wsTrafficFrame struct {
+	Timestamp   int64  `json:"timestamp"`
+	DeviceID    string `json:"device_id"`
+	NodeName    string `json:"node_name"`
+	UpDelta     int64  `json:"up_delta"`
+	DownDelta   int64  `json:"down_delta"`
+	IsProxy     bool   `json:"is_proxy"`
+	ActiveConns int    `json:"active_connections"`
+}
+
+// wsConnFrame 已关闭连接的审计记录（type 为 "conn"）
+type wsConnFrame struct {
+	DeviceID    string   `json:"device_id"`
+	ConnID      string   `json:"conn_id"`
+	Start       int64    `json:"start"`
+	End         int64    `json:"end"`
+	Duration    int64    `json:"duration"`
+	Network     string   `json:"network"`
+	ConnType    string   `json:"conn_type"`
+	SourceIP    string   `json:"source_ip"`
+	SourcePort  string   `json:"source_port"`
+	DestIP      string   `json:"dest_ip"`
+	DestPort    string   `json:"dest_port"`
+	Host        string   `json:"host"`
+	Rule        string   `json:"rule"`
+	RulePayload string   `json:"rule_payload"`
+	Process     string   `json:"process"`
+	ProcessPath string   `json:"process_path"`
+	Chains      []string `json:"chains"`
+	NodeName    string   `json:"node_name"`
+	Upload      int64    `json:"upload"`
+	Download    int64    `json:"download"`
+	IsProxy     bool     `json:"is_proxy"`
+}
+
+// wsBatchFrame 一个上报周期内的流量增量与已关闭连接（type 为 "batch"）
+type wsBatchFrame struct {
+	Timestamp int64            `json:"timestamp"`
+	DeviceID  string           `json:"device_id"`
+	Traffic   []wsTrafficFrame `json:"traffic"`
+	Conns     []wsConnFrame    `json:"conns"`
+}
+
+func (f wsTrafficFrame) record() TrafficRecord {
+	return TrafficRecord{
+		Timestamp:   time.Unix(f.Timestamp, 0),
+		DeviceID:    f.DeviceID,
+		NodeName:    f.NodeName,
+		UpDelta:     f.UpDelta,
+		DownDelta:   f.DownDelta,
+		IsProxy:     f.IsProxy,
+		ActiveConns: f.ActiveConns,
+	}
+}
+
+func (f wsConnFrame) record() ConnectionRecord {
+	return ConnectionRecord{
+		DeviceID:    f.DeviceID,
+		ConnID:      f.ConnID,
+		StartTime:   time.UnixMilli(f.Start),
+		EndTime:     time.UnixMilli(f.End),
+		Duration:    f.Duration,
+		Network:     f.Network,
+		ConnType:    f.ConnType,
+		SourceIP:    f.SourceIP,
+		SourcePort:  f.SourcePort,
+		DestIP:      f.DestIP,
+		DestPort:    f.DestPort,
+		Host:        f.Host,
+		Rule:        f.Rule,
+		RulePayload: f.RulePayload,
+		Process:     f.Process,
+		ProcessPath: f.ProcessPath,
+		Chains:      strings.Join(f.Chains, " > "),
+		NodeName:    f.NodeName,
+		Upload:      f.Upload,
+		Download:    f.Download,
+		IsProxy:     f.IsProxy,
+	}
+}
+
+// wsHelloFrame 客户端连接后发送的握手帧（type 为 "hello"），不经发件箱、无需确认
+type wsHelloFrame struct {
+	DeviceID          string   `json:"device_id"`
+	ClientVersion     string   `json:"client_version"`
+	OS                string   `json:"os"`
+	Arch              string   `json:"arch"`
+	MihomoVersion     string   `json:"mihomo_version"`
+	ConfigHash        string   `json:"config_hash"`
+	HeartbeatInterval int      `json:"heartbeat_interval"` // 秒，0 表示客户端不发送心跳
+	Capabilities      []string `json:"capabilities"`       // 客户端支持的可选功能，如 "commands"
+}
+
+// wsHeartbeatFrame 客户端定期发送的本地健康状态（type 为 "heartbeat"），不经发件箱、无需确认
+type wsHeartbeatFrame struct {
+	DeviceID        string `json:"device_id"`
+	Timestamp       int64  `json:"timestamp"`
+	MihomoReachable bool   `json:"mihomo_reachable"`
+	QueueDepth      int64  `json:"queue_depth"`
+	Dropped         int64  `json:"dropped"`
+}
+
+func (f wsHelloFrame) hello() DeviceHello {
+	return DeviceHello{
+		ClientVersion: f.ClientVersion,
+		OS:            f.OS,
+		Arch:          f.Arch,
+		MihomoVersion: f.MihomoVersion,
+		ConfigHash:    f.ConfigHash,
+	}
+}
+
+// wsAck 服务端回复的确认帧：Ranges 中每个 [from, to] 区间的帧均已成功入库
+type wsAck struct {
+	Type   string      `json:"type"`
+	Stream string      `json:"stream"`
+	Ranges [][2]uint64 `json:"ranges"`
+}
+
+const (
+	ackFlushInterval = 200 * time.Millisecond // 确认帧的合并发送周期
+	ackFlushSize     = 100                    // 累积到该数量时立即发送
+	wsWriteTimeout   = 10 * time.Second       // 单次写出的超时，客户端不读时及时断开而不是卡住 writeLoop
+)
+
+// wsSession 单个设备连接的发送端。gorilla/websocket 不允许并发写，
+// 所有下行消息都经由 writeLoop 串行写出。
+type wsSession struct {
+	conn          *websocket.Conn
+	principal     *Principal
+	deviceID      string // 设备 Token 连接建立时即确定；ServerToken 连接取第一帧的 device_id
+	remoteIP      string
+	clientVersion string
+	startedAt     time.Time
+	recordID      uint          // 对应的 DeviceSession 记录，绑定设备后写入
+	touchedAt     time.Time     // 最近一次写入活跃时间的时刻
+	readTimeout   time.Duration // 客户端声明心跳间隔后启用，超时未收到任何消息即断开
+	commands      bool          // 客户端在 hello 中声明支持远程命令（受 wsSessionsMu 保护）
+	ackMu         sync.Mutex
+	acks          map[string][]uint64 // 待回复的确认（按流），由 ackMu 保护、不设上限
+	ackCount      int
+	ackReady      chan struct{} // 待回复确认达到 ackFlushSize 时通知 writeLoop 立即发送
+	out           chan any      // 待写出的下行消息（命令等）
+	done          chan struct{} // 读循环结束时关闭，通知 writeLoop 退出
+	closed        chan struct{} // writeLoop 退出时关闭
+}
+
+func newWSSession(conn *websocket.Conn, p *Principal, remoteIP, clientVersion string) *wsSession {
+	return &wsSession{
+		conn:          conn,
+		principal:     p,
+		remoteIP:      remoteIP,
+		clientVersion: clientVersion,
+		startedAt:     time.Now(),
+		acks:          make(map[string][]uint64),
+		ackReady:      make(chan struct{}, 1),
+		out:           make(chan any, 16),
+		done:          make(chan struct{}),
+		closed:        make(chan struct{}),
+	}
+}
+
+// 在线的设备连接，吊销 Token 时据此断开对应连接（每个设备的在线状态见 presence.go）
+var (
+	wsSessions   = make(map[*wsSession]struct{})
+	wsSessionsMu sync.Mutex
+)
+
+func registerSession(s *wsSession) {
+	wsSessionsMu.Lock()
+	wsSessions[s] = struct{}{}
+	wsSessionsMu.Unlock()
+}
+
+func unregisterSession(s *wsSession) {
+	wsSessionsMu.Lock()
+	delete(wsSessions, s)
+	wsSessionsMu.Unlock()
+	s.unbindDevice()
+}
+
+// closeSessionsByToken 断开所有使用指定设备 Token 的连接，返回断开的数量
+func closeSessionsByToken(tokenID uint) int {
+	wsSessionsMu.Lock()
+	defer wsSessionsMu.Unlock()
+
+	n := 0
+	for s := range wsSessions {
+		if s.principal.Kind == "device" && s.principal.TokenID == tokenID {
+			s.conn.Close()
+			n++
+		}
+	}
+	return n
+}
+
+// ack 登记一个已入库的序号，由 writeLoop 合并成区间后回复。
+// 在全局入库协程中调用，因此从不阻塞：确认先存入会话自己的队列，连接已关闭时随会话一起丢弃
+func (s *wsSession) ack(stream string, seq uint64) {
+	s.ackMu.Lock()
+	s.acks[stream] = append(s.acks[stream], seq)
+	s.ackCount++
+	full := s.ackCount >= ackFlushSize
+	s.ackMu.Unlock()
+
+	if full {
+		select {
+		case s.ackReady <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// takeAcks 取走全部待回复的确认
+func (s *wsSession) takeAcks() map[string][]uint64 {
+	s.ackMu.Lock()
+	defer s.ackMu.Unlock()
+	if s.ackCount == 0 {
+		return nil
+	}
+	acks := s.acks
+	s.acks = make(map[string][]uint64)
+	s.ackCount = 0
+	return acks
+}
+
+// write 带写超时地写出一条消息
+func (s *wsSession) write(v any) error {
+	s.conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+	return s.conn.WriteJSON(v)
+}
+
+// send 投递一条下行消息，由 writeLoop 写出；连接已关闭时返回 false
+func (s *wsSession) send(v any) bool {
+	select {
+	case s.out <- v:
+		return true
+	case <-s.closed:
+		return false
+	}
+}
+
+func (s *wsSession) writeLoop() {
+	defer close(s.closed)
+
+	ticker := time.NewTicker(ackFlushInterval)
+	defer ticker.Stop()
+
+	flush := func() error {
+		for stream, seqs := range s.takeAcks() {
+			if err := s.write(wsAck{Type: "ack", Stream: stream, Ranges: seqRanges(seqs)}); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	for {
+		var err error
+		select {
+		case <-s.ackReady:
+			err = flush()
+		case <-ticker.C:
+			err = flush()
+		case v := <-s.out:
+			err = s.write(v)
+		case <-s.done:
+			flush()
+			return
+		}
+		if err != nil {
+			log.Printf("[WS] 写出下行消息失败: %v", err)
+			s.conn.Close()
+			return
+		}
+	}
+}
+
+// seqRanges 将序号列表合并为连续区间
+func seqRanges(seqs []uint64) [][2]uint64 {
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+	var ranges [][2]uint64
+	for _, seq := range seqs {
+		if n := len(ranges); n > 0 && seq <= ranges[n-1][1]+1 {
+			if seq > ranges[n-1][1] {
+				ranges[n-1][1] = seq
+			}
+			continue
+		}
+		ranges = append(ranges, [2]uint64{seq, seq})
+	}
+	return ranges
+}
+
 // handleWS upgrades the HTTP connection to WebSocket and receives real-time traffic reports.
-// The client connects to GET /ws with Authorization: Bearer <token> header.
+// The client connects to GET /ws with Authorization: Bearer <token> header, where the token
+// is either a per-device token (reports are bound to that device) or the legacy ServerToken.
+// Frames carrying a stream/seq header are acknowledged only after the DB write succeeds;
+// on a write failure the connection is dropped so the client replays from its last ack.
 func handleWS(c *gin.Context) {
 	// Authenticate via header (sent during WebSocket handshake)
-	confLock.RLock()
-	token := conf.ServerToken
-	confLock.RUnlock()
-
-	authHeader := c.GetHeader("Authorization")
-	if authHeader != "Bearer "+token {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+	principal, ok := authenticateGuarded(c, "bearer", bearerToken(c), false)
+	if !ok {
+		return
+	}
+	if !authorize(c, principal, PermReportWrite) {
 		return
 	}
 
@@ -41,20 +348,31 @@ func handleWS(c *gin.Context) {
 	}
 	defer conn.Close()
 
-	log.Printf("[WS] 客户端已连接: %s", c.ClientIP())
+	if principal.Kind == "device" {
+		log.Printf("[WS] 客户端已连接: %s (设备: %s, Token #%d)", c.ClientIP(), principal.DeviceID, principal.TokenID)
+	} else {
+		log.Printf("[WS] 客户端已连接: %s (ServerToken)", c.ClientIP())
+	}
+
+	session := newWSSession(conn, principal, c.ClientIP(), c.GetHeader(clientVersionHeader))
+	registerSession(session)
+	if principal.Kind == "device" {
+		session.bindDeviceID(principal.DeviceID)
+	}
+	go session.writeLoop()
+	failed := false // 由写入管线设置：前序帧写入失败后拒绝本连接的后续帧
+	defer func() {
+		unregisterSession(session)
+		close(session.done)
+		<-session.closed
+		log.Printf("[WS] 连接关闭: %s", c.ClientIP())
+	}()
 
 	for {
-		var data struct {
-			Timestamp   int64  `json:"timestamp"`
-			DeviceID    string `json:"device_id"`
-			NodeName    string `json:"node_name"`
-			UpDelta     int64  `json:"up_delta"`
-			DownDelta   int64  `json:"down_delta"`
-			IsProxy     bool   `json:"is_proxy"`
-			ActiveConns int    `json:"active_connections"`
+		if session.readTimeout > 0 {
+			conn.SetReadDeadline(time.Now().Add(session.readTimeout))
 		}
-
-		err := conn.ReadJSON(&data)
+		_, msg, err := conn.ReadMessage()
 		if err != nil {
 			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseNormalClosure) {
 				log.Printf("[WS] 读取错误: %v", err)
@@ -63,25 +381,103 @@ func handleWS(c *gin.Context) {
 			}
 			break
 		}
+		session.touch(time.Now())
 
-		// Write to database (same logic as handleReport)
-		result := db.Create(&TrafficRecord{
-			Timestamp:   time.Unix(data.Timestamp, 0),
-			DeviceID:    data.DeviceID,
-			NodeName:    data.NodeName,
-			UpDelta:     data.UpDelta,
-			DownDelta:   data.DownDelta,
-			IsProxy:     data.IsProxy,
-			ActiveConns: data.ActiveConns,
-		})
+		var head wsFrameHeader
+		if err := json.Unmarshal(msg, &head); err != nil {
+			log.Printf("[WS] 无法解析消息: %v", err)
+			continue
+		}
 
-		if result.Error != nil {
-			log.Printf("[WS] 数据库写入失败: %v", result.Error)
-		} else {
-			log.Printf("[WS] 已接收 | 设备: %s | 节点: %s | ↑%d ↓%d | 连接数: %d",
-				data.DeviceID, data.NodeName, data.UpDelta, data.DownDelta, data.ActiveConns)
+		switch head.Type {
+		case "hello":
+			session.handleHello(msg)
+			continue
+		case "heartbeat":
+			session.handleHeartbeat(msg)
+			continue
+		case "command_result":
+			session.handleCommandResult(msg)
+			continue
+		case "latency":
+			session.handleLatency(msg)
+			continue
+		}
+
+		job, err := decodeFrame(head, msg)
+		if err != nil || job == nil {
+			// 无法处理的帧也要确认，否则客户端会一直卡在该序号上反复重发
+			if err != nil {
+				log.Printf("[WS] 消息格式错误 (type=%s): %v，已确认并丢弃", head.Type, err)
+			} else {
+				log.Printf("[WS] 未知消息类型: %s，已确认并丢弃", head.Type)
+			}
+			if head.Seq > 0 {
+				session.ack(head.Stream, head.Seq)
+			}
+			continue
+		}
+
+		job.bindDevice(principal)
+		if err := checkLegacyReport(principal, job.deviceID); err != nil {
+			log.Printf("[WS] 拒绝连接 %s: %v", c.ClientIP(), err)
+			break
+		}
+		session.bindDeviceID(job.deviceID)
+		job.failed = &failed
+		job.done = func(dup bool, err error) {
+			if err != nil {
+				log.Printf("[WS] 数据库写入失败，断开连接等待客户端重放 (设备: %s, seq: %d): %v", job.deviceID, head.Seq, err)
+				conn.Close()
+				return
+			}
+			if dup {
+				log.Printf("[WS] 跳过重复帧 | 设备: %s | seq: %d", job.deviceID, head.Seq)
+			}
+			if head.Seq > 0 {
+				session.ack(head.Stream, head.Seq)
+			}
 		}
+		submitIngest(job)
 	}
+}
+
+// decodeFrame 将上报帧解析为写入任务；未知类型返回 nil
+func decodeFrame(head wsFrameHeader, msg []byte) (*ingestJob, error) {
+	job := &ingestJob{head: head}
 
-	log.Printf("[WS] 连接关闭: %s", c.ClientIP())
+	switch head.Type {
+	case "", "traffic":
+		var data wsTrafficFrame
+		if err := json.Unmarshal(msg, &data); err != nil {
+			return nil, err
+		}
+		job.deviceID = data.DeviceID
+		job.traffic = []TrafficRecord{data.record()}
+
+	case "conn":
+		var data wsConnFrame
+		if err := json.Unmarshal(msg, &data); err != nil {
+			return nil, err
+		}
+		job.deviceID = data.DeviceID
+		job.conns = []ConnectionRecord{data.record()}
+
+	case "batch":
+		var data wsBatchFrame
+		if err := json.Unmarshal(msg, &data); err != nil {
+			return nil, err
+		}
+		job.deviceID = data.DeviceID
+		for _, t := range data.Traffic {
+			job.traffic = append(job.traffic, t.record())
+		}
+		for _, c := range data.Conns {
+			job.conns = append(job.conns, c.record())
+		}
+
+	default:
+		return nil, nil
+	}
+	return job, nil
 }
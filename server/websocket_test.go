@@ -0,0 +1,31 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSeqRanges(t *testing.T) {
+	tests := []struct {
+		name string
+		seqs []uint64
+		want [][2]uint64
+	}{
+		{"空", nil, nil},
+		{"单个", []uint64{7}, [][2]uint64{{7, 7}}},
+		{"连续", []uint64{1, 2, 3, 4}, [][2]uint64{{1, 4}}},
+		{"乱序", []uint64{4, 1, 3, 2}, [][2]uint64{{1, 4}}},
+		{"有空洞", []uint64{1, 2, 5, 6, 9}, [][2]uint64{{1, 2}, {5, 6}, {9, 9}}},
+		{"重复", []uint64{3, 3, 4, 4, 4, 5}, [][2]uint64{{3, 5}}},
+		{"重复与空洞混合", []uint64{10, 2, 2, 11, 1, 10, 20}, [][2]uint64{{1, 2}, {10, 11}, {20, 20}}},
+		{"相差 2 不合并", []uint64{1, 3}, [][2]uint64{{1, 1}, {3, 3}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := seqRanges(tt.seqs); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("seqRanges(%v) = %v, 期望 %v", tt.seqs, got, tt.want)
+			}
+		})
+	}
+}
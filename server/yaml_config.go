@@ -25,6 +25,8 @@ const (
 	TemplatesDir = "./templates"
 	RuleDir      = TemplatesDir + "/RuleSet"
 	CSVFile      = TemplatesDir + "/86_rule_set_collect.csv"
+
+	TargetMapFile = TemplatesDir + "/86_target_map.csv" // 规则目标 → 规则集文件映射
 )
 
 // HandleTriggerUpdate 触发 Go 版本的节点和规则更新，并发送邮件通知 (HTTP Handler)
@@ -145,30 +147,6 @@ func downloadFile(url, tempFilePath string, logger *log.Logger) error {
 	return nil
 }
 
-// getTargetFile 根据 target 映射对应的文件名
-func getTargetFile(target string) string {
-	switch target {
-	case "Japan":
-		return "86JPRules.yaml"
-	case "JP":
-		return "86JPRules.yaml"
-	case "HK":
-		return "86HKRules.yaml"
-	case "US":
-		return "86USRules.yaml"
-	case "bemly":
-		return "86BemlyRules.yaml"
-	case "Switch":
-		return "86SwitchRules.yaml"
-	case "DIRECT":
-		return "86DirectRules.yaml"
-	case "REJECT":
-		return "86RejectRules.yaml"
-	default:
-		return ""
-	}
-}
-
 // processRules 处理规则生成逻辑
 func processRules(logger *log.Logger) error {
 	if _, err := os.Stat(CSVFile); os.IsNotExist(err) {
@@ -204,6 +182,8 @@ func processRules(logger *log.Logger) error {
 	tempRawFile := filepath.Join(TemplatesDir, "raw.tmp")
 	defer os.Remove(tempRawFile) // 确保退出时删除临时文件
 
+	targets := loadRuleTargets()
+
 	// 统计变量
 	totalProcessed := 0
 	totalSkipped := 0
@@ -227,16 +207,19 @@ func processRules(logger *log.Logger) error {
 		}
 		totalEntries++
 
-		targetFile := filepath.Join(RuleDir, getTargetFile(target))
-		if getTargetFile(target) == "" {
-			logger.Printf("  ⚠️  跳过 %s: 未知 target '%s'", name, target)
+		fileName := targets.file(target)
+		if fileName == "" {
+			logger.Printf("  ⚠️  跳过 %s: target '%s' 不能直接作为文件名，请在 %s 中添加映射", name, target, filepath.Base(TargetMapFile))
 			totalSkipped++
 			continue
 		}
-		if _, err := os.Stat(targetFile); os.IsNotExist(err) {
-			logger.Printf("  ⚠️  跳过 %s: 目标文件 %s 不存在", name, targetFile)
+		targetFile := filepath.Join(RuleDir, fileName)
+		if created, err := ensureRuleFile(targetFile); err != nil {
+			logger.Printf("  ⚠️  跳过 %s: 无法创建目标文件 %s: %v", name, targetFile, err)
 			totalSkipped++
 			continue
+		} else if created {
+			logger.Printf("  📄 新建规则集文件 %s (target=%s)", fileName, target)
 		}
 
 		logger.Printf("  -> %s (target=%s, behavior=%s)", name, target, behavior)
@@ -274,7 +257,7 @@ func processRules(logger *log.Logger) error {
 	logger.Printf("-------- CSV 编译统计 (共 %d 条) --------", totalEntries)
 	logger.Printf("  成功: %d | 规则: %d 条", totalProcessed, totalRules)
 	if totalSkipped > 0 {
-		logger.Printf("  跳过: %d (未知 target 或目标文件不存在)", totalSkipped)
+		logger.Printf("  跳过: %d (target 无法映射或目标文件无法创建)", totalSkipped)
 	}
 	if totalDownloadFailed > 0 {
 		logger.Printf("  下载失败: %d", totalDownloadFailed)
@@ -462,7 +445,7 @@ func ExtractConfigFromMainSub(filename string) (string, string, error) {
 	return listenPort, secret, nil
 }
 
-// watchCSV 监听 86_rule_set_collect.csv 文件变化，自动重新编译规则集
+// watchCSV 监听 86_rule_set_collect.csv 与规则目标映射 86_target_map.csv 的变化，自动重新编译规则集
 func watchCSV() {
 	watcher, err := fsnotify.NewWatcher()
 	if err != nil {
@@ -476,7 +459,11 @@ func watchCSV() {
 		return
 	}
 
-	log.Printf("[CSV] 正在监听 %s 的变化...", CSVFile)
+	if err := watcher.Add(TargetMapFile); err == nil {
+		log.Printf("[CSV] 正在监听 %s 与 %s 的变化...", CSVFile, TargetMapFile)
+	} else {
+		log.Printf("[CSV] 正在监听 %s 的变化...（%s 不可用: %v）", CSVFile, TargetMapFile, err)
+	}
 
 	// 防抖：文件可能短时间内多次写入，等待 2 秒后统一处理
 	var debounceTimer *time.Timer
@@ -1,4 +1,5 @@
 import { createRouter, createWebHistory, type RouteRecordRaw } from 'vue-router'
+import { buildApiUrl, onSessionExpired } from '@/utils/http'
 
 // 定义路由元信息类型
 declare module 'vue-router' {
@@ -65,10 +66,20 @@ router.beforeEach(async (to, from) => {
     }
 })
 
-// 验证token的函数（示例）
+// 会话在使用中失效（apiFetch 收到 401）时回到登录页
+onSessionExpired(() => {
+    const current = router.currentRoute.value
+    if (current.meta.requiresAuth) {
+        router.push({ name: 'Login', query: { redirect: current.fullPath } })
+    }
+})
+
+// 验证会话是否仍有效（登出或过期后服务端返回 401）
 async function verifyToken(token: string): Promise<boolean> {
-    // 这里实现token验证逻辑
-    return true
+    const res = await fetch(buildApiUrl('/api/me'), {
+        headers: { 'Authorization': `Bearer ${token}` }
+    })
+    return res.ok
 }
 
 export default router
\ No newline at end of file
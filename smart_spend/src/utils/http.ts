@@ -27,6 +27,27 @@ export function toWsUrl(baseUrl: string): string {
   return baseUrl.replace(/^http/, 'ws')
 }
 
+const sessionExpiredListeners = new Set<() => void>()
+
+/**
+ * 注册会话失效回调（如跳转登录页、断开 /ws/live）
+ * @returns 取消注册函数
+ */
+export function onSessionExpired(listener: () => void): () => void {
+  sessionExpiredListeners.add(listener)
+  return () => sessionExpiredListeners.delete(listener)
+}
+
+/**
+ * 会话失效（过期、登出或被吊销）：清除本地 Token 并通知各订阅方。
+ * 不再用失效的 Token 继续请求，否则会被服务端计入失败次数
+ */
+export function expireSession(): void {
+  if (!localStorage.getItem('token')) return
+  localStorage.removeItem('token')
+  sessionExpiredListeners.forEach((listener) => listener())
+}
+
 /**
  * 封装 fetch，自动拼接 BASE_URL 和 Authorization header
  * @param path - API 路径，如 '/api/stats'
@@ -49,6 +70,11 @@ export async function apiFetch<T = any>(
 
   const res = await fetch(url, { ...options, headers })
 
+  // 携带 Token 仍返回 401 说明会话已失效（登录接口的 401 是密码错误，此时本地没有 Token）
+  if (res.status === 401 && token) {
+    expireSession()
+  }
+
   if (!res.ok) {
     throw new Error(`API request failed: ${res.status} ${res.statusText}`)
   }
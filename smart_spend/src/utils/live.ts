@@ -0,0 +1,73 @@
+/**
+ * 实时推送订阅模块
+ * 所有组件共用一条 /ws/live 连接，服务端推送 hello / traffic / throughput / device 消息
+ */
+
+import { apiFetch, onSessionExpired } from './http'
+import { createWebSocket } from './ws'
+
+export type LiveHandler = (msg: any) => void
+
+const handlers = new Set<LiveHandler>()
+let closeLive: (() => void) | null = null
+
+/**
+ * 订阅实时消息，首个订阅者建立连接，最后一个取消时断开
+ * @param handler - 消息回调
+ * @returns 取消订阅函数
+ */
+export function subscribeLive(handler: LiveHandler): () => void {
+  handlers.add(handler)
+  if (!closeLive) {
+    // 浏览器无法为 WebSocket 设置 Authorization 头，会话 Token 通过查询参数传递
+    const token = localStorage.getItem('token') || ''
+    closeLive = createWebSocket({
+      path: `/ws/live?token=${encodeURIComponent(token)}`,
+      onMessage: (msg) => handlers.forEach((h) => h(msg)),
+      // 浏览器拿不到握手失败的状态码：断开后用 /api/me 确认会话，401 时由 apiFetch 触发 expireSession 停止重连
+      onClose: () => {
+        apiFetch('/api/me').catch(() => {})
+      },
+    })
+  }
+  return () => {
+    handlers.delete(handler)
+    if (handlers.size === 0 && closeLive) {
+      closeLive()
+      closeLive = null
+    }
+  }
+}
+
+// 会话失效后断开连接，不再带着失效的 Token 重连；重新登录后由下一个订阅者重新建立
+onSessionExpired(() => {
+  if (closeLive) {
+    closeLive()
+    closeLive = null
+  }
+})
+
+/**
+ * 有新入库流量或设备上下线时调用 refresh，两次调用至少间隔 minInterval 毫秒
+ * @returns 取消订阅函数
+ */
+export function refreshOnLive(refresh: () => void, minInterval = 5000): () => void {
+  let last = 0
+  let timer: ReturnType<typeof setTimeout> | null = null
+
+  const unsubscribe = subscribeLive((msg) => {
+    if (msg?.type !== 'traffic' && msg?.type !== 'device') return
+    if (timer) return
+    const wait = Math.max(0, last + minInterval - Date.now())
+    timer = setTimeout(() => {
+      timer = null
+      last = Date.now()
+      refresh()
+    }, wait)
+  })
+
+  return () => {
+    if (timer) clearTimeout(timer)
+    unsubscribe()
+  }
+}